@@ -0,0 +1,316 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+	"github.com/ipfs/go-ipfs/core/coreapi/interface/options"
+	"github.com/ipfs/go-ipfs/core/corerepo"
+)
+
+// backend stores, resolves and pins nodes. ipfsBackend uses an IPFS node.
+// memBackend keeps nodes in memory and is selected with store.inmemory,
+// for tests of the tree logic that do not need IPFS.
+type backend interface {
+	// get returns the node at p, which may resolve links below a CID.
+	get(ctx context.Context, p coreiface.Path) (ipldNode, error)
+	// resolve returns the CID of the node at p.
+	resolve(ctx context.Context, p coreiface.Path) (cid.Cid, error)
+	// put stores nodes.
+	put(ctx context.Context, nodes []ipldNode) error
+	// has reports whether c is stored locally.
+	has(ctx context.Context, c cid.Cid) (bool, error)
+	pin(ctx context.Context, p coreiface.Path, recursive bool) error
+	unpin(ctx context.Context, p coreiface.Path) error
+	// pinned reports whether c is pinned directly or recursively, not
+	// counting an indirect pin through another node.
+	pinned(ctx context.Context, c cid.Cid) (bool, error)
+	// publish points the IPNS name of key at p and returns the name.
+	publish(ctx context.Context, p coreiface.Path, key string) (string, error)
+	// resolveName returns the path an IPNS name points at.
+	resolveName(ctx context.Context, name string) (coreiface.Path, error)
+	// gc removes the nodes that are not pinned and returns how many.
+	gc(ctx context.Context) (int, error)
+	// sync forces the stored nodes to disk.
+	sync(ctx context.Context) error
+}
+
+type ipfsBackend struct {
+	api  coreiface.CoreAPI
+	ipfs *core.IpfsNode
+}
+
+func newIPFSBackend(ipfs *core.IpfsNode) *ipfsBackend {
+	return &ipfsBackend{api: coreapi.NewCoreAPI(ipfs), ipfs: ipfs}
+}
+
+func (b *ipfsBackend) get(ctx context.Context, p coreiface.Path) (ipldNode, error) {
+	nd, err := b.api.Dag().Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if cnode, ok := nd.(*cbor.Node); ok {
+		return cnode, nil
+	}
+	return decodeNode(nd.RawData(), nd.Cid())
+}
+
+func (b *ipfsBackend) resolve(ctx context.Context, p coreiface.Path) (cid.Cid, error) {
+	rp, err := b.api.ResolvePath(ctx, p)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return rp.Cid(), nil
+}
+
+// put writes nodes in a single DAG batch. Puts do not resolve the links of
+// the node being put.
+func (b *ipfsBackend) put(ctx context.Context, nodes []ipldNode) error {
+	dagBatch := b.api.Dag().Batch(ctx)
+	for _, n := range nodes {
+		_, err := dagBatch.Put(ctx, bytes.NewReader(n.RawData()), dagPutOptions(n.Cid())...)
+		if err != nil {
+			return err
+		}
+	}
+	return dagBatch.Commit(ctx)
+}
+
+func (b *ipfsBackend) has(ctx context.Context, c cid.Cid) (bool, error) {
+	return b.ipfs.Blockstore.Has(c)
+}
+
+func (b *ipfsBackend) pin(ctx context.Context, p coreiface.Path, recursive bool) error {
+	return b.api.Pin().Add(ctx, p, options.Pin.Recursive(recursive))
+}
+
+func (b *ipfsBackend) unpin(ctx context.Context, p coreiface.Path) error {
+	return b.api.Pin().Rm(ctx, p)
+}
+
+func (b *ipfsBackend) pinned(ctx context.Context, c cid.Cid) (bool, error) {
+	mode, ok, err := b.ipfs.Pinning.IsPinned(c)
+	if err != nil || !ok {
+		return false, err
+	}
+	return mode == "direct" || mode == "recursive", nil
+}
+
+func (b *ipfsBackend) publish(ctx context.Context, p coreiface.Path, key string) (string, error) {
+	entry, err := b.api.Name().Publish(ctx, p, options.Name.Key(key))
+	if err != nil {
+		return "", err
+	}
+	return entry.Name(), nil
+}
+
+func (b *ipfsBackend) resolveName(ctx context.Context, name string) (coreiface.Path, error) {
+	return b.api.Name().Resolve(ctx, name)
+}
+
+func (b *ipfsBackend) gc(ctx context.Context) (int, error) {
+	var freed int
+	for res := range corerepo.GarbageCollectAsync(b.ipfs, ctx) {
+		if res.Error != nil {
+			return freed, res.Error
+		}
+		freed++
+	}
+	return freed, nil
+}
+
+func (b *ipfsBackend) sync(ctx context.Context) error {
+	return b.ipfs.Repo.Datastore().Sync(ds.NewKey("/"))
+}
+
+// memBackend keeps nodes and pins in maps keyed by CID. IPNS names are the
+// key names.
+type memBackend struct {
+	sync.Mutex
+	nodes map[string]ipldNode
+	pins  map[string]bool // [cid]recursive
+	names map[string]coreiface.Path
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		nodes: make(map[string]ipldNode),
+		pins:  make(map[string]bool),
+		names: make(map[string]coreiface.Path)}
+}
+
+func (b *memBackend) get(ctx context.Context, p coreiface.Path) (ipldNode, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	segs := strings.Split(strings.Trim(p.String(), "/"), "/")
+	if len(segs) < 2 || segs[0] != "ipld" {
+		return nil, fmt.Errorf("unsupported path %s", p)
+	}
+	c, err := cid.Parse(segs[1])
+	if err != nil {
+		return nil, err
+	}
+	n, err := b.node(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range segs[2:] {
+		c, err := resolveNodeLink(n, name)
+		if err != nil {
+			return nil, err
+		}
+		n, err = b.node(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (b *memBackend) node(c cid.Cid) (ipldNode, error) {
+	n := b.nodes[c.KeyString()]
+	if n == nil {
+		return nil, fmt.Errorf("node %s not found", c)
+	}
+	return n, nil
+}
+
+func (b *memBackend) resolve(ctx context.Context, p coreiface.Path) (cid.Cid, error) {
+	n, err := b.get(ctx, p)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return n.Cid(), nil
+}
+
+func (b *memBackend) put(ctx context.Context, nodes []ipldNode) error {
+	b.Lock()
+	defer b.Unlock()
+	for _, n := range nodes {
+		b.nodes[n.Cid().KeyString()] = n
+	}
+	return nil
+}
+
+func (b *memBackend) has(ctx context.Context, c cid.Cid) (bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.nodes[c.KeyString()] != nil, nil
+}
+
+func (b *memBackend) pin(ctx context.Context, p coreiface.Path, recursive bool) error {
+	c, err := b.resolve(ctx, p)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.pins[c.KeyString()] = b.pins[c.KeyString()] || recursive
+	return nil
+}
+
+func (b *memBackend) unpin(ctx context.Context, p coreiface.Path) error {
+	c, err := b.resolve(ctx, p)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.pins[c.KeyString()]; !ok {
+		return errors.New("not pinned")
+	}
+	delete(b.pins, c.KeyString())
+	return nil
+}
+
+func (b *memBackend) pinned(ctx context.Context, c cid.Cid) (bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	_, ok := b.pins[c.KeyString()]
+	return ok, nil
+}
+
+func (b *memBackend) publish(ctx context.Context, p coreiface.Path, key string) (string, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.names[key] = p
+	return key, nil
+}
+
+func (b *memBackend) resolveName(ctx context.Context, name string) (coreiface.Path, error) {
+	b.Lock()
+	defer b.Unlock()
+	p, ok := b.names[name]
+	if !ok {
+		return nil, fmt.Errorf("name %s not found", name)
+	}
+	return p, nil
+}
+
+func (b *memBackend) gc(ctx context.Context) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	live := make(map[string]bool)
+	walked := make(map[string]bool)
+	var mark func(key string, recursive bool)
+	mark = func(key string, recursive bool) {
+		n := b.nodes[key]
+		if n == nil {
+			return
+		}
+		live[key] = true
+		if !recursive || walked[key] {
+			return
+		}
+		walked[key] = true
+		for _, lnk := range n.Links() {
+			mark(lnk.Cid.KeyString(), true)
+		}
+	}
+	for key, recursive := range b.pins {
+		mark(key, recursive)
+	}
+
+	var freed int
+	for key := range b.nodes {
+		if !live[key] {
+			delete(b.nodes, key)
+			freed++
+		}
+	}
+	return freed, nil
+}
+
+func (b *memBackend) sync(ctx context.Context) error {
+	return nil
+}
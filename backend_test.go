@@ -0,0 +1,96 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("In-memory backend", func() {
+	ctx := context.Background()
+
+	It("gets nodes by CID and through links", func() {
+		mem := newMemBackend()
+		child, err := wrapObj([]byte("child"), nil)
+		failIfErr(err)
+		parent, err := wrapObj([]byte("parent"), map[string]cid.Cid{"c": child.Cid()})
+		failIfErr(err)
+		failIfErr(mem.put(ctx, []ipldNode{child, parent}))
+
+		n, err := mem.get(ctx, coreiface.IpldPath(parent.Cid()))
+		failIfErr(err)
+		Expect(n.Cid()).To(Equal(parent.Cid()))
+
+		p, err := coreiface.ParsePath(coreiface.IpldPath(parent.Cid()).String() + "/c")
+		failIfErr(err)
+		c, err := mem.resolve(ctx, p)
+		failIfErr(err)
+		Expect(c).To(Equal(child.Cid()))
+
+		p, err = coreiface.ParsePath(coreiface.IpldPath(parent.Cid()).String() + "/x")
+		failIfErr(err)
+		_, err = mem.get(ctx, p)
+		Expect(err).To(Equal(cbor.ErrNoSuchLink))
+
+		ok, err := mem.has(ctx, child.Cid())
+		failIfErr(err)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("pins and unpins", func() {
+		mem := newMemBackend()
+		n, err := wrapObj([]byte("pinned"), nil)
+		failIfErr(err)
+		failIfErr(mem.put(ctx, []ipldNode{n}))
+
+		p := coreiface.IpldPath(n.Cid())
+		failIfErr(mem.pin(ctx, p, false))
+		Expect(mem.pins).To(HaveKey(n.Cid().KeyString()))
+		failIfErr(mem.unpin(ctx, p))
+		Expect(mem.pins).To(BeEmpty())
+		Expect(mem.unpin(ctx, p)).NotTo(Succeed())
+	})
+
+	It("commits a merkle batch", func() {
+		mem := newMemBackend()
+		tree, err := initMerkle(ctx, mem, "")
+		failIfErr(err)
+		b, err := tree.StartBatch(nil)
+		failIfErr(err)
+		failIfErr(b.putValue(ctx, "abc", []byte("value")))
+
+		bt := &batch{}
+		failIfErr(bt.commit(ctx, mem, b.root))
+		failIfErr(tree.CommitBatch(ctx, b))
+
+		ok, err := mem.has(ctx, tree.rootNode().cnode.Cid())
+		failIfErr(err)
+		Expect(ok).To(BeTrue())
+
+		v, err := tree.getValue(ctx, "abc")
+		failIfErr(err)
+		Expect(v).To(Equal([]byte("value")))
+	})
+})
@@ -17,55 +17,199 @@
 package storeipfs
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
-	"github.com/ipfs/go-ipfs/core/coreapi/interface/options"
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type batch struct {
-	dagBatch    coreiface.DagBatch
-	nodes       []*node
-	nodeIndex   map[string]int
+	nodes     []*node
+	nodeIndex map[string]int
+	deduped   int // nodes IPFS already held, with store.ipfs.dedupcheck set
+
+	// progress, if set, is called after each chunk of nodes is committed
+	// with the number of nodes written so far and the total to write.
+	progress func(done, total int)
+}
+
+func (b *batch) commit(ctx context.Context, api backend, root *node) error {
+	ctx, span := startTrace(ctx, "storeipfs.batch.commit")
+	err := b.write(ctx, api, root)
+	if span != nil {
+		span.SetAttributes(
+			attribute.String("ipfs.root", root.cnode.String()),
+			attribute.Int("ipfs.nodes", b.nodeCount()),
+			attribute.Int("ipfs.deduped", b.deduped),
+			attribute.Int("store.dagbatchsize", dagBatchSize),
+			attribute.Int("store.commitworkers", commitWorkers))
+	}
+	endTrace(span, err)
+	return err
 }
 
-func (b *batch) commit(ctx context.Context, api coreiface.CoreAPI, root *node) error {
+// nodeCount returns the number of nodes written by the last commit.
+func (b *batch) nodeCount() int {
+	if b == nil || len(b.nodes) == 0 {
+		return 0
+	}
+	return len(b.nodes) - 1
+}
+
+// write collects the changed nodes below root and puts them in chunks of
+// store.ipfs.dagbatchsize on store.ipfs.commitworkers goroutines.
+func (b *batch) write(ctx context.Context, api backend, root *node) error {
+	start := time.Now()
 	nodes := make([]*node, 1)
 	b.nodeIndex = make(map[string]int)
 	nodes[0] = (*node)(nil) // so that zeroth index is unavailabe
 
-	nodes, err := collectChangedNodes(root, nodes, b.nodeIndex)
+	end := startSpan(ctx, "collectChangedNodes")
+	nodes, err := collectChangedNodesParallel(root, nodes, b.nodeIndex, commitWorkers)
+	end()
 	if err != nil {
 		return err
 	}
 	b.nodes = nodes
 
-	// Commit from the leaves up to the root.
-	// The root is in nodes[1]. nodes[0] is nil.
-	starti := len(b.nodes) - 1
-	for starti > 0 {
-		b.dagBatch = api.Dag().Batch(ctx)
-		for i := starti; i > starti-dagBatchSize; i-- {
-			if i == 0 {
-				break
-			}
-			byts := bytes.NewReader(b.nodes[i].cnode.RawData())
-			b.dagBatch.Put(ctx, byts, options.Dag.InputEnc("raw"))
-		}
-
-		err := b.dagBatch.Commit(ctx)
+	if debug {
+		err = verifyNodes(b.nodes[1:])
 		if err != nil {
+			logger.Error("batch commit failed", "root", root.cnode.String(), "err", err)
 			return err
 		}
+	}
+
+	// Puts do not resolve the links of the node being put and every CID
+	// was already computed in memory, so chunks of nodes can be written in
+	// any order and in parallel.
+	chunks := make(chan []*node)
+	errs := make(chan error, commitWorkers)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	total := len(b.nodes) - 1
+	done := 0
+	var deduped int64
+	var progressMu sync.Mutex
+	report := func(n int) {
+		if b.progress == nil {
+			return
+		}
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		done += n
+		b.progress(done, total)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < commitWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				n := len(chunk)
+				if dedupCheck {
+					var err error
+					chunk, err = skipStored(ctx, api, chunk)
+					if err != nil {
+						errs <- err
+						cancel()
+						return
+					}
+					atomic.AddInt64(&deduped, int64(n-len(chunk)))
+				}
+				end := startSpan(ctx, "putChunk")
+				err := putChunk(ctx, api, chunk)
+				end()
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				report(n)
+			}
+		}()
+	}
+
+	// The root is in nodes[1]. nodes[0] is nil.
+	for start := 1; start < len(b.nodes); start += dagBatchSize {
+		end := start + dagBatchSize
+		if end > len(b.nodes) {
+			end = len(b.nodes)
+		}
+		select {
+		case chunks <- b.nodes[start:end]:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(chunks)
+	wg.Wait()
 
-		starti -= dagBatchSize
+	select {
+	case err := <-errs:
+		logger.Error("batch commit failed", "root", root.cnode.String(), "err", err)
+		return err
+	default:
+	}
+	if ctx.Err() != nil {
+		logger.Error("batch commit canceled", "root", root.cnode.String(), "err", ctx.Err())
+		return ctx.Err()
 	}
 
+	b.deduped = int(deduped)
+	atomic.AddUint64(&stats.nodesDeduped, uint64(deduped))
+	elapsed := time.Since(start)
+	stats.recordCommit(total, b.deduped, elapsed)
+	logDebug("batch committed", "root", root.cnode.String(), "nodes", total, "deduped", b.deduped, "elapsed", elapsed)
+	return nil
+}
+
+func putChunk(ctx context.Context, api backend, nodes []*node) error {
+	cnodes := make([]ipldNode, len(nodes))
+	for i, n := range nodes {
+		cnodes[i] = n.cnode
+	}
+	err := retry(ctx, func(ctx context.Context) error {
+		return api.put(ctx, cnodes)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&stats.nodesPut, uint64(len(nodes)))
 	return nil
 }
 
+// skipStored returns the nodes IPFS does not hold yet. With
+// store.ipfs.dedupcheck set a commit puts only those, at the cost of a has
+// check for each node.
+func skipStored(ctx context.Context, api backend, nodes []*node) ([]*node, error) {
+	fresh := make([]*node, 0, len(nodes))
+	for _, n := range nodes {
+		var has bool
+		err := retry(ctx, func(ctx context.Context) error {
+			var err error
+			has, err = api.has(ctx, n.cnode.Cid())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			fresh = append(fresh, n)
+		}
+	}
+	return fresh, nil
+}
+
 func collectChangedNodes(n *node, nodes []*node, nodeIndex map[string]int) ([]*node, error) {
 	var added bool
 	for k := range n.changedLinks {
@@ -94,3 +238,108 @@ func collectChangedNodes(n *node, nodes []*node, nodeIndex map[string]int) ([]*n
 	}
 	return nodes, nil
 }
+
+// collectChangedNodesParallel collects the same nodes as collectChangedNodes,
+// though not in the same order, walking independent subtrees on up to
+// workers goroutines. The top of the tree is expanded breadth first until
+// there are enough subtrees to share among the workers.
+func collectChangedNodesParallel(root *node, nodes []*node, nodeIndex map[string]int, workers int) ([]*node, error) {
+	if workers <= 1 {
+		return collectChangedNodes(root, nodes, nodeIndex)
+	}
+
+	add := func(n *node) {
+		nodeIndex[n.cnode.String()] = len(nodes)
+		nodes = append(nodes, n)
+	}
+
+	frontier := []*node{root}
+	seen := map[string]bool{root.cnode.String(): true}
+	for len(frontier) > 0 && len(frontier) < 4*workers {
+		var next []*node
+		for _, n := range frontier {
+			if len(n.changedLinks) > 0 || n.changedData {
+				add(n)
+			}
+			for k := range n.changedLinks {
+				tn := n.links[k].targetNode
+				if tn == nil {
+					return nil, fmt.Errorf("no data for changed link %s", k)
+				}
+				cidS := tn.cnode.String()
+				if !seen[cidS] {
+					seen[cidS] = true
+					next = append(next, tn)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	results := make([][]*node, len(frontier))
+	errs := make([]error, len(frontier))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, n := range frontier {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, n *node) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// each subtree gets its own index; nodes shared between
+			// subtrees are deduplicated when merging
+			results[i], errs[i] = collectChangedNodes(n, make([]*node, 1), make(map[string]int))
+		}(i, n)
+	}
+	wg.Wait()
+
+	for i := range frontier {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for _, n := range results[i][1:] {
+			if nodeIndex[n.cnode.String()] == 0 {
+				add(n)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// verifyNodes checks, for each node, that its raw data hashes to its CID and
+// that encoding its data and links again gives the same CID. A mismatch
+// means a node was changed without being recomputed. It is run by commit
+// when store.debug is set.
+func verifyNodes(nodes []*node) error {
+	for _, n := range nodes {
+		c := n.cnode.Cid()
+		sum, err := c.Prefix().Sum(n.cnode.RawData())
+		if err != nil {
+			return err
+		}
+		if !sum.Equals(c) {
+			return fmt.Errorf("%w: raw data of %s hashes to %s", ErrNodeMismatch, c, sum)
+		}
+
+		links := make(map[string]cid.Cid, len(n.links))
+		for k, lnk := range n.links {
+			if lnk.targetNode != nil {
+				links[k] = lnk.targetNode.cnode.Cid()
+			} else {
+				links[k] = lnk.targetCid
+			}
+		}
+		nc := codecs[c.Type()]
+		if nc == nil {
+			return fmt.Errorf("%w: 0x%x in %s", ErrUnsupportedCodec, c.Type(), c)
+		}
+		encoded, err := encodeNode(nc, c.Prefix().MhType, n.version, n.data, links, n.expires)
+		if err != nil {
+			return err
+		}
+		if !encoded.Cid().Equals(c) {
+			return fmt.Errorf("%w: %s encodes to %s from its data and links", ErrNodeMismatch, c, encoded.Cid())
+		}
+	}
+	return nil
+}
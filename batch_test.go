@@ -0,0 +1,260 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// wideTree returns the root of an uncommitted tree with count changed
+// keys, spread as acttxn keys are.
+func wideTree(ctx context.Context, count int) *node {
+	tree, err := initMerkle(ctx, newMemBackend(), "")
+	failIfErr(err)
+	b, err := tree.StartBatch(nil)
+	failIfErr(err)
+	for i := 0; i < count; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		failIfErr(b.putValue(ctx, "acttxnfrom"+hex.EncodeToString(sum[:8]), []byte("txn")))
+	}
+	return b.root
+}
+
+// changedNodes returns the nodes of an uncommitted tree with count keys,
+// stored in api.
+func changedNodes(ctx context.Context, api backend, count int) []*node {
+	nodes, err := collectChangedNodes(wideTree(ctx, count), make([]*node, 1), make(map[string]int))
+	failIfErr(err)
+	failIfErr(putChunk(ctx, api, nodes[1:]))
+	return nodes
+}
+
+// slowPinBackend is a memBackend whose pins take as long as a round trip
+// to an IPFS daemon.
+type slowPinBackend struct {
+	*memBackend
+}
+
+func (b slowPinBackend) pin(ctx context.Context, p coreiface.Path, recursive bool) error {
+	time.Sleep(200 * time.Microsecond)
+	return b.memBackend.pin(ctx, p, recursive)
+}
+
+func cidSet(nodes []*node) map[string]bool {
+	set := make(map[string]bool, len(nodes))
+	for _, n := range nodes[1:] {
+		set[n.cnode.String()] = true
+	}
+	return set
+}
+
+// largeEntries returns count value entries, spread as acttxn keys are, for
+// putMany.
+func largeEntries(count int) []kv {
+	entries := make([]kv, count)
+	for i := range entries {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		entries[i] = kv{key: "acttxnfrom" + hex.EncodeToString(sum[:8]), value: []byte(fmt.Sprint(i))}
+	}
+	return entries
+}
+
+// spillingBatch returns a batch of a new tree in api whose spilled nodes
+// are put in api and counted in spilled.
+func spillingBatch(ctx context.Context, api backend, spilled *int) (*merkleTreeStruct, *merkleTreeBatch) {
+	tree, err := initMerkle(ctx, api, "")
+	failIfErr(err)
+	b, err := tree.StartBatch(nil)
+	failIfErr(err)
+	b.spill = func(ctx context.Context, nodes []*node) error {
+		*spilled += len(nodes)
+		return putChunk(ctx, api, nodes)
+	}
+	return tree, b
+}
+
+var _ = Describe("Batch", func() {
+	It("collects the same nodes in parallel as serially", func() {
+		root := wideTree(context.Background(), 300)
+
+		serial, err := collectChangedNodes(root, make([]*node, 1), make(map[string]int))
+		failIfErr(err)
+		index := make(map[string]int)
+		parallel, err := collectChangedNodesParallel(root, make([]*node, 1), index, 4)
+		failIfErr(err)
+
+		Expect(parallel).To(HaveLen(len(serial)))
+		Expect(cidSet(parallel)).To(Equal(cidSet(serial)))
+		Expect(parallel[1]).To(Equal(root))
+		for i, n := range parallel[1:] {
+			Expect(index[n.cnode.String()]).To(Equal(i + 1))
+		}
+	})
+
+	It("detects a node changed without being recomputed", func() {
+		defer func(d bool) { debug = d }(debug)
+		debug = true
+		ctx := context.Background()
+		root := wideTree(ctx, 3)
+		root.data = []byte("changed")
+
+		err := (&batch{}).commit(ctx, newMemBackend(), root)
+		Expect(errors.Is(err, ErrNodeMismatch)).To(BeTrue())
+	})
+
+	It("spills finished subtrees of a large putMany", func() {
+		ctx := context.Background()
+		spillNodes = 100
+		defer func() { spillNodes = 0 }()
+		entries := largeEntries(3000)
+
+		mem := newMemBackend()
+		var spilled int
+		tree, b := spillingBatch(ctx, mem, &spilled)
+		failIfErr(b.putMany(ctx, entries))
+		Expect(spilled).To(BeNumerically(">", 3000))
+
+		held, err := collectChangedNodes(b.root, make([]*node, 1), make(map[string]int))
+		failIfErr(err)
+		Expect(len(held) - 1).To(BeNumerically("<", 300))
+
+		unspilled, err := initMerkle(ctx, newMemBackend(), "")
+		failIfErr(err)
+		ub, err := unspilled.StartBatch(nil)
+		failIfErr(err)
+		failIfErr(ub.putMany(ctx, entries))
+		Expect(b.getRoot()).To(Equal(ub.getRoot()))
+
+		failIfErr((&batch{}).commit(ctx, mem, b.root))
+		failIfErr(tree.CommitBatch(ctx, b))
+		for _, e := range entries[:100] {
+			value, err := tree.getValue(ctx, e.key)
+			failIfErr(err)
+			Expect(value).To(Equal(e.value))
+		}
+	})
+
+	It("pins every node in parallel", func() {
+		ctx := context.Background()
+		mem := newMemBackend()
+		nodes := changedNodes(ctx, mem, 300)
+		sb := &storeBlock{store: &store{api: mem}}
+
+		failIfErr(sb.pinNodesWith(ctx, nodes, 4))
+		Expect(mem.pins).To(HaveLen(len(nodes) - 1))
+		Expect(sb.pinned).To(HaveLen(len(nodes) - 1))
+
+		failIfErr(sb.unpinNodes(ctx))
+		Expect(mem.pins).To(BeEmpty())
+	})
+
+	It("stops pinning when the context is canceled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		mem := newMemBackend()
+		nodes := changedNodes(ctx, mem, 300)
+		sb := &storeBlock{store: &store{api: mem}}
+		cancel()
+
+		err := sb.pinNodesWith(ctx, nodes, 4)
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		Expect(sb.pinned).To(BeEmpty())
+	})
+})
+
+func BenchmarkCollectChangedNodes(b *testing.B) {
+	root := wideTree(context.Background(), 5000)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			collectChangedNodes(root, make([]*node, 1), make(map[string]int))
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			collectChangedNodesParallel(root, make([]*node, 1), make(map[string]int), 4)
+		}
+	})
+}
+
+func BenchmarkPinNodes(b *testing.B) {
+	ctx := context.Background()
+	api := slowPinBackend{newMemBackend()}
+	nodes := changedNodes(ctx, api, 500)[:501]
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sb := &storeBlock{store: &store{api: api}}
+				err := sb.pinNodesWith(ctx, nodes, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPutManyLargeBlock reports the heap in use after putting the
+// entries of a large block, which store.spillnodes keeps flat.
+func BenchmarkPutManyLargeBlock(b *testing.B) {
+	ctx := context.Background()
+	entries := largeEntries(50000)
+	defer func() { spillNodes = 0 }()
+
+	for _, spill := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("spillnodes=%d", spill), func(b *testing.B) {
+			spillNodes = spill
+			var heap uint64
+			for i := 0; i < b.N; i++ {
+				tree, err := initMerkle(ctx, newMemBackend(), "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				mb, err := tree.StartBatch(nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if spill > 0 {
+					// drop spilled nodes so only what the batch holds counts
+					mb.spill = func(context.Context, []*node) error { return nil }
+				}
+				err = mb.putMany(ctx, entries)
+				if err != nil {
+					b.Fatal(err)
+				}
+				runtime.GC()
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				heap += ms.HeapInuse
+				runtime.KeepAlive(mb)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N)/(1<<20), "heap-MiB")
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+
+	spec "github.com/blocktop/go-spec"
+)
+
+// bloomFalsePositives is the false positive rate a filter is sized for.
+const bloomFalsePositives = 0.01
+
+// bloomFilter is a Bloom filter of the keys of a merkle tree that hold a
+// value or named links, so that lookups of absent keys can skip the trie
+// traversal. A key it may contain is looked up as usual. Keys are never
+// removed, so a deleted key is only a false positive.
+type bloomFilter struct {
+	mu       sync.RWMutex
+	bits     []uint64
+	k        uint64
+	capacity int // keys the filter is sized for, see store.bloomkeys
+}
+
+// newBloomFilter returns a filter sized for capacity keys.
+func newBloomFilter(capacity int) *bloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	m := math.Ceil(-float64(capacity) * math.Log(bloomFalsePositives) / (math.Ln2 * math.Ln2))
+	words := int(m/64) + 1
+	k := uint64(math.Round(float64(words*64) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words), k: k, capacity: capacity}
+}
+
+// bloomHashes returns the two hashes the k bit positions of key are
+// derived from.
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	var h1, h2 uint64
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[8+i])
+	}
+	return h1, h2 | 1
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHashes(key)
+	size := uint64(len(f.bits) * 64)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain reports false if key was never added.
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+	size := uint64(len(f.bits) * 64)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// buildFilter returns a filter sized for capacity keys holding the keys of
+// the tree below root. It walks the whole tree.
+func buildFilter(ctx context.Context, api backend, root *node, capacity int) (*bloomFilter, error) {
+	f := newBloomFilter(capacity)
+	err := walkEntries(ctx, api, root, func(key string, _ []byte, _ spec.Links) error {
+		f.add(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// loadFilter builds a filter sized for capacity keys from the committed
+// tree and makes getValue consult it.
+func (m *merkleTreeStruct) loadFilter(ctx context.Context, capacity int) error {
+	f, err := buildFilter(ctx, m.api, m.rootNode(), capacity)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	m.bloom = f
+	m.Unlock()
+	return nil
+}
+
+// filterFor returns a filter of the tree below root, to replace the filter
+// when root replaces the committed root other than by a batch commit. It
+// returns nil if m has no filter.
+func (m *merkleTreeStruct) filterFor(ctx context.Context, root *node) (*bloomFilter, error) {
+	f := m.filter()
+	if f == nil {
+		return nil, nil
+	}
+	return buildFilter(ctx, m.api, root, f.capacity)
+}
+
+func (m *merkleTreeStruct) filter() *bloomFilter {
+	m.Lock()
+	defer m.Unlock()
+	return m.bloom
+}
+
+// mayHold reports false if key holds neither a value nor named links in
+// the committed tree, as far as the filter knows. Without a filter it
+// reports true.
+func (m *merkleTreeStruct) mayHold(key string) bool {
+	f := m.filter()
+	return f == nil || f.mayContain(key)
+}
@@ -0,0 +1,83 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// nodeCache is an LRU cache of IPLD nodes keyed by IPLD path. Paths rooted
+// at a CID always resolve to the same node, so entries never go stale.
+// The undecoded ipldNode is cached rather than *node because batches
+// modify nodes in place; getObj decodes a fresh *node on every hit.
+type nodeCache struct {
+	sync.Mutex
+	size   int
+	ll     *list.List
+	items  map[string]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key   string
+	cnode ipldNode
+}
+
+func newNodeCache(size int) *nodeCache {
+	return &nodeCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size)}
+}
+
+func (c *nodeCache) get(key string) (ipldNode, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).cnode, true
+}
+
+func (c *nodeCache) add(key string, cnode ipldNode) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, cnode: cnode})
+
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *nodeCache) stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
@@ -0,0 +1,51 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Node cache", func() {
+
+	It("evicts the least recently used entry", func() {
+		c := newNodeCache(2)
+		a, err := wrapObj([]byte("a"), nil)
+		failIfErr(err)
+		b, err := wrapObj([]byte("b"), nil)
+		failIfErr(err)
+		d, err := wrapObj([]byte("d"), nil)
+		failIfErr(err)
+
+		c.add("a", a)
+		c.add("b", b)
+		_, ok := c.get("a")
+		Expect(ok).To(BeTrue())
+
+		c.add("d", d)
+		_, ok = c.get("b")
+		Expect(ok).To(BeFalse())
+		cn, ok := c.get("a")
+		Expect(ok).To(BeTrue())
+		Expect(cn.Cid()).To(Equal(a.Cid()))
+
+		hits, misses := c.stats()
+		Expect(hits).To(Equal(uint64(2)))
+		Expect(misses).To(Equal(uint64(1)))
+	})
+})
@@ -0,0 +1,203 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+)
+
+// carHeader is the dag-cbor header of a CARv1 stream.
+type carHeader struct {
+	Roots   []cid.Cid `refmt:"roots"`
+	Version uint64    `refmt:"version"`
+}
+
+func init() {
+	cbor.RegisterCborType(carHeader{})
+}
+
+// ExportCAR writes the DAG reachable from the header of a submitted block
+// to w as a CARv1 stream with the header as its single root. The stream
+// includes the parent headers, so that a vanilla `ipfs dag import` can pin
+// the root. Nodes are written as they are visited. A block the store has
+// not seen since it was opened is looked up on the chain of the root.
+func (s *store) ExportCAR(ctx context.Context, blockHash string, w io.Writer) error {
+	root, err := s.blockHeaderByHash(ctx, blockHash)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return fmt.Errorf("%w: %s", ErrBlockNotFound, blockHash)
+	}
+
+	bw := bufio.NewWriter(w)
+	err = writeCARHeader(bw, root.cnode.Cid())
+	if err != nil {
+		return err
+	}
+	err = walkDAG(ctx, s.api, root, make(map[string]bool), func(n *node) error {
+		return writeCARBlock(bw, n.cnode.Cid(), n.cnode.RawData())
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportCAR puts every block of a CARv1 stream and returns its first root.
+// The caller may adopt the root with setRoot. The roots must be present
+// once the stream is read, and they are pinned recursively if
+// store.ipfs.pin is set.
+func (s *store) ImportCAR(ctx context.Context, r io.Reader) (string, error) {
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+	roots, err := readCAR(r, func(cnode ipldNode) error {
+		return s.api.put(ctx, []ipldNode{cnode})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range roots {
+		has, err := s.api.has(ctx, root)
+		if err != nil {
+			return "", err
+		}
+		if !has {
+			return "", fmt.Errorf("CAR root %s was not in the stream", root)
+		}
+		if pin {
+			err = s.api.pin(ctx, coreiface.IpldPath(root), true)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	logger.Info("CAR imported", "root", roots[0].String())
+	return roots[0].String(), nil
+}
+
+// readCAR reads a CARv1 stream, checking each block against its CID and
+// passing it to fn, and returns the roots from the header.
+func readCAR(r io.Reader, fn func(cnode ipldNode) error) ([]cid.Cid, error) {
+	br := bufio.NewReader(r)
+	hb, err := readCARSection(br)
+	if err == io.EOF {
+		return nil, errors.New("CAR stream has no header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := &carHeader{}
+	err = cbor.DecodeInto(hb, h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %d", h.Version)
+	}
+	if len(h.Roots) == 0 {
+		return nil, errors.New("CAR header has no roots")
+	}
+
+	for {
+		sec, err := readCARSection(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		l, c, err := cid.CidFromBytes(sec)
+		if err != nil {
+			return nil, err
+		}
+		cnode, err := decodeNode(sec[l:], c)
+		if err != nil {
+			return nil, fmt.Errorf("CAR block %s: %v", c, err)
+		}
+		if !cnode.Cid().Equals(c) {
+			return nil, fmt.Errorf("CAR block %s hashes to %s", c, cnode.Cid())
+		}
+		err = fn(cnode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.Roots, nil
+}
+
+func writeCARHeader(w io.Writer, root cid.Cid) error {
+	byts, err := cbor.DumpObject(&carHeader{Roots: []cid.Cid{root}, Version: 1})
+	if err != nil {
+		return err
+	}
+	return writeCARSection(w, byts)
+}
+
+func writeCARBlock(w io.Writer, c cid.Cid, data []byte) error {
+	return writeCARSection(w, c.Bytes(), data)
+}
+
+// writeCARSection writes the parts prefixed with their total length as an
+// unsigned varint.
+func writeCARSection(w io.Writer, parts ...[]byte) error {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	l := binary.PutUvarint(buf, uint64(size))
+	_, err := w.Write(buf[:l])
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		_, err = w.Write(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCARSection reads one length-prefixed section. It returns io.EOF only
+// when r is empty.
+func readCARSection(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	byts := make([]byte, size)
+	_, err = io.ReadFull(r, byts)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return byts, err
+}
@@ -0,0 +1,138 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CAR", func() {
+
+	var ctx context.Context
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("exports a block as a CARv1 stream", func() {
+		storeb := openStore(ctx)
+		failIfErr(storeb.tree.putValue(ctx, "carexport", []byte("exported")))
+		_, err := storeb.Submit(ctx, &testBlock{hash: "carblock", number: 1})
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+
+		buf := &bytes.Buffer{}
+		failIfErr(Store.ExportCAR(ctx, "carblock", buf))
+
+		r := bufio.NewReader(buf)
+		hb, err := readCARSection(r)
+		failIfErr(err)
+		h := &carHeader{}
+		failIfErr(cbor.DecodeInto(hb, h))
+		Expect(h.Version).To(Equal(uint64(1)))
+		Expect(h.Roots).To(HaveLen(1))
+		Expect(h.Roots[0]).To(Equal(storeb.blockHeader.cnode.Cid()))
+
+		seen := make(map[string]bool)
+		for {
+			sec, err := readCARSection(r)
+			if err == io.EOF {
+				break
+			}
+			failIfErr(err)
+			l, c, err := cid.CidFromBytes(sec)
+			failIfErr(err)
+			sum, err := c.Prefix().Sum(sec[l:])
+			failIfErr(err)
+			Expect(sum).To(Equal(c))
+			Expect(seen).NotTo(HaveKey(c.String()))
+			seen[c.String()] = true
+		}
+		Expect(seen).To(HaveKey(storeb.blockHeader.cnode.String()))
+		Expect(seen).To(HaveKey(storeb.blockHeader.links["merkle"].targetNode.cnode.String()))
+	})
+
+	It("imports an exported block into an empty store", func() {
+		storeb := openStore(ctx)
+		failIfErr(storeb.tree.putValue(ctx, "carimport", []byte("imported")))
+		_, err := storeb.Submit(ctx, &testBlock{hash: "carimportblock", number: 1})
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+		header := storeb.blockHeader.cnode.String()
+
+		buf := &bytes.Buffer{}
+		failIfErr(Store.ExportCAR(ctx, "carimportblock", buf))
+
+		Store.Close()
+		removeDataDir()
+		initialize(ctx)
+		has, err := Store.merkleTree.has(ctx, "carimport")
+		failIfErr(err)
+		Expect(has).To(BeFalse())
+
+		root, err := Store.ImportCAR(ctx, buf)
+		failIfErr(err)
+		Expect(root).To(Equal(header))
+
+		rootNode, err := makeNodeFromNodeHash(ctx, Store.api, root)
+		failIfErr(err)
+		failIfErr(Store.setRoot(ctx, rootNode))
+		Store.Close()
+		failIfErr(InitStore(ctx))
+
+		v, err := Store.merkleTree.getValue(ctx, "carimport")
+		failIfErr(err)
+		Expect(v).To(Equal([]byte("imported")))
+	})
+
+	It("exports a block committed before the store was opened", func() {
+		storeb := openStore(ctx)
+		_, err := storeb.Submit(ctx, &testBlock{hash: "carreopened", number: 1})
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+		header := storeb.blockHeader.cnode.Cid()
+		sb, err := Store.OpenBlock(2)
+		failIfErr(err)
+		_, err = sb.Submit(ctx, &testBlock{hash: "carreopened2", parentHash: "carreopened", number: 2})
+		failIfErr(err)
+		failIfErr(sb.Commit(ctx))
+
+		Store.Close()
+		failIfErr(InitStore(ctx))
+		buf := &bytes.Buffer{}
+		failIfErr(Store.ExportCAR(ctx, "carreopened", buf))
+		hb, err := readCARSection(bufio.NewReader(buf))
+		failIfErr(err)
+		h := &carHeader{}
+		failIfErr(cbor.DecodeInto(hb, h))
+		Expect(h.Roots).To(Equal([]cid.Cid{header}))
+	})
+
+	It("fails for an unknown block", func() {
+		err := Store.ExportCAR(ctx, "nosuchblock", &bytes.Buffer{})
+		Expect(errors.Is(err, ErrBlockNotFound)).To(BeTrue())
+	})
+})
@@ -0,0 +1,248 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+)
+
+// ipldNode is an encoded node. Nodes are *cbor.Node unless store.ipfs.codec
+// selects another codec. MarshalJSON gives the form cbor.Node does, with
+// bytes as base64 strings and links as {"/": cid}, whatever the codec, so
+// that makeNodeFromIPLD reads every codec alike.
+type ipldNode interface {
+	Cid() cid.Cid
+	RawData() []byte
+	String() string
+	MarshalJSON() ([]byte, error)
+}
+
+// nodeCodec encodes node objects to, and decodes raw blocks of, one IPLD
+// codec. A node object maps field names to []byte values, cid.Cid links
+// and integers, as built by wrapExpiringObj.
+type nodeCodec interface {
+	encode(obj map[string]interface{}, mhType uint64) (ipldNode, error)
+	decode(raw []byte, c cid.Cid) (ipldNode, error)
+}
+
+// dagJSON is the multicodec code of dag-json, which go-cid does not name.
+const dagJSON = 0x0129
+
+// codecs are the codecs nodes are decoded with, keyed by CID codec, so that
+// a DAG of mixed codecs resolves.
+var codecs = map[uint64]nodeCodec{
+	cid.DagCBOR: cborCodec{},
+	dagJSON:     jsonCodec{}}
+
+// codecNames are the values of store.ipfs.codec.
+var codecNames = map[string]uint64{
+	"dag-cbor": cid.DagCBOR,
+	"dag-json": dagJSON}
+
+// codec is the codec new nodes are encoded with, set by store.ipfs.codec.
+// It applies to every store in the process, see StoreConfig. The links of
+// a node are the same in every codec.
+var codec nodeCodec = cborCodec{}
+
+// checkIPFSCodec returns an error if the codec named by store.ipfs.codec
+// cannot be used with an IPFS node. IPFS does not decode dag-json, so
+// dag-json nodes can only be kept in memory.
+func checkIPFSCodec(name string) error {
+	if name != "" && codecNames[name] == dagJSON {
+		return errors.New("store.ipfs.codec dag-json requires store.inmemory")
+	}
+	return nil
+}
+
+// parseCodec returns the codec for a store.ipfs.codec name, dag-cbor if
+// empty.
+func parseCodec(name string) (nodeCodec, error) {
+	if name == "" {
+		return cborCodec{}, nil
+	}
+	code, ok := codecNames[name]
+	if !ok {
+		return nil, fmt.Errorf("store.ipfs.codec: unknown codec %q", name)
+	}
+	return codecs[code], nil
+}
+
+// decodeNode decodes the raw data of c with the codec of c.
+func decodeNode(raw []byte, c cid.Cid) (ipldNode, error) {
+	nc := codecs[c.Type()]
+	if nc == nil {
+		return nil, fmt.Errorf("%w: 0x%x in %s", ErrUnsupportedCodec, c.Type(), c)
+	}
+	return nc.decode(raw, c)
+}
+
+// resolveNodeLink returns the CID of the link name of n, or
+// cbor.ErrNoSuchLink, as a cbor.Node resolving the path would.
+func resolveNodeLink(n ipldNode, name string) (cid.Cid, error) {
+	switch n := n.(type) {
+	case *cbor.Node:
+		lnk, _, err := n.ResolveLink([]string{name})
+		if err != nil {
+			return cid.Undef, err
+		}
+		return lnk.Cid, nil
+	case *jsonNode:
+		c, ok := n.links[name]
+		if !ok {
+			return cid.Undef, cbor.ErrNoSuchLink
+		}
+		return c, nil
+	}
+	return cid.Undef, fmt.Errorf("%w: %T", ErrUnsupportedCodec, n)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) encode(obj map[string]interface{}, mhType uint64) (ipldNode, error) {
+	return cbor.WrapObject(obj, mhType, -1)
+}
+
+func (cborCodec) decode(raw []byte, c cid.Cid) (ipldNode, error) {
+	prefix := c.Prefix()
+	return cbor.Decode(raw, prefix.MhType, prefix.MhLength)
+}
+
+// jsonCodec encodes nodes as dag-json: map keys sorted, bytes as
+// {"/": {"bytes": base64}} with the padding dropped and links as
+// {"/": cid}.
+type jsonCodec struct{}
+
+// jsonNode is a dag-json node. obj holds the node in cbor.Node JSON form.
+type jsonNode struct {
+	raw   []byte
+	c     cid.Cid
+	obj   map[string]interface{}
+	links map[string]cid.Cid
+}
+
+func (n *jsonNode) Cid() cid.Cid                 { return n.c }
+func (n *jsonNode) RawData() []byte              { return n.raw }
+func (n *jsonNode) String() string               { return n.c.String() }
+func (n *jsonNode) MarshalJSON() ([]byte, error) { return json.Marshal(n.obj) }
+
+func (jsonCodec) encode(obj map[string]interface{}, mhType uint64) (ipldNode, error) {
+	dag := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		switch v := v.(type) {
+		case []byte:
+			if v == nil {
+				dag[k] = nil
+			} else {
+				dag[k] = map[string]interface{}{"/": map[string]string{"bytes": base64.RawStdEncoding.EncodeToString(v)}}
+			}
+		case cid.Cid:
+			dag[k] = map[string]string{"/": v.String()}
+		default:
+			dag[k] = v
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(dag)
+	if err != nil {
+		return nil, err
+	}
+	raw := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	prefix := cid.Prefix{Version: 1, Codec: dagJSON, MhType: mhType, MhLength: -1}
+	c, err := prefix.Sum(raw)
+	if err != nil {
+		return nil, err
+	}
+	return jsonCodec{}.decode(raw, c)
+}
+
+func (jsonCodec) decode(raw []byte, c cid.Cid) (ipldNode, error) {
+	sum, err := c.Prefix().Sum(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("dag-json data of %s hashes to %s", c, sum)
+	}
+
+	dag := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err = dec.Decode(&dag)
+	if err != nil {
+		return nil, fmt.Errorf("dag-json %s: %v", c, err)
+	}
+
+	n := &jsonNode{
+		raw:   raw,
+		c:     c,
+		obj:   make(map[string]interface{}, len(dag)),
+		links: make(map[string]cid.Cid)}
+	keys := make([]string, 0, len(dag))
+	for k := range dag {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := decodeJSONField(dag[k])
+		if err != nil {
+			return nil, fmt.Errorf("dag-json %s: %s: %v", c, k, err)
+		}
+		if lc, ok := v.(cid.Cid); ok {
+			n.links[k] = lc
+			n.obj[k] = map[string]string{"/": lc.String()}
+			continue
+		}
+		n.obj[k] = v
+	}
+	return n, nil
+}
+
+// decodeJSONField returns a dag-json field as a cid.Cid for a link, a
+// base64 string for bytes, or the value itself.
+func decodeJSONField(v interface{}) (interface{}, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return v, nil
+	}
+	switch slash := m["/"].(type) {
+	case string:
+		return cid.Parse(slash)
+	case map[string]interface{}:
+		s, ok := slash["bytes"].(string)
+		if !ok || len(slash) != 1 {
+			return nil, errors.New("malformed bytes")
+		}
+		byts, err := base64.RawStdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(byts), nil
+	}
+	return v, nil
+}
@@ -0,0 +1,185 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"fmt"
+)
+
+// Compact rewrites the committed merkle tree without its empty branches,
+// the nodes holding neither a value, named links nor a non-empty child,
+// and makes a header linking the rewritten tree the current root. Every
+// live key resolves to the same value and links under the new root, but
+// the CIDs of the rewritten nodes and their ancestors change. Expired
+// values are kept, since expiry is advisory.
+//
+// Compact returns the new root, or the current root if there is nothing to
+// drop. Like RestoreFromRoot it refuses while a block is open, and it
+// returns ErrCommitConflict, leaving the root as it was, if a block is
+// opened or committed before the rewrite is done. The compacted header
+// replaces the old one as the block's header for GetBlock and
+// OpenBlockOn. With store.ipfs.pin set the rewritten nodes are pinned, and
+// unpinning the compacted block releases the nodes the rewrite replaced.
+func (s *store) Compact(ctx context.Context) (string, error) {
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+	s.Lock()
+	if len(s.storeBlocks) > 0 {
+		s.Unlock()
+		return "", fmt.Errorf("%w: cannot compact", ErrBlockAlreadyOpen)
+	}
+	header := s.root
+	root := s.merkleTree.rootNode()
+	s.Unlock()
+
+	merkleRoot, changed, err := compactNode(ctx, s.api, root)
+	if err != nil {
+		return "", err
+	}
+	if !changed || merkleRoot == nil && len(root.links) == 0 {
+		return header.cnode.String(), nil
+	}
+	if merkleRoot == nil {
+		merkleRoot, err = makeNodeFromObj(nil, nil)
+		if err != nil {
+			return "", err
+		}
+		merkleRoot.changedData = true
+	}
+
+	b := &batch{}
+	err = b.commit(ctx, s.api, merkleRoot)
+	if err != nil {
+		return "", err
+	}
+
+	links := make(map[string]*link, len(header.links))
+	for k, lnk := range header.links {
+		links[k] = &link{key: k, targetCid: lnk.targetCid, targetNode: lnk.targetNode}
+	}
+	links["merkle"] = &link{key: "merkle", targetNode: merkleRoot}
+	n, err := makeNodeFromObj(header.data, links)
+	if err != nil {
+		return "", err
+	}
+	err = putObj(ctx, s.api, n)
+	if err != nil {
+		return "", err
+	}
+
+	// UnpinBlock must see the pinned nodes under the new root
+	s.pinMu.RLock()
+	defer s.pinMu.RUnlock()
+	if pinRecursive {
+		err = s.api.pin(ctx, n.path, true)
+	} else if pin {
+		err = s.pinCompacted(ctx, append(b.nodes, n))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.root != header || len(s.storeBlocks) > 0 {
+		return "", fmt.Errorf("%w: the root changed during Compact", ErrCommitConflict)
+	}
+	err = s.setRootLocked(ctx, n)
+	if err != nil {
+		return "", err
+	}
+	if pinRecursive {
+		s.swapRootPin(ctx, n)
+	}
+	s.merkleTree.Lock()
+	s.merkleTree.root = merkleRoot
+	s.merkleTree.Unlock()
+	bh, err := blockHeaderFromBytes(header.data)
+	if err == nil && s.blockRoots[bh.blockID] == header {
+		s.blockRoots[bh.blockID] = n
+	}
+	logger.Info("store compacted", "root", s.Root, "nodes", b.nodeCount())
+	return n.cnode.String(), nil
+}
+
+// compactNode returns n without its empty branches, or nil if n itself is
+// empty. The bool reports whether anything was dropped below n, in which
+// case the returned node is new and flagged for a batch commit. Otherwise
+// it is n, and the subtrees walked are not kept in memory.
+func compactNode(ctx context.Context, api backend, n *node) (*node, bool, error) {
+	changed := false
+	links := make(map[string]*link, len(n.links))
+	changedLinks := make(map[string]bool)
+	for k, lnk := range n.links {
+		if len(k) != 1 {
+			links[k] = lnk
+			continue
+		}
+		tn, err := linkTarget(ctx, api, lnk)
+		if err != nil {
+			return nil, false, err
+		}
+		if tn == nil {
+			changed = true
+			continue
+		}
+		c, cchanged, err := compactNode(ctx, api, tn)
+		if err != nil {
+			return nil, false, err
+		}
+		switch {
+		case c == nil:
+			changed = true
+		case cchanged:
+			links[k] = &link{key: k, targetNode: c}
+			changedLinks[k] = true
+			changed = true
+		default:
+			links[k] = &link{key: k, targetCid: tn.cnode.Cid()}
+		}
+	}
+
+	if n.data == nil && len(links) == 0 {
+		return nil, true, nil
+	}
+	if !changed {
+		return n, false, nil
+	}
+	c, err := makeExpiringNode(n.data, links, n.expires)
+	if err != nil {
+		return nil, false, err
+	}
+	c.changedLinks = changedLinks
+	c.changedData = true
+	return c, true, nil
+}
+
+// pinCompacted pins the nodes written by Compact directly.
+func (s *store) pinCompacted(ctx context.Context, nodes []*node) error {
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		err := s.api.pin(ctx, n.path, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
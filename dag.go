@@ -0,0 +1,90 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"sort"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+)
+
+// WalkDAG calls visit with the CID and encoded bytes of every node
+// reachable from the node root, depth first and in link name order. It
+// follows every link, so from a block header it visits the parent headers,
+// the block, the merkle tree and the accounts and transactions linked from
+// it. A node reached by more than one path is visited once. The walk stops
+// at the first error returned by visit, a node that cannot be fetched, or a
+// done context, which is checked before each fetch.
+func (s *store) WalkDAG(ctx context.Context, root string, visit func(cid string, raw []byte) error) error {
+	c, err := cid.Parse(root)
+	if err != nil {
+		return err
+	}
+	n, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return err
+	}
+	return walkDAG(ctx, s.api, n, make(map[string]bool), func(n *node) error {
+		return visit(n.cnode.String(), n.cnode.RawData())
+	})
+}
+
+// walkDAG calls visit with n and every node reachable from it that is not
+// in visited, adding each to visited. Nodes are fetched as the walk reaches
+// them and are not retained afterward.
+func walkDAG(ctx context.Context, api backend, n *node, visited map[string]bool, visit func(n *node) error) error {
+	cidS := n.cnode.String()
+	if visited[cidS] {
+		return nil
+	}
+	visited[cidS] = true
+
+	err := visit(n)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(n.links))
+	for k := range n.links {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lnk := n.links[k]
+		if visited[linkCid(lnk)] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		tn, err := linkTarget(ctx, api, lnk)
+		if err != nil {
+			return err
+		}
+		if tn == nil {
+			continue
+		}
+		err = walkDAG(ctx, api, tn, visited, visit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
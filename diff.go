@@ -0,0 +1,211 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	spec "github.com/blocktop/go-spec"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+)
+
+// TreeDiff lists the keys that differ between two merkle trees, in lexical
+// order within each group. A key is in a tree if it holds a value or named
+// links.
+type TreeDiff struct {
+	Added    []KeyChange
+	Removed  []KeyChange
+	Modified []KeyChange
+}
+
+// KeyChange is a key that differs between two trees, with its value and
+// named links in each. Old and OldLinks are nil for an added key, New and
+// NewLinks for a removed one.
+type KeyChange struct {
+	Key      string
+	Old      []byte
+	New      []byte
+	OldLinks spec.Links
+	NewLinks spec.Links
+}
+
+// DiffRoots returns the keys that differ between the merkle trees of the
+// block headers rootA and rootB. Subtrees with the same CID in both trees
+// are skipped without being fetched, so the cost follows the number of
+// changes rather than the size of the trees.
+func (s *store) DiffRoots(ctx context.Context, rootA string, rootB string) (*TreeDiff, error) {
+	a, err := s.merkleRootOf(ctx, rootA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.merkleRootOf(ctx, rootB)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &TreeDiff{}
+	err = diffNodes(ctx, s.api, a, b, "", d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// merkleRootOf returns the merkle root of the block header rootCID.
+func (s *store) merkleRootOf(ctx context.Context, rootCID string) (*node, error) {
+	c, err := cid.Parse(rootCID)
+	if err != nil {
+		return nil, err
+	}
+	root, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return nil, err
+	}
+	merkleLink := root.links["merkle"]
+	if merkleLink == nil {
+		return nil, fmt.Errorf("%w: %s has no merkle tree", ErrBlockNotFound, rootCID)
+	}
+	return linkTarget(ctx, s.api, merkleLink)
+}
+
+// diffNodes adds to d the differences between the subtrees a and b at key,
+// either of which may be nil.
+func diffNodes(ctx context.Context, api backend, a *node, b *node, key string, d *TreeDiff) error {
+	switch {
+	case a == nil && b == nil:
+		return nil
+	case a == nil:
+		return walkNode(ctx, api, b, key, func(k string, n *node) error {
+			if len(k) > 0 && hasEntry(n) {
+				d.Added = append(d.Added, keyChange(k, nil, n))
+			}
+			return nil
+		})
+	case b == nil:
+		return walkNode(ctx, api, a, key, func(k string, n *node) error {
+			if len(k) > 0 && hasEntry(n) {
+				d.Removed = append(d.Removed, keyChange(k, n, nil))
+			}
+			return nil
+		})
+	case a.cnode.Cid().Equals(b.cnode.Cid()):
+		return nil
+	}
+
+	if len(key) > 0 {
+		switch {
+		case !hasEntry(a) && hasEntry(b):
+			d.Added = append(d.Added, keyChange(key, nil, b))
+		case hasEntry(a) && !hasEntry(b):
+			d.Removed = append(d.Removed, keyChange(key, a, nil))
+		case hasEntry(a) && !sameEntry(a, b):
+			d.Modified = append(d.Modified, keyChange(key, a, b))
+		}
+	}
+
+	children := make(map[string]bool)
+	for _, n := range []*node{a, b} {
+		for k := range n.links {
+			if len(k) == 1 {
+				children[k] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(children))
+	for k := range children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		la, lb := a.links[k], b.links[k]
+		if la != nil && lb != nil && linkCid(la) == linkCid(lb) {
+			continue
+		}
+		var ta, tb *node
+		var err error
+		if la != nil {
+			ta, err = linkTarget(ctx, api, la)
+			if err != nil {
+				return err
+			}
+		}
+		if lb != nil {
+			tb, err = linkTarget(ctx, api, lb)
+			if err != nil {
+				return err
+			}
+		}
+		err = diffNodes(ctx, api, ta, tb, key+k, d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyChange returns the change at key from the entry of a to that of b,
+// either of which may be nil.
+func keyChange(key string, a *node, b *node) KeyChange {
+	change := KeyChange{Key: key}
+	if a != nil {
+		change.Old = a.data
+		change.OldLinks = entryLinks(a)
+	}
+	if b != nil {
+		change.New = b.data
+		change.NewLinks = entryLinks(b)
+	}
+	return change
+}
+
+// entryLinks returns the named links of n, or nil if it has none.
+func entryLinks(n *node) spec.Links {
+	named := namedLinks(n)
+	if len(named) == 0 {
+		return nil
+	}
+	return makeSpecLinks(named)
+}
+
+// hasEntry reports whether n holds a value or named links.
+func hasEntry(n *node) bool {
+	return n.data != nil || len(namedLinks(n)) > 0
+}
+
+// sameEntry reports whether a and b hold the same value and named links.
+func sameEntry(a *node, b *node) bool {
+	if !bytes.Equal(a.data, b.data) || (a.data == nil) != (b.data == nil) || a.expires != b.expires {
+		return false
+	}
+	na, nb := namedLinks(a), namedLinks(b)
+	if len(na) != len(nb) {
+		return false
+	}
+	for k, la := range na {
+		lb := nb[k]
+		if lb == nil || linkCid(la) != linkCid(lb) {
+			return false
+		}
+	}
+	return true
+}
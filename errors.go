@@ -0,0 +1,153 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import "errors"
+
+var (
+	// ErrNotInBatch is returned by batch operations when the merkle tree
+	// has no open batch.
+	ErrNotInBatch = errors.New("the merkle tree is not in batch")
+
+	// ErrCommitConflict is returned by Commit for a block opened on a root
+	// that another block has since been committed on top of. The block
+	// must be reverted and opened again. Compact returns it when a block
+	// is opened or committed while it rewrites the tree.
+	ErrCommitConflict = errors.New("another block was committed since the block was opened")
+
+	// ErrBlockAlreadyOpen is returned by OpenBlock while a block is open.
+	ErrBlockAlreadyOpen = errors.New("a block is already open")
+
+	// ErrStoreNotOpen is returned by block operations when the block is
+	// not open.
+	ErrStoreNotOpen = errors.New("store is not currently open")
+
+	// ErrWrongBlockNumber is returned when a block is submitted to a store
+	// block opened for a different block number.
+	ErrWrongBlockNumber = errors.New("store was open for a different block number")
+
+	// ErrNoBlockSubmitted is returned by Commit when Submit has not been
+	// called.
+	ErrNoBlockSubmitted = errors.New("no block has been submitted")
+
+	// ErrBlockAlreadySubmitted is returned by Submit when a different block
+	// was already submitted to the store block.
+	ErrBlockAlreadySubmitted = errors.New("a different block has already been submitted")
+
+	// ErrKeyNotFound is returned when a key does not exist in the merkle
+	// tree.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrFetchTimeout is returned when a node cannot be fetched from IPFS
+	// within the configured store.ipfs.fetchtimeout.
+	ErrFetchTimeout = errors.New("timed out fetching node from IPFS")
+
+	// ErrBlockNotFound is returned when a block hash is not known to the
+	// store.
+	ErrBlockNotFound = errors.New("block not found")
+
+	// ErrOffline is returned when a node is not stored locally and the
+	// store runs with store.ipfs.online set to false.
+	ErrOffline = errors.New("node is not stored locally and the store is offline")
+
+	// ErrCorruptRootFile is returned by InitStore when the root file is
+	// truncated or fails its checksum.
+	ErrCorruptRootFile = errors.New("the root file is corrupt")
+
+	// ErrInvalidLinkName is returned when a named link put into the merkle
+	// tree would shadow a child link or a node value.
+	ErrInvalidLinkName = errors.New("invalid link name")
+
+	// ErrStoreClosed is returned when a block is opened after the store
+	// has begun closing.
+	ErrStoreClosed = errors.New("the store is closed")
+
+	// ErrReadOnly is returned by the operations that would change a store
+	// opened with InitStoreReadOnly.
+	ErrReadOnly = errors.New("the store is read-only")
+
+	// ErrConfigConflict is returned when a store is opened with
+	// process-wide settings that differ from those of a store already open
+	// in the process, see StoreConfig.
+	ErrConfigConflict = errors.New("the settings differ from those of an open store")
+
+	// ErrRootConflict is returned by CompareAndSetRoot when the root file
+	// no longer holds the expected root.
+	ErrRootConflict = errors.New("the root was changed by another writer")
+
+	// ErrValueTooLarge is returned when a value is larger than
+	// store.maxvaluesize.
+	ErrValueTooLarge = errors.New("value is too large")
+
+	// ErrKeyTooLong is returned when a key is longer than
+	// store.maxkeylength.
+	ErrKeyTooLong = errors.New("key is too long")
+
+	// ErrTooManyLinks is returned when a node would have more links than
+	// store.maxnodelinks.
+	ErrTooManyLinks = errors.New("node has too many links")
+
+	// ErrUnsupportedNodeVersion is returned when a node was written with a
+	// newer node layout than this version of the store reads.
+	ErrUnsupportedNodeVersion = errors.New("unsupported node layout version")
+
+	// ErrIPFSDown is returned by HealthCheck when the IPFS node is closed
+	// or offline.
+	ErrIPFSDown = errors.New("the IPFS node is down")
+
+	// ErrRepoLocked is returned by InitStore when another process holds
+	// the lock of the IPFS repo in store.datadir, after waiting for up to
+	// store.ipfs.waitforlock.
+	ErrRepoLocked = errors.New("the IPFS repo is locked by another process")
+
+	// ErrRootUnresolvable is returned by HealthCheck when the root cannot
+	// be fetched.
+	ErrRootUnresolvable = errors.New("the root cannot be resolved")
+
+	// ErrMerkleRootMissing is returned by HealthCheck when the merkle root
+	// is not stored.
+	ErrMerkleRootMissing = errors.New("the merkle root is missing")
+
+	// ErrNodeMismatch is returned by a commit with store.debug set when a
+	// node's CID does not match its encoded data and links.
+	ErrNodeMismatch = errors.New("node does not match its CID")
+
+	// ErrBlockNotSuccessor is returned by Submit with store.strictblocknumbers
+	// set, and by AppendBlock, when the block number is not one more than
+	// its parent's.
+	ErrBlockNotSuccessor = errors.New("block number does not follow its parent")
+
+	// ErrParentMismatch is returned by AppendBlock when the block's parent
+	// is not the block at the current root.
+	ErrParentMismatch = errors.New("block does not build on the current root")
+
+	// ErrEncodingChanged is returned by InitStore when the nil roots no
+	// longer encode to NilStoreRoot and NilMerkleRoot.
+	ErrEncodingChanged = errors.New("node encoding has changed")
+
+	// ErrUnsupportedCodec is returned when a node is encoded with an IPLD
+	// codec the store cannot decode.
+	ErrUnsupportedCodec = errors.New("unsupported IPLD codec")
+
+	// ErrRootNotSigned is returned by GetSignedRoot when the store does
+	// not sign its roots.
+	ErrRootNotSigned = errors.New("the root is not signed")
+
+	// ErrBadRootSignature is returned by VerifySignedRoot when a signature
+	// does not match the root.
+	ErrBadRootSignature = errors.New("bad root signature")
+)
@@ -0,0 +1,72 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import "sync"
+
+// CommitEvent describes a committed block.
+type CommitEvent struct {
+	Hash   string // block hash
+	Number uint64
+	Root   string // CID of the new root
+}
+
+// commitEventBuffer is the number of events buffered for each subscriber.
+// Events published while a subscriber's buffer is full are dropped for that
+// subscriber, so that a slow consumer cannot stall commits.
+const commitEventBuffer = 64
+
+type subscribers struct {
+	sync.Mutex
+	chans map[<-chan CommitEvent]chan CommitEvent
+}
+
+// SubscribeCommits returns a channel that receives an event for each block
+// committed from now on, in commit order.
+func (s *store) SubscribeCommits() <-chan CommitEvent {
+	s.subs.Lock()
+	defer s.subs.Unlock()
+	if s.subs.chans == nil {
+		s.subs.chans = make(map[<-chan CommitEvent]chan CommitEvent)
+	}
+	ch := make(chan CommitEvent, commitEventBuffer)
+	s.subs.chans[ch] = ch
+	return ch
+}
+
+// Unsubscribe stops events to ch, a channel returned by SubscribeCommits,
+// and closes it.
+func (s *store) Unsubscribe(ch <-chan CommitEvent) {
+	s.subs.Lock()
+	defer s.subs.Unlock()
+	if c, ok := s.subs.chans[ch]; ok {
+		delete(s.subs.chans, ch)
+		close(c)
+	}
+}
+
+func (s *store) publishCommit(e CommitEvent) {
+	s.subs.Lock()
+	defer s.subs.Unlock()
+	for _, c := range s.subs.chans {
+		select {
+		case c <- e:
+		default:
+			logger.Error("commit event dropped for a slow subscriber", "hash", e.Hash, "number", e.Number)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/corehttp"
+)
+
+// startGateway serves the IPFS HTTP gateway of the store's node on addr,
+// a host:port, until the store is closed. Nodes are fetched from
+// http://addr/ipfs/<cid>, optionally followed by a path of link names.
+func (s *store) startGateway(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("store.ipfs.gateway.addr: %w", err)
+	}
+	s.gateway = lis
+
+	go func() {
+		err := corehttp.Serve(s.ipfs, lis, gatewayOption(s.api))
+		s.Lock()
+		closed := s.closed
+		s.Unlock()
+		if err != nil && !closed {
+			logger.Error("gateway stopped", "addr", addr, "err", err)
+		}
+	}()
+	logger.Info("gateway started", "addr", lis.Addr().String())
+	return nil
+}
+
+// GatewayAddr returns the address the IPFS HTTP gateway listens on, or ""
+// if store.ipfs.gateway.addr is not set.
+func (s *store) GatewayAddr() string {
+	if s.gateway == nil {
+		return ""
+	}
+	return s.gateway.Addr().String()
+}
+
+// gatewayOption serves /ipfs/ with gatewayHandler in front of the IPFS
+// gateway.
+func gatewayOption(api backend) corehttp.ServeOption {
+	return func(n *core.IpfsNode, lis net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		gw := http.NewServeMux()
+		_, err := corehttp.GatewayOption(false, "/ipfs")(n, lis, gw)
+		if err != nil {
+			return nil, err
+		}
+		mux.Handle("/ipfs/", &gatewayHandler{api: api, next: gw})
+		return mux, nil
+	}
+}
+
+// gatewayHandler serves store nodes, which the IPFS gateway does not since
+// it reads only unixfs files, as their raw blocks. Requests for anything
+// else, including nodes of other codecs, go to the IPFS gateway.
+type gatewayHandler struct {
+	api  backend
+	next http.Handler
+}
+
+func (h *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	p := "/ipld/" + strings.TrimPrefix(r.URL.Path, "/ipfs/")
+	n, err := getObj(r.Context(), h.api, p)
+	if errors.Is(err, cbor.ErrNoSuchLink) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	c := n.cnode.Cid()
+	switch c.Type() {
+	case cid.DagCBOR:
+		w.Header().Set("Content-Type", "application/cbor")
+	case dagJSON:
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Etag", `"`+c.String()+`"`)
+	w.Header().Set("X-Ipfs-Path", r.URL.Path)
+	w.Write(n.cnode.RawData())
+}
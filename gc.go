@@ -0,0 +1,91 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+)
+
+// GC removes stored nodes that are not pinned, such as those written by
+// commits that were then reverted, and returns how many were removed. The
+// current root and submitted block roots are protected: with store.ipfs.pin
+// set their nodes are already pinned, otherwise each of their nodes that is
+// not already pinned is pinned directly for the duration of the collection.
+// Pins taken before GC, including the root pin of store.ipfs.pinrecursive,
+// are left as they were, and the DAG below the root pin is not walked. The
+// targets of TreePutLink links are neither fetched nor protected. GC fails
+// if any block is open, and blocks are not opened until it is done.
+func (s *store) GC(ctx context.Context) (int, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.storeBlocks) > 0 {
+		return 0, fmt.Errorf("%w: commit or revert open blocks before GC", ErrBlockAlreadyOpen)
+	}
+
+	if !pin {
+		var pinned []coreiface.Path
+		defer func() {
+			for _, p := range pinned {
+				err := s.api.unpin(ctx, p)
+				if err != nil {
+					logger.Error("failed to unpin after GC", "path", p, "err", err)
+				}
+			}
+		}()
+
+		heads := []*node{s.root}
+		for _, n := range s.blockRoots {
+			heads = append(heads, n)
+		}
+		// the recursive root pin already protects its DAG
+		live := make(map[string]bool)
+		if s.rootPin != nil {
+			live[strings.TrimPrefix(s.rootPin.String(), "/ipld/")] = true
+		}
+		err := s.walkLive(ctx, heads, nil, live, func(n *node) error {
+			ok, err := s.api.pinned(ctx, n.cnode.Cid())
+			if err != nil || ok {
+				return err
+			}
+			err = s.api.pin(ctx, n.path, false)
+			if err != nil {
+				return err
+			}
+			pinned = append(pinned, n.path)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	freed, err := s.api.gc(ctx)
+	if err != nil {
+		logger.Error("gc failed", "freed", freed, "err", err)
+		return freed, err
+	}
+	logger.Info("gc complete", "freed", freed)
+	return freed, nil
+}
@@ -17,71 +17,583 @@
 package storeipfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/ipfs/go-ipfs/core/coreapi"
+	mh "gx/ipfs/QmPnFwZ2JXKnXgMw8CdBPxn7FWh6LLdjUjxV1fKHuJnkr8/go-multihash"
+
+	"github.com/ipfs/go-ipfs/core"
 	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
 	"github.com/spf13/viper"
 )
 
+// Store is the store opened by InitStore.
+//
+// Deprecated: use the store returned by InitStoreWithConfig, so that more
+// than one store can be open in a process.
 var Store *store
+
 var pin bool
+var pinRecursive bool
+var prefetchDepth = 1
+var commitWorkers int
+var dagBatchSize int
+var fetchTimeout time.Duration
+var cache *nodeCache
+var online bool
+var hashFunc uint64 = mh.SHA2_256
+var maxValueSize = defaultMaxValueSize
+var maxNodeLinks = defaultMaxNodeLinks
+var maxKeyLength = defaultMaxKeyLength
+var spillNodes int
+var dedupCheck bool
+var durability = durabilityFlush
+var strictBlockNumbers bool
+
+const defaultDagBatchSize = 700
 
+// The values of store.ipfs.durability, how much of a commit is forced to
+// disk before Commit returns. Each level is slower than the one before.
+//
+// none leaves the root file and the datastore to the operating system. A
+// crash of the machine shortly after a commit may lose the root file or
+// the nodes it points at, so the store restarts on an older or a missing
+// root. It saves an fsync per commit.
+//
+// flush, the default, fsyncs each root file before renaming it into
+// place, so that the root file is never torn. Nodes are left to the
+// datastore, which flatfs writes with its own sync setting and badger
+// with its write-ahead log.
+//
+// fsync also syncs the IPFS datastore after writing the nodes of a commit
+// and the data directory after renaming the root file, so that a
+// committed root and every node under it survive a power loss. It costs a
+// datastore sync and two fsyncs per commit.
+const (
+	durabilityNone  = "none"
+	durabilityFlush = "flush"
+	durabilityFsync = "fsync"
+)
+
+// NilStoreRoot is the root of a store with no committed blocks, and
+// NilMerkleRoot the root of an empty merkle tree, with the default sha2-256
+// hash function. InitStore fails if the nodes no longer encode to these
+// CIDs, as the roots of existing chains would no longer resolve.
+//
+// The roots carry the version 1 layout marker. Stores created before it
+// start from the unmarked roots zdpuAmUr33yuaUdvJKUQUAvsy8a8fGfeCoucuFuhUybEdbP6M
+// and zdpuAsSjSbrPSXPoW5nBw15MbQby59kULnfzBCDeArYgUZg7p, which still resolve
+// as version 0 nodes.
+const (
+	NilStoreRoot  = "zdpuAsAHtBsKmT3Fns9F8KCbrxFjD7xFMPczmcRi2zNdx7ymG"
+	NilMerkleRoot = "zdpuAqypEaMy5B9D9L6UEtENhU7CNF5xRf863FXJp5tJRxUfZ"
+)
+
+// The defaults keep an encoded node within the 1 MiB block size that IPFS
+// reliably transfers. A link costs about 40 bytes plus its name.
+const (
+	defaultMaxValueSize = 1 << 19
+	defaultMaxNodeLinks = 4096
+)
+
+// defaultMaxKeyLength is well above the longest keys the store writes
+// itself, which hold a hash or two.
+const defaultMaxKeyLength = 1024
+
+// StoreConfig holds the settings of a store. DataDir, InMemory,
+// PendingDir, ReadOnly, BloomKeys, SignRoots, the IPNS settings and the
+// IPFS repo and network settings are kept per store or per IPFS node. The
+// others apply to every store in the process, so a store opened while
+// another is open must use the same ones, or it fails with
+// ErrConfigConflict.
+type StoreConfig struct {
+	DataDir    string // directory of the IPFS repo and root file
+	InMemory   bool   // keep nodes in memory, without IPFS or a root file
+	PendingDir string // submitted blocks are logged here until committed, if set
+	ReadOnly   bool   // see InitStoreReadOnly
+	Debug      bool
+
+	Pin                bool
+	PinRecursive       bool // pin the root of each commit recursively, fetching TreePutLink targets
+	Online             bool
+	CommitWorkers      int
+	DagBatchSize       int
+	DedupCheck         bool   // skip putting nodes IPFS already holds, counting them
+	Durability         string // "none", "flush", the default, or "fsync"
+	FetchTimeout       time.Duration
+	PrefetchDepth      int // trie levels to resolve per IPFS call, 1 for one at a time
+	NodeCacheSize      int
+	HashFunc           string // multihash name, e.g. "sha2-256"
+	Codec              string // "dag-cbor", the default, or "dag-json", in memory only
+	MaxValueSize       int
+	MaxNodeLinks       int
+	MaxKeyLength       int
+	SpillNodes         int // changed nodes Submit holds before writing some, 0 for no limit
+	BloomKeys          int // keys the lookup filter is sized for, 0 for no filter
+	MaxRetries         int
+	RetryBackoff       time.Duration
+	StrictBlockNumbers bool // Submit requires each block to follow its parent
+
+	BootstrapList []string
+	SwarmHosts    []string
+	SwarmPort     int
+	DisableNAT    bool
+	SwarmKey      string        // swarm.key content or path
+	Datastore     string        // "flatfs" or "badger"
+	WaitForLock   time.Duration // how long to wait for another process to release the repo
+	GatewayAddr   string        // host:port to serve the IPFS HTTP gateway on, if set
+
+	ReprovideStrategy string // "all", "pinned" or "roots", see reprovideStrategies
+	SignRoots         bool   // sign each root with the IPFS node's private key
+
+	IPNSKey         string // key to publish the root under, "self" if empty
+	IPNSAutoPublish bool   // publish the root after each commit
+
+	RemotePinEndpoint string
+	RemotePinToken    string
+	RemotePinStrict   bool
+}
+
+// DefaultStoreConfig returns the settings used for keys missing from the
+// viper configuration.
+func DefaultStoreConfig() StoreConfig {
+	return StoreConfig{
+		Online:        true,
+		CommitWorkers: 1,
+		DagBatchSize:  defaultDagBatchSize,
+		PrefetchDepth: 1,
+		MaxValueSize:  defaultMaxValueSize,
+		MaxNodeLinks:  defaultMaxNodeLinks,
+		MaxKeyLength:  defaultMaxKeyLength,
+		MaxRetries:    defaultMaxRetries,
+		RetryBackoff:  defaultRetryBackoff}
+}
+
+// configFromViper reads the store settings from the store.* viper keys.
+func configFromViper() StoreConfig {
+	cfg := DefaultStoreConfig()
+	cfg.DataDir = viper.GetString("store.datadir")
+	cfg.InMemory = viper.GetBool("store.inmemory")
+	cfg.PendingDir = viper.GetString("store.pendingdir")
+	cfg.ReadOnly = viper.GetBool("store.readonly")
+	cfg.Debug = viper.GetBool("store.debug")
+	cfg.Pin = viper.GetBool("store.ipfs.pin")
+	cfg.PinRecursive = viper.GetBool("store.ipfs.pinrecursive")
+	if viper.IsSet("store.ipfs.online") {
+		cfg.Online = viper.GetBool("store.ipfs.online")
+	}
+	cfg.CommitWorkers = viper.GetInt("store.ipfs.commitworkers")
+	if viper.IsSet("store.ipfs.dagbatchsize") {
+		cfg.DagBatchSize = viper.GetInt("store.ipfs.dagbatchsize")
+	}
+	cfg.DedupCheck = viper.GetBool("store.ipfs.dedupcheck")
+	cfg.Durability = viper.GetString("store.ipfs.durability")
+	cfg.FetchTimeout = viper.GetDuration("store.ipfs.fetchtimeout")
+	if viper.IsSet("store.ipfs.prefetchdepth") {
+		cfg.PrefetchDepth = viper.GetInt("store.ipfs.prefetchdepth")
+	}
+	cfg.NodeCacheSize = viper.GetInt("store.ipfs.nodecachesize")
+	cfg.HashFunc = viper.GetString("store.ipfs.hashfunc")
+	cfg.Codec = viper.GetString("store.ipfs.codec")
+	if viper.IsSet("store.maxvaluesize") {
+		cfg.MaxValueSize = viper.GetInt("store.maxvaluesize")
+	}
+	if viper.IsSet("store.maxnodelinks") {
+		cfg.MaxNodeLinks = viper.GetInt("store.maxnodelinks")
+	}
+	cfg.SpillNodes = viper.GetInt("store.spillnodes")
+	cfg.BloomKeys = viper.GetInt("store.bloomkeys")
+	if viper.IsSet("store.maxkeylength") {
+		cfg.MaxKeyLength = viper.GetInt("store.maxkeylength")
+	}
+	cfg.StrictBlockNumbers = viper.GetBool("store.strictblocknumbers")
+	if viper.IsSet("store.ipfs.maxretries") {
+		cfg.MaxRetries = viper.GetInt("store.ipfs.maxretries")
+	}
+	if viper.IsSet("store.ipfs.retrybackoff") {
+		cfg.RetryBackoff = viper.GetDuration("store.ipfs.retrybackoff")
+	}
+	cfg.BootstrapList = viper.GetStringSlice("store.ipfs.bootstraplist")
+	cfg.SwarmHosts = viper.GetStringSlice("store.ipfs.swarmhosts")
+	cfg.SwarmPort = viper.GetInt("store.ipfs.swarmport")
+	cfg.DisableNAT = viper.GetBool("store.ipfs.disablenat")
+	cfg.SwarmKey = viper.GetString("store.ipfs.swarmkey")
+	cfg.Datastore = viper.GetString("store.ipfs.datastore")
+	cfg.WaitForLock = viper.GetDuration("store.ipfs.waitforlock")
+	cfg.GatewayAddr = viper.GetString("store.ipfs.gateway.addr")
+	cfg.ReprovideStrategy = viper.GetString("store.ipfs.reprovidestrategy")
+	cfg.SignRoots = viper.GetBool("store.ipfs.signroots")
+	cfg.IPNSKey = viper.GetString("store.ipfs.ipnskey")
+	cfg.IPNSAutoPublish = viper.GetBool("store.ipfs.ipnsautopublish")
+	cfg.RemotePinEndpoint = viper.GetString("store.ipfs.remotepin.endpoint")
+	cfg.RemotePinToken = viper.GetString("store.ipfs.remotepin.token")
+	cfg.RemotePinStrict = viper.GetBool("store.ipfs.remotepin.strict")
+	return cfg
+}
+
+// InitStore initializes the Store global from the store.* viper keys.
 func InitStore(ctx context.Context) error {
-	pin = viper.GetBool("store.ipfs.pin")
+	return initStoreGlobal(ctx, configFromViper())
+}
+
+// InitStoreReadOnly initializes the Store global from the store.* viper
+// keys as a read-only store, for a replica serving queries. It loads the
+// root and merkle tree, and nodes can still be fetched and pinned, but
+// opening blocks, putting nodes and changing the root return ErrReadOnly.
+// The root file is never written.
+func InitStoreReadOnly(ctx context.Context) error {
+	cfg := configFromViper()
+	cfg.ReadOnly = true
+	return initStoreGlobal(ctx, cfg)
+}
 
-	ipfs, err := initIPFS(ctx)
+func initStoreGlobal(ctx context.Context, cfg StoreConfig) error {
+	s, err := InitStoreWithConfig(ctx, cfg)
 	if err != nil {
 		return err
 	}
+	storeMu.Lock()
+	Store = s
+	storeMu.Unlock()
+	return nil
+}
 
-	api := coreapi.NewCoreAPI(ipfs)
+// configMu guards configStores and appliedConfig.
+var configMu sync.Mutex
 
-	var merkleRoot string
-	Store = &store{ipfs: ipfs, api: api}
-	Store.rootFile = path.Join(viper.GetString("store.datadir"), "root")
-	root, err := Store.getPreviousRoot(ctx)
+// configStores counts the open stores sharing the process-wide settings
+// applied from appliedConfig, see applyConfig and releaseConfig.
+var configStores int
+var appliedConfig StoreConfig
+
+// processConfig returns the settings of cfg that apply to the whole
+// process, without those kept per store or per IPFS node.
+func processConfig(cfg StoreConfig) StoreConfig {
+	return StoreConfig{
+		Debug:              cfg.Debug,
+		Pin:                cfg.Pin,
+		PinRecursive:       cfg.PinRecursive,
+		Online:             cfg.Online,
+		CommitWorkers:      cfg.CommitWorkers,
+		DagBatchSize:       cfg.DagBatchSize,
+		DedupCheck:         cfg.DedupCheck,
+		Durability:         cfg.Durability,
+		FetchTimeout:       cfg.FetchTimeout,
+		PrefetchDepth:      cfg.PrefetchDepth,
+		NodeCacheSize:      cfg.NodeCacheSize,
+		HashFunc:           cfg.HashFunc,
+		Codec:              cfg.Codec,
+		MaxValueSize:       cfg.MaxValueSize,
+		MaxNodeLinks:       cfg.MaxNodeLinks,
+		MaxKeyLength:       cfg.MaxKeyLength,
+		SpillNodes:         cfg.SpillNodes,
+		MaxRetries:         cfg.MaxRetries,
+		RetryBackoff:       cfg.RetryBackoff,
+		StrictBlockNumbers: cfg.StrictBlockNumbers,
+		RemotePinEndpoint:  cfg.RemotePinEndpoint,
+		RemotePinToken:     cfg.RemotePinToken,
+		RemotePinStrict:    cfg.RemotePinStrict}
+}
+
+// applyConfig sets the process-wide settings from cfg for a store being
+// opened. While another store is open the settings are kept, and cfg must
+// hold the same ones or applyConfig returns ErrConfigConflict. Each
+// successful call must be matched by releaseConfig once the store is
+// closed or fails to open.
+func applyConfig(cfg StoreConfig) error {
+	if cfg.DagBatchSize <= 0 {
+		return fmt.Errorf("store.ipfs.dagbatchsize must be greater than 0, got %d", cfg.DagBatchSize)
+	}
+	if cfg.MaxValueSize <= 0 {
+		return fmt.Errorf("store.maxvaluesize must be greater than 0, got %d", cfg.MaxValueSize)
+	}
+	if cfg.MaxNodeLinks <= 0 {
+		return fmt.Errorf("store.maxnodelinks must be greater than 0, got %d", cfg.MaxNodeLinks)
+	}
+	if cfg.SpillNodes < 0 {
+		return fmt.Errorf("store.spillnodes must not be negative, got %d", cfg.SpillNodes)
+	}
+	if cfg.BloomKeys < 0 {
+		return fmt.Errorf("store.bloomkeys must not be negative, got %d", cfg.BloomKeys)
+	}
+	if cfg.MaxKeyLength <= 0 {
+		return fmt.Errorf("store.maxkeylength must be greater than 0, got %d", cfg.MaxKeyLength)
+	}
+	if cfg.PrefetchDepth <= 0 {
+		return fmt.Errorf("store.ipfs.prefetchdepth must be greater than 0, got %d", cfg.PrefetchDepth)
+	}
+	if cfg.ReprovideStrategy != "" {
+		err := checkReprovideStrategy(cfg.ReprovideStrategy)
+		if err != nil {
+			return err
+		}
+	}
+	switch cfg.Durability {
+	case "", durabilityNone, durabilityFlush, durabilityFsync:
+	default:
+		return fmt.Errorf("store.ipfs.durability must be none, flush or fsync, got %q", cfg.Durability)
+	}
+	if cfg.MaxRetries < 0 {
+		return fmt.Errorf("store.ipfs.maxretries must not be negative, got %d", cfg.MaxRetries)
+	}
+	code := uint64(mh.SHA2_256)
+	if cfg.HashFunc != "" {
+		var err error
+		code, err = parseHashFunc(cfg.HashFunc)
+		if err != nil {
+			return err
+		}
+	}
+	nc, err := parseCodec(cfg.Codec)
 	if err != nil {
 		return err
 	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if configStores > 0 {
+		if !reflect.DeepEqual(processConfig(cfg), appliedConfig) {
+			return fmt.Errorf("%w: close the open stores first", ErrConfigConflict)
+		}
+		configStores++
+		return nil
+	}
+	configStores++
+	appliedConfig = processConfig(cfg)
+
+	debug = cfg.Debug
+	pin = cfg.Pin
+	pinRecursive = cfg.PinRecursive
+	online = cfg.Online
+	commitWorkers = cfg.CommitWorkers
+	if commitWorkers < 1 {
+		commitWorkers = 1
+	}
+	dagBatchSize = cfg.DagBatchSize
+	fetchTimeout = cfg.FetchTimeout
+	prefetchDepth = cfg.PrefetchDepth
+	maxRetries = cfg.MaxRetries
+	retryBackoff = cfg.RetryBackoff
+	maxValueSize = cfg.MaxValueSize
+	maxNodeLinks = cfg.MaxNodeLinks
+	maxKeyLength = cfg.MaxKeyLength
+	spillNodes = cfg.SpillNodes
+	dedupCheck = cfg.DedupCheck
+	durability = cfg.Durability
+	if durability == "" {
+		durability = durabilityFlush
+	}
+	strictBlockNumbers = cfg.StrictBlockNumbers
+	hashFunc = code
+	codec = nc
+	cache = nil
+	if cfg.NodeCacheSize > 0 {
+		cache = newNodeCache(cfg.NodeCacheSize)
+	}
+	remotePinner = nil
+	if cfg.RemotePinEndpoint != "" {
+		remotePinner = newHTTPPinner(cfg.RemotePinEndpoint, cfg.RemotePinToken)
+	}
+	remotePinStrict = cfg.RemotePinStrict
+	return nil
+}
+
+// releaseConfig releases the settings applied for a store that has closed
+// or failed to open, so that the next store may apply its own.
+func releaseConfig() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	configStores--
+}
+
+// InitStoreWithConfig opens a store with the settings in cfg and returns
+// it. It does not set the Store global.
+func InitStoreWithConfig(ctx context.Context, cfg StoreConfig) (*store, error) {
+	if !cfg.InMemory {
+		err := checkIPFSCodec(cfg.Codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := applyConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNilRoots()
+	if err != nil {
+		releaseConfig()
+		logger.Error("node encoding self-check failed", "err", err)
+		return nil, err
+	}
+
+	var ipfs *core.IpfsNode
+	var api backend
+	if cfg.InMemory {
+		api = newMemBackend()
+	} else {
+		ipfs, err = initIPFS(ctx, cfg)
+		if err != nil {
+			releaseConfig()
+			logger.Error("failed to start ipfs node", "err", err)
+			return nil, err
+		}
+		api = newIPFSBackend(ipfs)
+	}
+	s, err := initStore(ctx, cfg, ipfs, api, true)
+	if err != nil {
+		releaseConfig()
+		return nil, err
+	}
+	return s, nil
+}
+
+// InitStoreWithNode opens a store on node, an IPFS node the caller has
+// built and runs, and returns it. The repo and network settings of cfg are
+// not used, and closing the store leaves node running. The root file is
+// kept in cfg.DataDir unless cfg.InMemory is set. It does not set the Store
+// global.
+func InitStoreWithNode(ctx context.Context, node *core.IpfsNode, cfg StoreConfig) (*store, error) {
+	if node == nil {
+		return nil, errors.New("InitStoreWithNode requires an IPFS node")
+	}
+	err := checkIPFSCodec(cfg.Codec)
+	if err != nil {
+		return nil, err
+	}
+	err = applyConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNilRoots()
+	if err != nil {
+		releaseConfig()
+		logger.Error("node encoding self-check failed", "err", err)
+		return nil, err
+	}
+	s, err := initStore(ctx, cfg, node, newIPFSBackend(node), false)
+	if err != nil {
+		releaseConfig()
+		return nil, err
+	}
+	return s, nil
+}
+
+// initStore opens a store on api, backed by ipfs unless it is nil, and
+// loads the previous root. ownsNode reports whether the store closes ipfs.
+func initStore(ctx context.Context, cfg StoreConfig, ipfs *core.IpfsNode, api backend, ownsNode bool) (*store, error) {
+	var merkleRoot string
+	s := &store{
+		ipfs:        ipfs,
+		ownsNode:    ownsNode,
+		readOnly:    cfg.ReadOnly,
+		api:         api,
+		storeBlocks: make(map[uint64]*storeBlock),
+		blockRoots:  make(map[string]*node),
+		pendingDir:  cfg.PendingDir,
+		ipnsKey:     cfg.IPNSKey,
+		autoPublish: cfg.IPNSAutoPublish}
+	if s.ipnsKey == "" {
+		s.ipnsKey = defaultIPNSKey
+	}
+	if !cfg.InMemory {
+		s.rootFile = path.Join(cfg.DataDir, "root")
+	}
+	if cfg.SignRoots {
+		if ipfs == nil || ipfs.PrivateKey == nil {
+			return nil, errors.New("store.ipfs.signroots requires an IPFS node with a private key")
+		}
+		s.signer = ipfs.PrivateKey
+	}
+	if cfg.GatewayAddr != "" && ipfs == nil {
+		return nil, errors.New("store.ipfs.gateway.addr requires an IPFS node")
+	}
+	root, err := s.getPreviousRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
 	if root == nil {
-		root, err = Store.makeNilRoot(ctx)
+		root, err = s.makeNilRoot(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		Store.root = root
+		s.root = root
 	} else {
-		Store.root = root
+		s.root = root
 		if root.links["merkle"] != nil {
 			merkleRoot = root.links["merkle"].targetCid.String()
 		}
 	}
 
-	merkle, err := initMerkle(ctx, ipfs, merkleRoot)
+	merkle, err := initMerkle(ctx, api, merkleRoot)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	Store.merkleTree = merkle
-	Store.root.links["merkle"] = &link{key: "merkle", targetNode: merkle.root}
-	Store.root.changedLinks["merkle"] = true
-	root, err = recomputeNode(Store.root)
+	s.merkleTree = merkle
+	if cfg.BloomKeys > 0 {
+		err = merkle.loadFilter(ctx, cfg.BloomKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.root.links["merkle"] = &link{key: "merkle", targetNode: merkle.root}
+	s.root.changedLinks["merkle"] = true
+	root, err = recomputeNode(s.root)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	Store.root = root
+	s.root = root
+	s.Root = root.cnode.String()
 
-	err = putObj(ctx, api, Store.root)
+	err = putObj(ctx, api, s.root)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if pinRecursive {
+		err = s.pinRoot(ctx, s.root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.writeRootFile(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.readOnly {
+		err = s.recoverPending(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.GatewayAddr != "" {
+		err = s.startGateway(cfg.GatewayAddr)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return Store.writeRootFile(ctx)
+	logger.Info("store initialized", "root", s.Root, "merkle", s.merkleTree.getRoot())
+	return s, nil
 }
 
 func (s *store) getPreviousRoot(ctx context.Context) (*node, error) {
+	if s.rootFile == "" {
+		return nil, nil
+	}
 	if _, err := os.Stat(s.rootFile); os.IsNotExist(err) {
 		return nil, nil
 	}
@@ -89,16 +601,151 @@ func (s *store) getPreviousRoot(ctx context.Context) (*node, error) {
 	if err != nil {
 		return nil, err
 	}
-	path := string(rb)
+	path, err := parseRootFile(rb)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v (a previous root may be in %s.bak)", ErrCorruptRootFile, s.rootFile, err, s.rootFile)
+	}
 	return getObj(ctx, s.api, path)
 }
 
+// writeRootFile writes the root path to the root file, replacing it
+// atomically. The previous root file is kept with a .bak suffix. With
+// store.ipfs.signroots set the root is signed first, see signRoot. A
+// read-only store writes nothing.
 func (s *store) writeRootFile(ctx context.Context) error {
+	if s.readOnly {
+		return nil
+	}
+	err := s.signRoot()
+	if err != nil {
+		return err
+	}
+	if s.rootFile == "" {
+		return nil
+	}
 	path := coreiface.IpldPath(s.root.cnode.Cid())
-	pathb := []byte(path.String())
-	return ioutil.WriteFile(s.rootFile, pathb, os.FileMode(0744))
+	content := formatRootFile(path.String())
+
+	if prev, err := ioutil.ReadFile(s.rootFile); err == nil {
+		if _, err := parseRootFile(prev); err == nil && !bytes.Equal(prev, content) {
+			err = writeFileAtomic(s.rootFile+".bak", prev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writeFileAtomic(s.rootFile, content)
+}
+
+const rootFileVersion = "storeipfs-root/1"
+
+// formatRootFile returns the root file content: the version, a CRC-32
+// checksum of the path and the path, separated by spaces.
+func formatRootFile(path string) []byte {
+	return []byte(fmt.Sprintf("%s %08x %s\n", rootFileVersion, crc32.ChecksumIEEE([]byte(path)), path))
+}
+
+// parseRootFile returns the root path from root file content. Root files
+// written before the checksum was added hold only the path.
+func parseRootFile(b []byte) (string, error) {
+	content := strings.TrimSpace(string(b))
+	if strings.HasPrefix(content, "/ipld/") && !strings.ContainsAny(content, " \n") {
+		return content, nil
+	}
+
+	parts := strings.Split(content, " ")
+	if len(parts) != 3 || parts[0] != rootFileVersion {
+		return "", errors.New("unrecognized format")
+	}
+	sum, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return "", errors.New("malformed checksum")
+	}
+	if uint32(sum) != crc32.ChecksumIEEE([]byte(parts[2])) {
+		return "", errors.New("checksum mismatch")
+	}
+	return parts[2], nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to name,
+// syncing as store.ipfs.durability asks.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && durability != durabilityNone {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, name)
+	if err != nil || durability != durabilityFsync {
+		return err
+	}
+	return syncDir(path.Dir(name))
+}
+
+// syncDir fsyncs the directory dir, so that a rename in it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (s *store) makeNilRoot(ctx context.Context) (*node, error) {
 	return makeNodeFromObj([]byte("root"), make(map[string]*link))
 }
+
+// nilRoots returns the CIDs of the nil store root and the empty merkle tree
+// with the configured hash function and codec.
+func nilRoots() (string, string, error) {
+	merkle, err := makeNodeFromObj([]byte("tree"), nil)
+	if err != nil {
+		return "", "", err
+	}
+	root, err := makeNodeFromObj([]byte("root"), map[string]*link{"merkle": {key: "merkle", targetNode: merkle}})
+	if err != nil {
+		return "", "", err
+	}
+	return root.cnode.String(), merkle.cnode.String(), nil
+}
+
+// checkNilRoots returns ErrEncodingChanged if the nil roots do not encode
+// to NilStoreRoot and NilMerkleRoot. Other hash functions and codecs are
+// not checked.
+func checkNilRoots() error {
+	if hashFunc != mh.SHA2_256 || codec != (cborCodec{}) {
+		return nil
+	}
+	root, merkle, err := nilRoots()
+	if err != nil {
+		return err
+	}
+	if root != NilStoreRoot || merkle != NilMerkleRoot {
+		return fmt.Errorf("%w: nil roots are %s and %s, expected %s and %s", ErrEncodingChanged, root, merkle, NilStoreRoot, NilMerkleRoot)
+	}
+	return nil
+}
+
+// IsEmpty reports whether no block has been committed to the store. With
+// the default hash function and codec the root of an empty store is
+// NilStoreRoot.
+func (s *store) IsEmpty() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.root.links["parent"] == nil
+}
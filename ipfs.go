@@ -18,44 +18,119 @@ package storeipfs
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	config "gx/ipfs/QmSoYrBMibm2T3LupaLuez7LPGnyrJwdRxvTfPUyCp691u/go-ipfs-config"
 
 	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/repo"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
-	"github.com/spf13/viper"
 )
 
-func initIPFS(ctx context.Context) (*core.IpfsNode, error) {
-	dataDir := viper.GetString("store.datadir")
+func initIPFS(ctx context.Context, scfg StoreConfig) (*core.IpfsNode, error) {
+	dataDir := scfg.DataDir
+	datastore := scfg.Datastore
 	if _, err := fsrepo.ConfigAt(dataDir); err != nil {
-		err = initRepo(dataDir)
+		err = initRepo(dataDir, datastore)
 		if err != nil {
 			return nil, err
 		}
+	} else if datastore != "" {
+		err = checkDatastore(dataDir, datastore)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writeSwarmKey(dataDir, scfg.SwarmKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := openRepo(ctx, dataDir, scfg.WaitForLock)
+	if err != nil {
+		return nil, err
 	}
 
-	repo, err := fsrepo.Open(dataDir)
+	repoCfg, err := r.Config()
 	if err != nil {
 		return nil, err
 	}
+	err = applyRepoConfig(repoCfg, scfg)
+	if err != nil {
+		return nil, err
+	}
+	r.SetConfig(repoCfg)
+
+	cfg := core.BuildCfg{
+		Online:    online,
+		Permanent: true,
+		Repo:      r}
 
-	repoCfg, err := repo.Config()
+	ipfsNode, err := core.NewNode(ctx, &cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	return ipfsNode, nil
+}
+
+// repoLockRetry is how often openRepo tries a locked repo again.
+const repoLockRetry = 250 * time.Millisecond
+
+// openRepo opens the IPFS repo in dataDir. While another process holds the
+// repo lock it tries again for up to wait, and then returns ErrRepoLocked.
+func openRepo(ctx context.Context, dataDir string, wait time.Duration) (repo.Repo, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		r, err := fsrepo.Open(dataDir)
+		if err == nil {
+			return r, nil
+		}
+		if !repoLocked(dataDir, err) {
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w: %s: %v", ErrRepoLocked, dataDir, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s: %v", ErrRepoLocked, dataDir, ctx.Err())
+		case <-time.After(repoLockRetry):
+		}
+	}
+}
+
+// repoLocked reports whether err, returned by fsrepo.Open for dataDir,
+// means that another process holds the repo lock.
+func repoLocked(dataDir string, err error) bool {
+	if locked, lerr := fsrepo.LockedByOtherProcess(dataDir); lerr == nil && locked {
+		return true
+	}
+	return strings.Contains(err.Error(), "someone else has the lock")
+}
+
+// applyRepoConfig sets the network and reprovider settings of scfg in the
+// IPFS config of the repo, before the node is built from it.
+func applyRepoConfig(repoCfg *config.Config, scfg StoreConfig) error {
 	// swap in bootstrap list from config, if any
-	bsList := viper.GetStringSlice("store.ipfs.bootstraplist")
+	bsList := scfg.BootstrapList
 	if bsList != nil && len(bsList) > 0 {
 		peers := make([]config.BootstrapPeer, len(bsList))
 		for i, p := range bsList {
 
 			remotePeer, err := config.ParseBootstrapPeer(p)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			peers[i] = remotePeer
@@ -64,34 +139,80 @@ func initIPFS(ctx context.Context) (*core.IpfsNode, error) {
 		repoCfg.SetBootstrapPeers(peers)
 	}
 
-	swarmHosts := viper.GetStringSlice("store.ipfs.swarmhosts")
-	swarmPort := viper.GetInt("store.ipfs.swarmport")
+	swarmHosts := scfg.SwarmHosts
+	swarmPort := scfg.SwarmPort
 	addrs := make([]string, len(swarmHosts))
 	for i, h := range swarmHosts {
 		addrs[i] = fmt.Sprintf("%s/%d", h, swarmPort)
 	}
 	repoCfg.Addresses.Swarm = addrs
-	repoCfg.Swarm.DisableNatPortMap = viper.GetBool("store.ipfs.disablenat")
+	repoCfg.Swarm.DisableNatPortMap = scfg.DisableNAT
 
-	repo.SetConfig(repoCfg)
+	if scfg.ReprovideStrategy != "" {
+		err := checkReprovideStrategy(scfg.ReprovideStrategy)
+		if err != nil {
+			return err
+		}
+		repoCfg.Reprovider.Strategy = scfg.ReprovideStrategy
+	}
+	return nil
+}
 
-	cfg := core.BuildCfg{
-		Online:    true,
-		Permanent: true,
-		Repo:      repo}
+// reprovideStrategies are the values of store.ipfs.reprovidestrategy, the
+// IPFS reprovider strategies deciding which CIDs the node announces to the
+// DHT. The repo setting is kept if it is not set.
+//
+// all, the IPFS default, announces every block in the repo. Every trie
+// node can be found by any peer, at the cost of one provider record per
+// node, which is heavy DHT traffic for a large tree.
+//
+// pinned announces the pinned blocks. With store.ipfs.pin set that is every
+// committed node, without the blocks of reverted blocks and other leftovers.
+//
+// roots announces only the roots of pins. With store.ipfs.pinrecursive set
+// that is the header of the last committed block: a peer finds the root in
+// the DHT and fetches the nodes beneath it from the same node. With only
+// store.ipfs.pin set every pin is direct, so roots announces as much as
+// pinned. Without pins nothing is announced.
+var reprovideStrategies = map[string]bool{
+	"all":    true,
+	"pinned": true,
+	"roots":  true}
 
-	ipfsNode, err := core.NewNode(ctx, &cfg)
-	if err != nil {
-		return nil, err
+func checkReprovideStrategy(strategy string) error {
+	if !reprovideStrategies[strategy] {
+		return fmt.Errorf("store.ipfs.reprovidestrategy must be all, pinned or roots, got %q", strategy)
 	}
-
-	return ipfsNode, nil
+	return nil
 }
 
-func initRepo(dataDir string) error {
+// datastoreProfiles maps store.ipfs.datastore values to the IPFS config
+// profiles that select them. flatfs, the default, stores each block in its
+// own file: it is simple to inspect and back up, but slow for many small
+// writes. badger is a log-structured store that is much faster for the
+// write-heavy commit workload, at the cost of more memory and periodic
+// compaction. The datastore of an existing repo cannot be changed.
+var datastoreProfiles = map[string]string{
+	"flatfs": "default-datastore",
+	"badger": "badgerds"}
+
+// initRepo creates an IPFS repo in dataDir using datastore, or the IPFS
+// default if datastore is empty.
+func initRepo(dataDir string, datastore string) error {
 	conf, err := config.Init(os.Stdout, 2048)
 	if err != nil {
-		return nil
+		return err
+	}
+
+	if datastore != "" {
+		name, ok := datastoreProfiles[datastore]
+		if !ok {
+			return fmt.Errorf("store.ipfs.datastore must be flatfs or badger, got %q", datastore)
+		}
+		err = config.Profiles[name].Transform(conf)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = fsrepo.Init(dataDir, conf)
@@ -101,3 +222,90 @@ func initRepo(dataDir string) error {
 
 	return nil
 }
+
+// checkDatastore returns an error if the repo in dataDir does not use
+// datastore. Opening a repo with a different datastore spec would not find
+// any existing blocks.
+func checkDatastore(dataDir string, datastore string) error {
+	if _, ok := datastoreProfiles[datastore]; !ok {
+		return fmt.Errorf("store.ipfs.datastore must be flatfs or badger, got %q", datastore)
+	}
+	conf, err := fsrepo.ConfigAt(dataDir)
+	if err != nil {
+		return err
+	}
+	existing := repoDatastore(conf.Datastore.Spec)
+	if existing != datastore {
+		return fmt.Errorf("store.ipfs.datastore is %s but the repo in %s uses %s; migrate the repo or use a new data directory", datastore, dataDir, existing)
+	}
+	return nil
+}
+
+// repoDatastore returns the store.ipfs.datastore value matching a datastore
+// spec.
+func repoDatastore(spec map[string]interface{}) string {
+	b, _ := json.Marshal(spec)
+	if strings.Contains(string(b), `"badgerds"`) {
+		return "badger"
+	}
+	return "flatfs"
+}
+
+const swarmKeyHeader = "/key/swarm/psk/1.0.0/"
+
+// writeSwarmKey writes the private network key, given either inline or as
+// a file path, to swarm.key in the repo. IPFS then only connects to peers
+// sharing the key. With no key, a swarm.key left from an earlier run is
+// removed, so that the node joins the public network as configured.
+func writeSwarmKey(dataDir string, key string) error {
+	keyFile := path.Join(dataDir, "swarm.key")
+	if key == "" {
+		err := os.Remove(keyFile)
+		if err == nil {
+			logger.Info("stale swarm.key removed", "dir", dataDir)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(key), swarmKeyHeader) {
+		b, err := ioutil.ReadFile(key)
+		if err != nil {
+			return fmt.Errorf("store.ipfs.swarmkey: %v", err)
+		}
+		key = string(b)
+	}
+	err := validateSwarmKey(key)
+	if err != nil {
+		return fmt.Errorf("store.ipfs.swarmkey: %v", err)
+	}
+	return ioutil.WriteFile(keyFile, []byte(key), os.FileMode(0600))
+}
+
+// validateSwarmKey checks that key is a 32 byte pre-shared key in the
+// swarm.key format.
+func validateSwarmKey(key string) error {
+	lines := strings.Split(strings.TrimSpace(key), "\n")
+	if len(lines) != 3 || strings.TrimSpace(lines[0]) != swarmKeyHeader {
+		return errors.New("malformed swarm key")
+	}
+
+	var psk []byte
+	var err error
+	encoded := strings.TrimSpace(lines[2])
+	switch strings.TrimSpace(lines[1]) {
+	case "/base16/":
+		psk, err = hex.DecodeString(encoded)
+	case "/base64/":
+		psk, err = base64.StdEncoding.DecodeString(encoded)
+	default:
+		return fmt.Errorf("unsupported swarm key encoding %s", lines[1])
+	}
+	if err != nil {
+		return fmt.Errorf("malformed swarm key: %v", err)
+	}
+	if len(psk) != 32 {
+		return fmt.Errorf("swarm key must be 32 bytes, got %d", len(psk))
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	config "gx/ipfs/QmSoYrBMibm2T3LupaLuez7LPGnyrJwdRxvTfPUyCp691u/go-ipfs-config"
+
+	"github.com/ipfs/go-ipfs/core"
+	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
+	"github.com/spf13/viper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPFS", func() {
+
+	DescribeTable("validates swarm keys",
+		func(key string, valid bool) {
+			err := validateSwarmKey(key)
+			if valid {
+				failIfErr(err)
+			} else {
+				Expect(err).To(HaveOccurred())
+			}
+		},
+		Entry("base16", swarmKeyHeader+"\n/base16/\n"+strings.Repeat("ab", 32)+"\n", true),
+		Entry("base64", swarmKeyHeader+"\n/base64/\n"+strings.Repeat("A", 43)+"=", true),
+		Entry("short key", swarmKeyHeader+"\n/base16/\n"+strings.Repeat("ab", 16), false),
+		Entry("bad hex", swarmKeyHeader+"\n/base16/\n"+strings.Repeat("zz", 32), false),
+		Entry("unknown encoding", swarmKeyHeader+"\n/base58/\n"+strings.Repeat("ab", 32), false),
+		Entry("missing header", "/base16/\n"+strings.Repeat("ab", 32), false),
+	)
+
+	DescribeTable("recognizes the datastore of a repo",
+		func(spec map[string]interface{}, datastore string) {
+			Expect(repoDatastore(spec)).To(Equal(datastore))
+		},
+		Entry("flatfs", map[string]interface{}{
+			"type": "mount",
+			"mounts": []interface{}{
+				map[string]interface{}{"mountpoint": "/blocks", "type": "measure",
+					"child": map[string]interface{}{"type": "flatfs", "path": "blocks"}}}}, "flatfs"),
+		Entry("badger", map[string]interface{}{
+			"type":  "measure",
+			"child": map[string]interface{}{"type": "badgerds", "path": "badgerds"}}, "badger"),
+	)
+
+	Describe("repo config", func() {
+		var repoCfg *config.Config
+
+		BeforeEach(func() {
+			repoCfg = &config.Config{}
+			repoCfg.Reprovider.Strategy = "all"
+		})
+
+		It("applies the reprovide strategy and swarm settings", func() {
+			err := applyRepoConfig(repoCfg, StoreConfig{
+				SwarmHosts:        []string{"/ip4/127.0.0.1/tcp"},
+				SwarmPort:         4101,
+				DisableNAT:        true,
+				ReprovideStrategy: "roots"})
+			failIfErr(err)
+			Expect(repoCfg.Reprovider.Strategy).To(Equal("roots"))
+			Expect(repoCfg.Addresses.Swarm).To(Equal([]string{"/ip4/127.0.0.1/tcp/4101"}))
+			Expect(repoCfg.Swarm.DisableNatPortMap).To(BeTrue())
+		})
+
+		It("keeps the repo strategy when none is set", func() {
+			failIfErr(applyRepoConfig(repoCfg, StoreConfig{}))
+			Expect(repoCfg.Reprovider.Strategy).To(Equal("all"))
+		})
+
+		It("rejects an unknown strategy", func() {
+			err := applyRepoConfig(repoCfg, StoreConfig{ReprovideStrategy: "everything"})
+			Expect(err).To(MatchError(ContainSubstring("store.ipfs.reprovidestrategy")))
+			Expect(repoCfg.Reprovider.Strategy).To(Equal("all"))
+
+			cfg := configFromViper()
+			cfg.InMemory = true
+			cfg.ReprovideStrategy = "everything"
+			_, err = InitStoreWithConfig(context.Background(), cfg)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("repo lock", func() {
+		var dir string
+		var release io.Closer
+		var holder *exec.Cmd
+
+		// holdRepoLock runs TestHoldRepoLock in a subprocess, which holds
+		// the lock of the repo in dir until release is closed.
+		holdRepoLock := func() {
+			holder = exec.Command(os.Args[0], "-test.run=^TestHoldRepoLock$")
+			holder.Env = append(os.Environ(), "STOREIPFS_LOCK_REPO="+dir)
+			stdin, err := holder.StdinPipe()
+			failIfErr(err)
+			stdout, err := holder.StdoutPipe()
+			failIfErr(err)
+			failIfErr(holder.Start())
+			release = stdin
+			line, err := bufio.NewReader(stdout).ReadString('\n')
+			failIfErr(err)
+			Expect(line).To(Equal("locked\n"))
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "repolock")
+			failIfErr(err)
+			failIfErr(initRepo(dir, ""))
+			holdRepoLock()
+		})
+
+		AfterEach(func() {
+			release.Close()
+			holder.Wait()
+			os.RemoveAll(dir)
+		})
+
+		It("returns ErrRepoLocked while another process holds the repo", func() {
+			start := time.Now()
+			_, err := openRepo(context.Background(), dir, 500*time.Millisecond)
+			Expect(errors.Is(err, ErrRepoLocked)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring(dir))
+			Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+		})
+
+		It("opens the repo once the lock is released", func() {
+			time.AfterFunc(500*time.Millisecond, func() {
+				release.Close()
+			})
+			r, err := openRepo(context.Background(), dir, 10*time.Second)
+			failIfErr(err)
+			failIfErr(r.Close())
+		})
+	})
+
+	Describe("swarm key", func() {
+		var dir string
+		key := swarmKeyHeader + "\n/base16/\n" + strings.Repeat("ab", 32) + "\n"
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "swarmkey")
+			failIfErr(err)
+			failIfErr(initRepo(dir, ""))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		// openNode builds an online node on the repo in dir, listening on
+		// the loopback interface only.
+		openNode := func() *core.IpfsNode {
+			r, err := openRepo(context.Background(), dir, 0)
+			failIfErr(err)
+			repoCfg, err := r.Config()
+			failIfErr(err)
+			repoCfg.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/0"}
+			repoCfg.Bootstrap = nil
+			failIfErr(r.SetConfig(repoCfg))
+			node, err := core.NewNode(context.Background(), &core.BuildCfg{Online: true, Repo: r})
+			failIfErr(err)
+			return node
+		}
+
+		It("puts the node on a private network and leaves it when unset", func() {
+			failIfErr(writeSwarmKey(dir, key))
+			node := openNode()
+			Expect(node.PNetFingerprint).NotTo(BeEmpty())
+			failIfErr(node.Close())
+
+			failIfErr(writeSwarmKey(dir, ""))
+			Expect(path.Join(dir, "swarm.key")).NotTo(BeAnExistingFile())
+			node = openNode()
+			Expect(node.PNetFingerprint).To(BeEmpty())
+			failIfErr(node.Close())
+		})
+
+		It("reads the key from a file", func() {
+			file := path.Join(dir, "psk")
+			failIfErr(ioutil.WriteFile(file, []byte(key), 0600))
+			failIfErr(writeSwarmKey(dir, file))
+			written, err := ioutil.ReadFile(path.Join(dir, "swarm.key"))
+			failIfErr(err)
+			Expect(string(written)).To(Equal(key))
+		})
+	})
+
+	It("rejects switching the datastore of an existing repo", func() {
+		failIfErr(checkDatastore(getDataDir(), "flatfs"))
+		Expect(checkDatastore(getDataDir(), "badger")).To(MatchError(ContainSubstring("uses flatfs")))
+		Expect(checkDatastore(getDataDir(), "leveldb")).To(HaveOccurred())
+	})
+})
+
+// TestHoldRepoLock is a helper for the repo lock specs rather than a test.
+// Run with STOREIPFS_LOCK_REPO set, it opens that repo and holds its lock
+// until stdin is closed.
+func TestHoldRepoLock(t *testing.T) {
+	dir := os.Getenv("STOREIPFS_LOCK_REPO")
+	if dir == "" {
+		return
+	}
+	r, err := fsrepo.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	fmt.Println("locked")
+	ioutil.ReadAll(os.Stdin)
+}
+
+// BenchmarkCommitDatastore commits blocks of 200 keys to a new repo using
+// each datastore.
+func BenchmarkCommitDatastore(b *testing.B) {
+	ctx := context.Background()
+	for _, datastore := range []string{"flatfs", "badger"} {
+		b.Run(datastore, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "datastore")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if Store != nil {
+				Store.Close()
+			}
+			initViper()
+			viper.Set("store.inmemory", false)
+			viper.Set("store.datadir", dir)
+			viper.Set("store.ipfs.datastore", datastore)
+			defer func() {
+				viper.Set("store.datadir", getDataDir())
+				viper.Set("store.ipfs.datastore", "")
+			}()
+			err = InitStore(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer Store.Close()
+
+			v := make([]byte, 32)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				storeb := openStore(ctx)
+				for k := 0; k < 200; k++ {
+					rand.Read(v)
+					storeb.tree.putValue(ctx, hex.EncodeToString(v), v)
+				}
+				err = storeb.batch.commit(ctx, Store.api, storeb.tree.root)
+				if err != nil {
+					b.Fatal(err)
+				}
+				Store.merkleTree.CommitBatch(ctx, storeb.tree)
+				Store.closeBlock(storeb)
+			}
+		})
+	}
+}
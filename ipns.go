@@ -0,0 +1,69 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import "context"
+
+const defaultIPNSKey = "self"
+
+// PublishRoot publishes the current root to IPNS under the key set by
+// store.ipfs.ipnskey and returns the IPNS name. Publishing can take a long
+// time on a live network.
+func (s *store) PublishRoot(ctx context.Context) (string, error) {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	s.Lock()
+	root := s.root
+	s.Unlock()
+
+	name, err := s.api.publish(ctx, root.path, s.ipnsKey)
+	if err != nil {
+		return "", err
+	}
+	logDebug("root published", "name", name, "root", root.cnode.String())
+	return name, nil
+}
+
+// ResolveRoot returns the root CID that the IPNS name points at.
+func (s *store) ResolveRoot(ctx context.Context, name string) (string, error) {
+	p, err := s.api.resolveName(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	c, err := s.api.resolve(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// publishAfterCommit publishes the root in the background when
+// store.ipfs.ipnsautopublish is set. Publishes are serialized, and each
+// publishes the root current when it starts, so the latest root is
+// published last. Failures are logged.
+func (s *store) publishAfterCommit() {
+	if !s.autoPublish {
+		return
+	}
+	go func() {
+		_, err := s.PublishRoot(context.Background())
+		if err != nil {
+			logger.Error("root publish failed", "err", err)
+		}
+	}()
+}
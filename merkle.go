@@ -20,38 +20,71 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
 	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
-	mh "gx/ipfs/QmPnFwZ2JXKnXgMw8CdBPxn7FWh6LLdjUjxV1fKHuJnkr8/go-multihash"
-	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
 
 	spec "github.com/blocktop/go-spec"
-	"github.com/ipfs/go-ipfs/core"
-	coreapi "github.com/ipfs/go-ipfs/core/coreapi"
 	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
 )
 
+// The merkle tree is a trie with one node per key character. A node links
+// to its children by single-character link names, and holds its value in
+// "val" and any named links (such as "acct" or a transaction hash) under
+// names of any other length. Keys are therefore resolvable as IPFS paths,
+// e.g. /ipld/<root>/a/b/c/val.
+//
+// A key may hold a value and also be a prefix of other keys, e.g. "ab"
+// and "abc": the value of "ab" and the child link "c" live side by side.
+// What would break traversal is a named link that shadows a child link or
+// the value, so put rejects link names that are a single character or
+// reserved (see val).
+
+// merkleTreeStruct holds the committed merkle tree. Changes are made in
+// batches, one per open store block, each starting from a snapshot of the
+// committed root. Committing a batch makes its root the committed root.
 type merkleTreeStruct struct {
-	locked bool
-	api    coreiface.CoreAPI
-	root   *node
-	batch  *merkleTreeBatch
+	sync.Mutex
+	api   backend
+	root  *node
+	bloom *bloomFilter // keys of the committed tree, if store.bloomkeys is set
+	size  treeSize     // counted keys of the committed tree, see TreeSize
 }
 
+// merkleTreeBatch is a set of changes to a merkle tree. Reads see the
+// batch's own writes: every node built or changed by the batch stays
+// attached to its parent by targetNode until the batch is committed, so a
+// read reaches it in memory, and IPFS is only asked for nodes that were
+// loaded from it or written to it. Links by CID alone are made only to
+// such nodes, see snapshotLink and spillChild.
 type merkleTreeBatch struct {
 	sync.Mutex
-	api  coreiface.CoreAPI
-	root *node
-}
+	api    backend
+	root   *node
+	closed bool
+	cow    bool // putMany copies nodes instead of changing them in place
+
+	// spill, if set, writes finished subtrees of putMany once held
+	// changed nodes reach store.spillnodes, see spillChild.
+	spill func(ctx context.Context, nodes []*node) error
+	held  int // changed nodes computed by putMany and not spilled
 
-const val = "val"
+	// keys put by the batch, added to the tree's filter on commit, if
+	// track is set
+	track bool
+	keys  []string
 
-func initMerkle(ctx context.Context, ipfs *core.IpfsNode, merkleRoot string) (*merkleTreeStruct, error) {
-	merkleTree := &merkleTreeStruct{}
+	base   cid.Cid // root the batch started on
+	forked bool    // the batch is on a root other than the committed one
+	added  int     // keys added less keys deleted, see TreeSize
+	depth  int     // length of the longest key put
+}
 
-	merkleTree.api = coreapi.NewCoreAPI(ipfs)
+func initMerkle(ctx context.Context, api backend, merkleRoot string) (*merkleTreeStruct, error) {
+	merkleTree := &merkleTreeStruct{api: api}
 
 	err := merkleTree.initRoot(ctx, merkleRoot)
 	if err != nil {
@@ -61,11 +94,16 @@ func initMerkle(ctx context.Context, ipfs *core.IpfsNode, merkleRoot string) (*m
 	return merkleTree, nil
 }
 
+// emptyTreeRoot returns the root node of a tree with no keys.
+func emptyTreeRoot() (*node, error) {
+	return makeNodeFromObj([]byte("tree"), nil)
+}
+
 func (m *merkleTreeStruct) initRoot(ctx context.Context, merkleRoot string) error {
 	var n *node
 	var err error
 	if merkleRoot == "" {
-		n, err = makeNodeFromObj([]byte("tree"), nil)
+		n, err = emptyTreeRoot()
 		if err != nil {
 			return err
 		}
@@ -86,59 +124,159 @@ func (m *merkleTreeStruct) initRoot(ctx context.Context, merkleRoot string) erro
 	return nil
 }
 
-func (m *merkleTreeStruct) StartBatch() (*node, error) {
-	if m.locked {
-		return nil, errors.New("the merkle tree is already in batch")
-	}
-
-	m.locked = true
+func (m *merkleTreeStruct) rootNode() *node {
+	m.Lock()
+	defer m.Unlock()
+	return m.root
+}
 
-	cnode, err := cbor.Decode(m.root.cnode.RawData(), mh.SHA2_256, -1)
+// StartBatch returns a new batch starting from root, or from the committed
+// root if root is nil. Any number of batches may be open at once, but of
+// those started on the same committed root only the first committed wins:
+// committing another returns ErrCommitConflict, see stale.
+func (m *merkleTreeStruct) StartBatch(root *node) (*merkleTreeBatch, error) {
+	committedRoot := m.rootNode()
+	onCommitted := root == nil || root.cnode.Cid().Equals(committedRoot.cnode.Cid())
+	if root == nil {
+		root = committedRoot
+	}
+	committed := root.cnode
+	cnode, err := decodeNode(committed.RawData(), committed.Cid())
 	if err != nil {
 		return nil, err
 	}
-	batchRoot, err := makeNodeFromCBOR(cnode)
+	batchRoot, err := makeNodeFromIPLD(cnode)
 	if err != nil {
 		return nil, err
 	}
 
-	m.batch = &merkleTreeBatch{
-		api:  m.api,
-		root: batchRoot}
+	b := &merkleTreeBatch{
+		api:    m.api,
+		root:   batchRoot,
+		base:   committed.Cid(),
+		forked: !onCommitted,
+		track:  m.filter() != nil}
 
-	return batchRoot, nil
+	return b, nil
 }
 
-func (m *merkleTreeStruct) CommitBatch() error {
-	if !m.locked {
-		return errors.New("the merkle tree is not in batch")
+// stale reports whether b was started on the committed root and another
+// commit has replaced that root since. Committing b would drop the changes
+// of that commit. A batch started on another root, by OpenBlockOn, is never
+// stale: committing it deliberately switches to its branch.
+func (m *merkleTreeStruct) stale(b *merkleTreeBatch) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.staleLocked(b)
+}
+
+func (m *merkleTreeStruct) staleLocked(b *merkleTreeBatch) bool {
+	return !b.forked && !m.root.cnode.Cid().Equals(b.base)
+}
+
+// CommitBatch makes the root of b the committed root and closes b. It
+// returns ErrCommitConflict, leaving b open, if b is stale.
+//
+// With store.bloomkeys set, the filter must hold every key of the new root.
+// If b started on the committed root, the filter has the keys of that root
+// and learns b's keys. Otherwise, as for a batch from OpenBlockOn or one
+// whose base was replaced by Restore or CompareAndSetRoot, the filter is
+// rebuilt by walking every node of b's tree, fetching from IPFS those not
+// in memory, which costs about as much as loading the filter at startup.
+func (m *merkleTreeStruct) CommitBatch(ctx context.Context, b *merkleTreeBatch) error {
+	_, err := m.commitBatch(ctx, b)
+	return err
+}
+
+// commitBatch is CommitBatch, also returning a function that undoes the
+// commit, for a block whose later commit steps fail. The undo restores the
+// root, filter and key count that b replaced and reopens b, unless another
+// commit has replaced b's root since.
+func (m *merkleTreeStruct) commitBatch(ctx context.Context, b *merkleTreeBatch) (func(), error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return nil, ErrNotInBatch
 	}
 
-	m.root = m.batch.root
-	m.batch = nil
-	m.locked = false
-	return nil
+	for {
+		if m.stale(b) {
+			return nil, fmt.Errorf("%w: the batch started on %s", ErrCommitConflict, b.base)
+		}
+
+		// The filter learns the new keys before the root that holds them
+		// is committed, so that no reader misses them, and the rebuilt
+		// filter replaces the old one together with the root.
+		f := m.filter()
+		onBase := m.rootNode().cnode.Cid().Equals(b.base)
+		if f != nil && b.track && !onBase {
+			var err error
+			f, err = buildFilter(ctx, m.api, b.root, f.capacity)
+			if err != nil {
+				return nil, err
+			}
+		} else if f != nil && b.track {
+			for _, key := range b.keys {
+				f.add(key)
+			}
+		}
+
+		m.Lock()
+		if m.staleLocked(b) {
+			m.Unlock()
+			return nil, fmt.Errorf("%w: the batch started on %s", ErrCommitConflict, b.base)
+		}
+		if f != nil && b.track && onBase && (m.bloom != f || !m.root.cnode.Cid().Equals(b.base)) {
+			// the root and its filter were replaced while the keys were
+			// added to the old filter
+			m.Unlock()
+			continue
+		}
+		prevRoot, prevBloom, prevSize := m.root, m.bloom, m.size
+		m.root = b.root
+		if f != nil {
+			m.bloom = f
+		}
+		m.size.commit(b)
+		m.Unlock()
+
+		b.closed = true
+		undo := func() {
+			b.Lock()
+			defer b.Unlock()
+			m.Lock()
+			defer m.Unlock()
+			if m.root != b.root {
+				return
+			}
+			m.root, m.bloom, m.size = prevRoot, prevBloom, prevSize
+			b.closed = false
+		}
+		return undo, nil
+	}
 }
 
-func (m *merkleTreeStruct) RevertBatch() error {
-	if !m.locked {
-		return errors.New("the merkle tree is not in batch")
+// RevertBatch closes b, discarding its changes.
+func (m *merkleTreeStruct) RevertBatch(b *merkleTreeBatch) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrNotInBatch
 	}
 
-	m.batch = nil
-	m.locked = false
+	b.closed = true
 	return nil
 }
 
 func (m *merkleTreeStruct) getRoot() string {
-	if m.locked {
-		return m.batch.root.path.Cid().String()
-	}
-	return m.root.path.Cid().String()
+	return m.rootNode().path.Cid().String()
 }
 
-func (m *merkleTreeStruct) getValue(ctx context.Context, key string, inBatch bool) ([]byte, error) {
-	n, err := m.getNode(ctx, key, "", inBatch)
+func (m *merkleTreeStruct) getValue(ctx context.Context, key string) ([]byte, error) {
+	if !m.mayHold(key) {
+		return nil, checkKeyLength(key)
+	}
+	n, err := m.getNode(ctx, key, "")
 	if err != nil {
 		return nil, err
 	}
@@ -148,8 +286,24 @@ func (m *merkleTreeStruct) getValue(ctx context.Context, key string, inBatch boo
 	return n.data, nil
 }
 
-func (m *merkleTreeStruct) getLinks(ctx context.Context, key string, inBatch bool) (map[string]*link, error) {
-	n, err := m.getNode(ctx, key, "", inBatch)
+// getValueAt is getValue, returning nil for a value expired at
+// blockNumber.
+func (m *merkleTreeStruct) getValueAt(ctx context.Context, key string, blockNumber uint64) ([]byte, error) {
+	if !m.mayHold(key) {
+		return nil, checkKeyLength(key)
+	}
+	n, err := m.getNode(ctx, key, "")
+	if err != nil {
+		return nil, err
+	}
+	if n == nil || expired(n, blockNumber) {
+		return nil, nil
+	}
+	return n.data, nil
+}
+
+func (m *merkleTreeStruct) getLinks(ctx context.Context, key string) (map[string]*link, error) {
+	n, err := m.getNode(ctx, key, "")
 	if err != nil {
 		return nil, err
 	}
@@ -159,34 +313,108 @@ func (m *merkleTreeStruct) getLinks(ctx context.Context, key string, inBatch boo
 	return n.links, nil
 }
 
-func (m *merkleTreeStruct) getLink(ctx context.Context, key string, linkName string, inBatch bool) (*node, error) {
-	return m.getNode(ctx, key, linkName, inBatch)
+func (m *merkleTreeStruct) getLink(ctx context.Context, key string, linkName string) (*node, error) {
+	return m.getNode(ctx, key, linkName)
 }
 
-func (m *merkleTreeStruct) getNode(ctx context.Context, key string, linkName string, inBatch bool) (*node, error) {
-	if inBatch {
-		return m.getNodeFromBatch(ctx, key, linkName)
+func (m *merkleTreeStruct) getNode(ctx context.Context, key string, linkName string) (*node, error) {
+	err := checkKeyLength(key)
+	if err != nil {
+		return nil, err
 	}
-
-	keyPath := m.root.path.String() + "/" + strings.Join(strings.Split(key, ""), "/")
+	keyPath := m.rootNode().path.String() + "/" + strings.Join(strings.Split(key, ""), "/")
 	if linkName != "" {
 		keyPath += "/" + linkName
 	}
-	n, err := getObj(ctx, m.api, keyPath)
-	if err == cbor.ErrNoSuchLink {
+	return getObjOptional(ctx, m.api, keyPath)
+}
+
+// has reports whether key holds a value or named links. A key that only
+// prefixes other keys is not held. Only the node at key is decoded.
+func (m *merkleTreeStruct) has(ctx context.Context, key string) (bool, error) {
+	if !m.mayHold(key) {
+		return false, checkKeyLength(key)
+	}
+	n, err := m.getNode(ctx, key, "")
+	if err != nil || n == nil {
+		return false, err
+	}
+	return isEntry(n), nil
+}
+
+// rangeKeys calls yield with every key below prefix that holds a value, in
+// lexical order. Nodes are fetched as the traversal reaches them and are not
+// retained afterward. Iteration stops at the first error returned by yield.
+func (m *merkleTreeStruct) rangeKeys(ctx context.Context, prefix string, yield func(key string) error) error {
+	n, err := m.getNode(ctx, prefix, "")
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return nil
+	}
+
+	return rangeNode(ctx, m.api, n, prefix, yield)
+}
+
+func (b *merkleTreeBatch) getRoot() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.root.path.Cid().String()
+}
+
+func (b *merkleTreeBatch) getValue(ctx context.Context, key string) ([]byte, error) {
+	n, err := b.getNode(ctx, key, "")
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
 		return nil, nil
-	} else if err != nil {
+	}
+	return n.data, nil
+}
+
+// getValueAt is getValue, returning nil for a value expired at
+// blockNumber.
+func (b *merkleTreeBatch) getValueAt(ctx context.Context, key string, blockNumber uint64) ([]byte, error) {
+	n, err := b.getNode(ctx, key, "")
+	if err != nil {
 		return nil, err
 	}
-	return n, nil
+	if n == nil || expired(n, blockNumber) {
+		return nil, nil
+	}
+	return n.data, nil
+}
+
+func (b *merkleTreeBatch) getLinks(ctx context.Context, key string) (map[string]*link, error) {
+	n, err := b.getNode(ctx, key, "")
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, nil
+	}
+	return n.links, nil
+}
+
+func (b *merkleTreeBatch) getLink(ctx context.Context, key string, linkName string) (*node, error) {
+	return b.getNode(ctx, key, linkName)
 }
 
-func (m *merkleTreeStruct) getNodeFromBatch(ctx context.Context, key string, linkName string) (*node, error) {
-	if !m.locked {
-		return nil, errors.New("the tree is not currently in batch")
+func (b *merkleTreeBatch) getNode(ctx context.Context, key string, linkName string) (*node, error) {
+	err := checkKeyLength(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return nil, ErrNotInBatch
 	}
-	root := m.batch.root
-	n, err := m.getKey(ctx, root, key)
+
+	n, err := getKey(ctx, b.api, b.root, key)
 	if err != nil {
 		return nil, err
 	}
@@ -207,45 +435,222 @@ func (m *merkleTreeStruct) getNodeFromBatch(ctx context.Context, key string, lin
 		return nil, nil
 	}
 	path := coreiface.IpldPath(lnk.targetCid).String()
-	return getObj(ctx, m.api, path)
+	return getObj(ctx, b.api, path)
 }
 
-func (m *merkleTreeStruct) getKey(ctx context.Context, n *node, key string) (*node, error) {
-	if len(key) == 0 {
-		return n, nil
+// has reports whether key holds a value or named links in the batch, as
+// merkleTreeStruct.has does.
+func (b *merkleTreeBatch) has(ctx context.Context, key string) (bool, error) {
+	err := checkKeyLength(key)
+	if err != nil {
+		return false, err
 	}
-	k := key[:1]
-	krest := key[1:]
-	if n.links == nil {
-		n.links = make(map[string]*link)
+
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return false, ErrNotInBatch
 	}
-	lnk := n.links[k]
-	if lnk == nil || lnk.targetNode == nil {
-		path := n.path.String() + "/" + k
-		nk, err := getObj(ctx, m.api, path)
+
+	n, err := getKey(ctx, b.api, b.root, key)
+	if err != nil || n == nil {
+		return false, err
+	}
+	return isEntry(n), nil
+}
+
+// rangeKeys is like merkleTreeStruct.rangeKeys but walks the batch, using
+// in-memory nodes where they exist.
+func (b *merkleTreeBatch) rangeKeys(ctx context.Context, prefix string, yield func(key string) error) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrNotInBatch
+	}
+
+	n, err := getKey(ctx, b.api, b.root, prefix)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return nil
+	}
+
+	return rangeNode(ctx, b.api, n, prefix, yield)
+}
+
+// getKey returns the node at key below n, or nil if there is none. Nodes
+// fetched along the way are not attached to their links, so n may be the
+// shared root of the committed tree: concurrent reads do not race and the
+// committed tree does not grow as keys are read.
+//
+// Below the nodes held in memory, getKey resolves up to
+// store.ipfs.prefetchdepth levels of the key with one IPFS path, so a key d
+// levels deep costs about d/prefetchdepth calls. IPFS still loads every node
+// on the path; what is saved is the round trip per level.
+func getKey(ctx context.Context, api backend, n *node, key string) (*node, error) {
+	for len(key) > 0 {
+		lnk := n.links[key[:1]]
+		if lnk == nil {
+			return nil, nil
+		}
+		levels := 1
+		if lnk.targetNode == nil && lnk.targetCid != cid.Undef && prefetchDepth > 1 {
+			levels = pathLevels(key, prefetchDepth)
+		}
+
+		var tn *node
+		var err error
+		if levels > 1 {
+			p := coreiface.IpldPath(lnk.targetCid).String()
+			for i := 1; i < levels; i++ {
+				p += "/" + key[i:i+1]
+			}
+			tn, err = getObjOptional(ctx, api, p)
+		} else {
+			tn, err = linkTarget(ctx, api, lnk)
+		}
 		if err != nil {
 			return nil, err
 		}
+		if tn == nil {
+			return nil, nil
+		}
+		n = tn
+		key = key[levels:]
+	}
+	return n, nil
+}
 
-		if lnk == nil {
-			lnk = &link{key: k}
-			n.links[k] = lnk
+// pathLevels returns how many levels of key, at most limit, can be
+// resolved with one IPFS path. A '/' or '.' would not survive as a path
+// segment of its own, so either ends the run.
+func pathLevels(key string, limit int) int {
+	if limit > len(key) {
+		limit = len(key)
+	}
+	for i := 1; i < limit; i++ {
+		if key[i] == '/' || key[i] == '.' {
+			return i
+		}
+	}
+	return limit
+}
+
+func rangeNode(ctx context.Context, api backend, n *node, key string, yield func(key string) error) error {
+	return walkNode(ctx, api, n, key, func(key string, n *node) error {
+		if n.data == nil || len(key) == 0 {
+			return nil
+		}
+		return yield(key)
+	})
+}
+
+// walk calls fn for every key in the committed tree that holds a value or
+// named links, in lexical order. A key holding only named links, such as an
+// account key, is passed nil data. Nodes are fetched as the traversal
+// reaches them and are not retained afterward. The walk stops at the first
+// error returned by fn.
+func (m *merkleTreeStruct) walk(ctx context.Context, fn func(key string, data []byte, links spec.Links) error) error {
+	return walkEntries(ctx, m.api, m.rootNode(), fn)
+}
+
+// walk is like merkleTreeStruct.walk but walks the batch, using in-memory
+// nodes where they exist.
+func (b *merkleTreeBatch) walk(ctx context.Context, fn func(key string, data []byte, links spec.Links) error) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrNotInBatch
+	}
+	return walkEntries(ctx, b.api, b.root, fn)
+}
+
+func walkEntries(ctx context.Context, api backend, root *node, fn func(key string, data []byte, links spec.Links) error) error {
+	return walkNode(ctx, api, root, "", func(key string, n *node) error {
+		if len(key) == 0 {
+			return nil
+		}
+		named := namedLinks(n)
+		if n.data == nil && len(named) == 0 {
+			return nil
+		}
+		return fn(key, n.data, makeSpecLinks(named))
+	})
+}
+
+// namedLinks returns the links of n other than its child links.
+func namedLinks(n *node) map[string]*link {
+	named := make(map[string]*link)
+	for name, lnk := range n.links {
+		if len(name) != 1 {
+			named[name] = lnk
+		}
+	}
+	return named
+}
+
+// walkNode calls visit for n and every node below it in depth-first,
+// lexical order, with the key each node is at.
+func walkNode(ctx context.Context, api backend, n *node, key string, visit func(key string, n *node) error) error {
+	err := visit(key, n)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(n.links))
+	for k := range n.links {
+		if len(k) == 1 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		tn, err := linkTarget(ctx, api, n.links[k])
+		if err != nil {
+			return err
+		}
+		if tn == nil {
+			continue
+		}
+		err = walkNode(ctx, api, tn, key+k, visit)
+		if err != nil {
+			return err
 		}
-		lnk.targetNode = nk
 	}
+	return nil
+}
 
-	return m.getKey(ctx, lnk.targetNode, krest)
+// linkTarget returns the target of lnk, fetching it from IPFS without
+// attaching it to the link if it is not already in memory.
+func linkTarget(ctx context.Context, api backend, lnk *link) (*node, error) {
+	if lnk.targetNode != nil {
+		return lnk.targetNode, nil
+	}
+	if lnk.targetCid == cid.Undef {
+		return nil, nil
+	}
+	return getObj(ctx, api, coreiface.IpldPath(lnk.targetCid).String())
 }
 
-func (m *merkleTreeStruct) putValue(ctx context.Context, key string, value []byte) error {
-	return m.put(ctx, key, value, false)
+func (b *merkleTreeBatch) putValue(ctx context.Context, key string, value []byte) error {
+	return b.put(ctx, key, value, false)
 }
-func (m *merkleTreeStruct) putLink(ctx context.Context, key string, ln *link) error {
-	return m.put(ctx, key, ln, true)
+
+// putValueWithExpiry puts value at key, to be treated as absent by
+// getValueAt from block number expiresAtBlock on. The expiry is advisory:
+// the value stays in the tree until it is put again or deleted. An
+// expiresAtBlock of 0 puts a value that does not expire.
+func (b *merkleTreeBatch) putValueWithExpiry(ctx context.Context, key string, value []byte, expiresAtBlock uint64) error {
+	return b.put(ctx, key, expiringValue{value, expiresAtBlock}, false)
+}
+func (b *merkleTreeBatch) putLink(ctx context.Context, key string, ln *link) error {
+	return b.put(ctx, key, ln, true)
 }
 
-func (m *merkleTreeStruct) putNode(ctx context.Context, key string, n *node) error {
-	err := m.put(ctx, key, n.data, false)
+func (b *merkleTreeBatch) putNode(ctx context.Context, key string, n *node) error {
+	err := b.put(ctx, key, n.data, false)
 	if err != nil {
 		return err
 	}
@@ -253,7 +658,7 @@ func (m *merkleTreeStruct) putNode(ctx context.Context, key string, n *node) err
 		return nil
 	}
 	for _, lnk := range n.links {
-		err = m.put(ctx, key, lnk, true)
+		err = b.put(ctx, key, lnk, true)
 		if err != nil {
 			return err
 		}
@@ -261,54 +666,60 @@ func (m *merkleTreeStruct) putNode(ctx context.Context, key string, n *node) err
 	return nil
 }
 
-func (m *merkleTreeStruct) put(ctx context.Context, key string, value interface{}, valueIsLink bool) error {
-	if !m.locked {
-		return errors.New("the tree is not currently in batch")
+func (b *merkleTreeBatch) put(ctx context.Context, key string, value interface{}, valueIsLink bool) error {
+	var root *node
+
+	err := checkKeyLength(key)
+	if err != nil {
+		return err
 	}
 
-	var err error
-	var root *node
+	if valueIsLink {
+		err = checkLinkName(value.(*link).key)
+		if err != nil {
+			return err
+		}
+	}
 
-	m.batch.Lock()
-	defer m.batch.Unlock()
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrNotInBatch
+	}
 
-	root = m.batch.root
-	root, err = m.batch.putKey(ctx, root, key, value, valueIsLink)
+	root = b.root
+	end := startSpan(ctx, "putKey")
+	root, err = b.putKey(ctx, root, key, value, valueIsLink)
+	end()
 	if err != nil {
-		return err
+		return keyError(key, err)
+	}
+	b.root = root
+	if b.track {
+		b.keys = append(b.keys, key)
+	}
+	if len(key) > b.depth {
+		b.depth = len(key)
 	}
-	m.batch.root = root
 
 	return nil
 }
 
+// keyError names key in an error from the node size limits.
+func keyError(key string, err error) error {
+	if errors.Is(err, ErrValueTooLarge) || errors.Is(err, ErrTooManyLinks) {
+		return fmt.Errorf("key %q: %w", key, err)
+	}
+	return err
+}
+
 func (b *merkleTreeBatch) putKey(ctx context.Context, n *node, key string, value interface{}, valueIsLink bool) (*node, error) {
 	var change bool
 
 	if len(key) == 0 {
-		if valueIsLink {
-			ln := value.(*link)
-			if n.links == nil {
-				n.links = make(map[string]*link)
-			}
-			if n.links[ln.key] == nil || n.links[ln.key].targetNode.cnode.String() != ln.targetNode.cnode.String() {
-				n.links[ln.key] = ln
-				n.changedLinks[ln.key] = true
-				change = true
-			}
-		} else {
-			v := value.([]byte)
-
-			n.changedData = bytes.Compare(v, n.data) != 0
-			// required becuase bytes.Compare treats nil and empty slice as equal
-			if (v == nil && n.data != nil) ||
-				(v != nil && n.data == nil) {
-				n.changedData = true
-				change = true
-			}
-			n.data = v
-		}
-		if change {
+		was := isEntry(n)
+		if setValue(n, value, valueIsLink) {
+			b.countEntry(was, n)
 			return recomputeNode(n)
 		}
 		return n, nil
@@ -327,15 +738,9 @@ func (b *merkleTreeBatch) putKey(ctx context.Context, n *node, key string, value
 	lnk := n.links[k]
 
 	// search IPFS for target
-	if lnk.targetNode == nil && n.fromIPFS {
-		path := n.path.String() + "/" + k
-		nk, err := getObj(ctx, b.api, path)
-		if err != nil && err != cbor.ErrNoSuchLink {
-			return nil, err
-		}
-		if err == nil {
-			lnk.targetNode = nk
-		}
+	err := loadLinkTarget(ctx, b.api, lnk)
+	if err != nil {
+		return nil, err
 	}
 
 	// If the target is still not found then make a new node,
@@ -347,6 +752,9 @@ func (b *merkleTreeBatch) putKey(ctx context.Context, n *node, key string, value
 		}
 		lnk.targetNode = nk
 		change = true
+		if isEntryValue(value, valueIsLink) {
+			b.added++
+		}
 	} else {
 		cidInitial := lnk.targetNode.cnode.String()
 		nk, err := b.putKey(ctx, lnk.targetNode, krest, value, valueIsLink)
@@ -364,6 +772,278 @@ func (b *merkleTreeBatch) putKey(ctx context.Context, n *node, key string, value
 	return n, nil
 }
 
+// checkKeyLength returns ErrKeyTooLong for a key longer than
+// store.maxkeylength. The trie has a node per key character and is walked
+// recursively, so the limit also bounds the depth of the recursion.
+func checkKeyLength(key string) error {
+	if len(key) > maxKeyLength {
+		return fmt.Errorf("%w: %d characters, store.maxkeylength is %d", ErrKeyTooLong, len(key), maxKeyLength)
+	}
+	return nil
+}
+
+// checkLinkName returns an error if a named link would shadow a child link
+// or the value of a trie node.
+func checkLinkName(name string) error {
+	if len(name) == 1 {
+		return fmt.Errorf("%w: %q would shadow a child link", ErrInvalidLinkName, name)
+	}
+	return checkReservedName(name)
+}
+
+// setValue sets the data or a named link of n and reports whether n
+// changed. The caller recomputes n.
+func setValue(n *node, value interface{}, valueIsLink bool) bool {
+	if valueIsLink {
+		ln := value.(*link)
+		if n.links == nil {
+			n.links = make(map[string]*link)
+		}
+		if n.links[ln.key] != nil && linkCid(n.links[ln.key]) == linkCid(ln) {
+			return false
+		}
+		n.links[ln.key] = ln
+		if ln.targetNode == nil {
+			// The target is identified only by CID and is not ours to
+			// write, but n itself must be written.
+			delete(n.changedLinks, ln.key)
+			n.changedData = true
+		} else {
+			n.changedLinks[ln.key] = true
+		}
+		return true
+	}
+
+	v, expires, _ := valueData(value)
+	// bytes.Equal treats nil and empty slice as equal
+	if bytes.Equal(v, n.data) && (v == nil) == (n.data == nil) && expires == n.expires {
+		return false
+	}
+	n.data = v
+	n.expires = expires
+	n.changedData = true
+	return true
+}
+
+// expiringValue is a value put with putValueWithExpiry.
+type expiringValue struct {
+	data    []byte
+	expires uint64
+}
+
+// valueData returns the data and expiry of a value that is not a link,
+// and whether value is of a value type.
+func valueData(value interface{}) ([]byte, uint64, bool) {
+	switch v := value.(type) {
+	case []byte:
+		return v, 0, true
+	case expiringValue:
+		return v.data, v.expires, true
+	}
+	return nil, 0, false
+}
+
+// expired reports whether the value of n is expired at blockNumber.
+func expired(n *node, blockNumber uint64) bool {
+	return n.expires > 0 && blockNumber >= n.expires
+}
+
+// kv is a single entry for putMany.
+type kv struct {
+	key         string
+	value       interface{}
+	valueIsLink bool
+}
+
+// putMany puts all entries in one pass. Entries sharing a key prefix share
+// the traversal, and each changed node is recomputed once. The resulting
+// root is the same as putting the entries one at a time, in order.
+func (b *merkleTreeBatch) putMany(ctx context.Context, entries []kv) error {
+	return b.putEntries(ctx, entries, false)
+}
+
+// putManyAtomic is putMany that leaves b unchanged if any entry fails. The
+// nodes along the changed paths are copied, and the copies replace the
+// root of b only once every entry is in.
+func (b *merkleTreeBatch) putManyAtomic(ctx context.Context, entries []kv) error {
+	return b.putEntries(ctx, entries, true)
+}
+
+func (b *merkleTreeBatch) putEntries(ctx context.Context, entries []kv, atomic bool) error {
+	for _, e := range entries {
+		err := checkKeyLength(e.key)
+		if err != nil {
+			return err
+		}
+		if e.valueIsLink {
+			err := checkLinkName(e.value.(*link).key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sorted := make([]kv, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].key < sorted[j].key
+	})
+
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrNotInBatch
+	}
+	if atomic && !b.cow {
+		b.cow = true
+		defer func() { b.cow = false }()
+	}
+
+	added := b.added
+	end := startSpan(ctx, "putMany")
+	root, _, err := b.putManyAt(ctx, b.root, sorted, 0)
+	end()
+	if err != nil {
+		if atomic {
+			b.added = added
+		}
+		return err
+	}
+	b.root = root
+	for _, e := range sorted {
+		if b.track {
+			b.keys = append(b.keys, e.key)
+		}
+		if len(e.key) > b.depth {
+			b.depth = len(e.key)
+		}
+	}
+	return nil
+}
+
+// putManyAt puts entries, sorted by key, that share the first depth
+// characters of their keys at n.
+func (b *merkleTreeBatch) putManyAt(ctx context.Context, n *node, entries []kv, depth int) (*node, bool, error) {
+	var change bool
+	if b.cow {
+		n = cloneNode(n)
+	}
+
+	was := isEntry(n)
+	i := 0
+	for ; i < len(entries) && len(entries[i].key) == depth; i++ {
+		if setValue(n, entries[i].value, entries[i].valueIsLink) {
+			change = true
+		}
+	}
+	if i > 0 {
+		b.countEntry(was, n)
+	}
+
+	if n.links == nil && i < len(entries) {
+		n.links = make(map[string]*link)
+	}
+	for i < len(entries) {
+		k := entries[i].key[depth : depth+1]
+		j := i + 1
+		for j < len(entries) && entries[j].key[depth:depth+1] == k {
+			j++
+		}
+
+		if n.links[k] == nil {
+			n.links[k] = &link{key: k}
+		}
+		lnk := n.links[k]
+		err := loadLinkTarget(ctx, b.api, lnk)
+		if err != nil {
+			return nil, false, err
+		}
+
+		childChange := false
+		if lnk.targetNode == nil {
+			nk, err := makeNodeFromObj(nil, nil)
+			if err != nil {
+				return nil, false, err
+			}
+			nk.changedData = true
+			lnk.targetNode = nk
+			childChange = true
+		}
+		nk, changed, err := b.putManyAt(ctx, lnk.targetNode, entries[i:j], depth+1)
+		if err != nil {
+			return nil, false, err
+		}
+		lnk.targetNode = nk
+		if changed || childChange {
+			n.changedLinks[k] = true
+			change = true
+			err = b.spillChild(ctx, n, k)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		i = j
+	}
+
+	if change {
+		n, err := recomputeNode(n)
+		if err != nil {
+			return nil, false, keyError(entries[0].key[:depth], err)
+		}
+		b.held++
+		return n, true, nil
+	}
+	return n, false, nil
+}
+
+// spillChild writes the changed nodes below the link k of n with b.spill
+// once putMany holds store.spillnodes changed nodes, and keeps only the
+// CID of the child. putMany visits keys in order, so the subtree is not
+// changed again by the same call. n is then written for its data, as for
+// a link put by CID, and the spilled nodes are not collected by commit.
+func (b *merkleTreeBatch) spillChild(ctx context.Context, n *node, k string) error {
+	if b.spill == nil || b.cow || b.held < spillNodes {
+		return nil
+	}
+	lnk := n.links[k]
+	nodes, err := collectChangedNodes(lnk.targetNode, make([]*node, 1), make(map[string]int))
+	if err != nil {
+		return err
+	}
+	err = b.spill(ctx, nodes[1:])
+	if err != nil {
+		return err
+	}
+
+	lnk.targetCid = lnk.targetNode.cnode.Cid()
+	lnk.targetNode = nil
+	delete(n.changedLinks, k)
+	n.changedData = true
+	b.held -= len(nodes) - 1
+	if b.held < 0 {
+		b.held = 0
+	}
+	return nil
+}
+
+// cloneNode returns a copy of n with its own links, so that the copy can
+// be changed without changing n. Link targets are shared.
+func cloneNode(n *node) *node {
+	c := *n
+	if n.links != nil {
+		c.links = make(map[string]*link, len(n.links))
+		for k, lnk := range n.links {
+			l := *lnk
+			c.links[k] = &l
+		}
+	}
+	c.changedLinks = make(map[string]bool, len(n.changedLinks))
+	for k, v := range n.changedLinks {
+		c.changedLinks[k] = v
+	}
+	return &c
+}
+
 func (b *merkleTreeBatch) makeChild(ctx context.Context, key string, value interface{}, valueIsLink bool) (*node, error) {
 	var err error
 	if len(key) == 0 {
@@ -374,15 +1054,19 @@ func (b *merkleTreeBatch) makeChild(ctx context.Context, key string, value inter
 			if err != nil {
 				return nil, err
 			}
-			n.changedLinks[ln.key] = true
+			if ln.targetNode == nil {
+				n.changedData = true
+			} else {
+				n.changedLinks[ln.key] = true
+			}
 			return n, nil
 		}
 
-		data, ok := value.([]byte)
+		data, expires, ok := valueData(value)
 		if !ok {
 			return nil, errors.New("value must be a []byte")
 		}
-		n, err := makeNodeFromObj(data, nil)
+		n, err := makeExpiringNode(data, nil, expires)
 		if err != nil {
 			return nil, err
 		}
@@ -407,6 +1091,223 @@ func (b *merkleTreeBatch) makeChild(ctx context.Context, key string, value inter
 	return n, nil
 }
 
+func (b *merkleTreeBatch) deleteKey(ctx context.Context, key string) error {
+	if len(key) == 0 {
+		return errors.New("key must not be empty")
+	}
+	err := checkKeyLength(key)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrNotInBatch
+	}
+
+	root, _, err := b.deleteAt(ctx, b.root, key)
+	if err != nil {
+		return err
+	}
+	b.root = root
+	b.added--
+
+	return nil
+}
+
+// deleteAt clears the value and named links at key below n and recomputes
+// each node on the way back up. The returned bool reports whether n is left
+// with neither data nor links, in which case the caller prunes it. Nothing is
+// modified if the key does not exist.
+func (b *merkleTreeBatch) deleteAt(ctx context.Context, n *node, key string) (*node, bool, error) {
+	if len(key) == 0 {
+		named := false
+		for k := range n.links {
+			if len(k) != 1 {
+				named = true
+				delete(n.links, k)
+				delete(n.changedLinks, k)
+			}
+		}
+		if n.data == nil && !named {
+			return nil, false, ErrKeyNotFound
+		}
+		n.data = nil
+		n.expires = 0
+		n.changedData = true
+
+		n, err := recomputeNode(n)
+		if err != nil {
+			return nil, false, err
+		}
+		return n, len(n.links) == 0, nil
+	}
+
+	k := key[:1]
+	krest := key[1:]
+
+	lnk := n.links[k]
+	if lnk == nil {
+		return nil, false, ErrKeyNotFound
+	}
+	err := loadLinkTarget(ctx, b.api, lnk)
+	if err != nil {
+		return nil, false, err
+	}
+	if lnk.targetNode == nil {
+		return nil, false, ErrKeyNotFound
+	}
+
+	nk, prune, err := b.deleteAt(ctx, lnk.targetNode, krest)
+	if err != nil {
+		return nil, false, err
+	}
+	if prune {
+		delete(n.links, k)
+		delete(n.changedLinks, k)
+		// No changed link leads collectChangedNodes to this node any more,
+		// so flag it directly to have it written.
+		n.changedData = true
+	} else {
+		lnk.targetNode = nk
+		n.changedLinks[k] = true
+	}
+
+	n, err = recomputeNode(n)
+	if err != nil {
+		return nil, false, err
+	}
+	return n, n.data == nil && len(n.links) == 0, nil
+}
+
+// copySubtree puts the node at srcKey, with everything below it, at dstKey
+// and recomputes the ancestors of dstKey. The copy shares the stored nodes
+// of the source, so later changes under srcKey do not show under dstKey.
+func (b *merkleTreeBatch) copySubtree(ctx context.Context, srcKey string, dstKey string) error {
+	if len(dstKey) == 0 {
+		return errors.New("key must not be empty")
+	}
+	for _, key := range []string{srcKey, dstKey} {
+		err := checkKeyLength(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrNotInBatch
+	}
+
+	src, err := getKey(ctx, b.api, b.root, srcKey)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, srcKey)
+	}
+
+	lnk := snapshotLink(dstKey[len(dstKey)-1:], src)
+	root, err := b.graftAt(ctx, b.root, dstKey, lnk)
+	if err != nil {
+		return keyError(dstKey, err)
+	}
+	b.root = root
+
+	if b.track {
+		if src.data != nil || len(namedLinks(src)) > 0 {
+			b.keys = append(b.keys, dstKey)
+		}
+		err = walkEntries(ctx, b.api, src, func(key string, _ []byte, _ spec.Links) error {
+			b.keys = append(b.keys, dstKey+key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotLink returns a link named key to n that is not affected by later
+// in-place changes to n. Nodes loaded from IPFS without changes since are
+// linked by CID and loaded again when needed; the rest, which may never
+// have been written, are cloned.
+func snapshotLink(key string, n *node) *link {
+	if n.fromIPFS && !n.changedData && len(n.changedLinks) == 0 {
+		return &link{key: key, targetCid: n.cnode.Cid()}
+	}
+	c := cloneNode(n)
+	for k, lnk := range c.links {
+		if lnk.targetNode != nil {
+			c.links[k] = snapshotLink(k, lnk.targetNode)
+		}
+	}
+	return &link{key: key, targetNode: c}
+}
+
+// graftAt replaces the child link for the last character of key below n
+// with lnk, making empty nodes along the way where needed, and recomputes
+// each node on the way back up.
+func (b *merkleTreeBatch) graftAt(ctx context.Context, n *node, key string, lnk *link) (*node, error) {
+	if n.links == nil {
+		n.links = make(map[string]*link)
+	}
+	k := key[:1]
+
+	if len(key) == 1 {
+		n.links[k] = lnk
+		if lnk.targetNode == nil {
+			delete(n.changedLinks, k)
+			n.changedData = true
+		} else {
+			n.changedLinks[k] = true
+		}
+		return recomputeNode(n)
+	}
+
+	if n.links[k] == nil {
+		n.links[k] = &link{key: k}
+	}
+	child := n.links[k]
+	err := loadLinkTarget(ctx, b.api, child)
+	if err != nil {
+		return nil, err
+	}
+	if child.targetNode == nil {
+		child.targetNode, err = makeNodeFromObj(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nk, err := b.graftAt(ctx, child.targetNode, key[1:], lnk)
+	if err != nil {
+		return nil, err
+	}
+	child.targetNode = nk
+	n.changedLinks[k] = true
+	return recomputeNode(n)
+}
+
+// loadLinkTarget fetches the target of lnk from IPFS if it has a CID
+// but has not been loaded into memory yet. A target that cannot be fetched
+// is an error rather than a missing key, since the link exists.
+func loadLinkTarget(ctx context.Context, api backend, lnk *link) error {
+	if lnk.targetNode != nil || lnk.targetCid == cid.Undef {
+		return nil
+	}
+	tn, err := getObj(ctx, api, coreiface.IpldPath(lnk.targetCid).String())
+	if err != nil {
+		return err
+	}
+	lnk.targetNode = tn
+	return nil
+}
+
 func makeBlockKey(block spec.Block) string {
 	return "blk" + block.Hash()
 }
@@ -21,13 +21,18 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	spec "github.com/blocktop/go-spec"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
 	"github.com/spf13/viper"
 
 	. "github.com/onsi/ginkgo"
@@ -35,8 +40,8 @@ import (
 )
 
 const (
-	nilStoreRoot  = "/ipld/zdpuAmUr33yuaUdvJKUQUAvsy8a8fGfeCoucuFuhUybEdbP6M"
-	nilMerkleRoot = "/ipld/zdpuAsSjSbrPSXPoW5nBw15MbQby59kULnfzBCDeArYgUZg7p"
+	nilStoreRoot  = "/ipld/" + NilStoreRoot
+	nilMerkleRoot = "/ipld/" + NilMerkleRoot
 )
 
 var _ = Describe("Merkle", func() {
@@ -59,11 +64,21 @@ var _ = Describe("Merkle", func() {
 		It("initializes", func() {
 			rb, err := ioutil.ReadFile(getRootFile())
 			failIfErr(err)
-			path := string(rb)
+			path, err := parseRootFile(rb)
+			failIfErr(err)
 			Expect(path).To(Equal(nilStoreRoot))
 			Expect(Store.root.path.String()).To(Equal(nilStoreRoot))
 
 			Expect(Store.merkleTree.root.path.String()).To(Equal(nilMerkleRoot))
+			Expect(Store.IsEmpty()).To(BeTrue())
+		})
+
+		It("computes the nil roots", func() {
+			root, merkle, err := nilRoots()
+			failIfErr(err)
+			Expect(root).To(Equal(NilStoreRoot))
+			Expect(merkle).To(Equal(NilMerkleRoot))
+			failIfErr(checkNilRoots())
 		})
 
 		It("initializes from existing root", func() {
@@ -75,19 +90,160 @@ var _ = Describe("Merkle", func() {
 			Expect(Store.merkleTree.root.path.String()).To(Equal(nilMerkleRoot))
 		})
 
+		It("puts and gets through the initialized merkle tree", func() {
+			Store.Close()
+			failIfErr(InitStore(ctx))
+			Expect(Store.root.links["merkle"].targetNode).To(Equal(Store.merkleTree.root))
+
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "initkey", []byte("initvalue")))
+
+			value, err := storeb.tree.getValue(ctx, "initkey")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("initvalue"))
+
+			commitMerkle(ctx, storeb)
+
+			value, err = Store.merkleTree.getValue(ctx, "initkey")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("initvalue"))
+		})
+
+	})
+
+	Describe("treeSize", func() {
+		It("counts the keys put and deleted by committed batches", func() {
+			mem := newMemBackend()
+			tree, err := initMerkle(ctx, mem, "")
+			failIfErr(err)
+			commit := func(b *merkleTreeBatch) {
+				failIfErr((&batch{}).commit(ctx, mem, b.root))
+				failIfErr(tree.CommitBatch(ctx, b))
+			}
+			expectSize := func(keys int, maxDepth int) {
+				for _, exact := range []bool{false, true} {
+					k, d, err := tree.treeSize(ctx, exact)
+					failIfErr(err)
+					Expect(k).To(Equal(keys))
+					Expect(d).To(Equal(maxDepth))
+				}
+			}
+
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			for _, key := range []string{"size", "sizes", "sized", "other"} {
+				failIfErr(mb.putValue(ctx, key, []byte(key)))
+			}
+			commit(mb)
+			expectSize(4, 5)
+
+			mb, err = tree.StartBatch(nil)
+			failIfErr(err)
+			failIfErr(mb.putValue(ctx, "size", []byte("again")))
+			failIfErr(mb.putMany(ctx, []kv{
+				{"siz", []byte("siz"), false},
+				{"sizeable", []byte("sizeable"), false},
+				{"other", []byte("again"), false}}))
+			failIfErr(mb.putLink(ctx, "linked", &link{key: "lnk", targetCid: mb.root.cnode.Cid()}))
+			failIfErr(mb.deleteKey(ctx, "sized"))
+			commit(mb)
+			expectSize(6, 8)
+		})
+	})
+
+	Describe("missing links", func() {
+		var mem *memBackend
+		var root string
+		BeforeEach(func() {
+			mem = newMemBackend()
+			tree, err := initMerkle(ctx, mem, "")
+			failIfErr(err)
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			failIfErr(mb.putValue(ctx, "ab", []byte("ab")))
+			failIfErr(mb.putValue(ctx, "cd", []byte("cd")))
+			failIfErr((&batch{}).commit(ctx, mem, mb.root))
+			failIfErr(tree.CommitBatch(ctx, mb))
+			root = tree.getRoot()
+		})
+
+		expectMissing := func(get func(key string, linkName string) (*node, error)) {
+			for _, kl := range [][2]string{{"ax", ""}, {"abc", ""}, {"z", ""}, {"ab", "nolink"}} {
+				n, err := get(kl[0], kl[1])
+				failIfErr(err)
+				Expect(n).To(BeNil())
+			}
+		}
+
+		It("are nil nodes in committed reads", func() {
+			tree, err := initMerkle(ctx, mem, root)
+			failIfErr(err)
+			expectMissing(func(key string, linkName string) (*node, error) {
+				return tree.getNode(ctx, key, linkName)
+			})
+			has, err := tree.has(ctx, "abc")
+			failIfErr(err)
+			Expect(has).To(BeFalse())
+		})
+
+		It("are nil nodes in batch reads", func() {
+			tree, err := initMerkle(ctx, mem, root)
+			failIfErr(err)
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			expectMissing(func(key string, linkName string) (*node, error) {
+				return mb.getNode(ctx, key, linkName)
+			})
+			has, err := mb.has(ctx, "abc")
+			failIfErr(err)
+			Expect(has).To(BeFalse())
+		})
+
+		It("are made by puts through them", func() {
+			tree, err := initMerkle(ctx, mem, root)
+			failIfErr(err)
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			failIfErr(mb.putValue(ctx, "abc", []byte("abc")))
+			failIfErr(mb.putValue(ctx, "ax", []byte("ax")))
+			Expect(mb.getValue(ctx, "abc")).To(Equal([]byte("abc")))
+			Expect(mb.getValue(ctx, "ab")).To(Equal([]byte("ab")))
+		})
+
+		It("differ from linked nodes that cannot be fetched", func() {
+			defer func(c *nodeCache) { cache = c }(cache)
+			cache = nil
+			tree, err := initMerkle(ctx, mem, root)
+			failIfErr(err)
+			lost := tree.rootNode().links["a"].targetCid
+			mem.Lock()
+			delete(mem.nodes, lost.KeyString())
+			mem.Unlock()
+
+			_, err = tree.getValue(ctx, "ab")
+			Expect(err).To(HaveOccurred())
+
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			_, err = mb.getValue(ctx, "ab")
+			Expect(err).To(HaveOccurred())
+			err = mb.putValue(ctx, "ax", []byte("ax"))
+			Expect(err).To(HaveOccurred())
+			Expect(mb.getValue(ctx, "cd")).To(Equal([]byte("cd")))
+		})
 	})
 
 	Describe("merkle", func() {
 		It("puts and gets", func() {
 			storeb := openStore(ctx)
 
-			err := Store.merkleTree.putValue(ctx, "testputkey", []byte("testputvalue"))
+			err := storeb.tree.putValue(ctx, "testputkey", []byte("testputvalue"))
 			failIfErr(err)
 
 			c, t := commitMerkle(ctx, storeb)
 			GinkgoWriter.Write([]byte(fmt.Sprintf("Commit took %f ms for %d nodes", t, c)))
 
-			value, err := Store.merkleTree.getValue(ctx, "testputkey", false)
+			value, err := Store.merkleTree.getValue(ctx, "testputkey")
 			failIfErr(err)
 
 			Expect(string(value)).To(Equal("testputvalue"))
@@ -96,33 +252,33 @@ var _ = Describe("Merkle", func() {
 		It("puts and gets overlapping keys", func() {
 			storeb := openStore(ctx)
 
-			err := Store.merkleTree.putValue(ctx, "testputkey", []byte("testputvalue"))
+			err := storeb.tree.putValue(ctx, "testputkey", []byte("testputvalue"))
 			failIfErr(err)
 
-			err = Store.merkleTree.putValue(ctx, "testput2key", []byte("testput2value"))
+			err = storeb.tree.putValue(ctx, "testput2key", []byte("testput2value"))
 			failIfErr(err)
 
-			err = Store.merkleTree.putValue(ctx, "testput22key", []byte("testput22value"))
+			err = storeb.tree.putValue(ctx, "testput22key", []byte("testput22value"))
 			failIfErr(err)
 
 			// get outside of batch returns nil
-			value, err := Store.merkleTree.getValue(ctx, "testput2key", false)
+			value, err := Store.merkleTree.getValue(ctx, "testput2key")
 			failIfErr(err)
 			Expect(value).To(BeNil())
 
-			value, err = Store.merkleTree.getValue(ctx, "testput22key", true)
+			value, err = storeb.tree.getValue(ctx, "testput22key")
 			failIfErr(err)
 			Expect(string(value)).To(Equal("testput22value"))
 
 			c, t := commitMerkle(ctx, storeb)
 			GinkgoWriter.Write([]byte(fmt.Sprintf("Commit took %f ms for %d nodes", t, c)))
 
-			value, err = Store.merkleTree.getValue(ctx, "testputkey", false)
+			value, err = Store.merkleTree.getValue(ctx, "testputkey")
 			failIfErr(err)
 			Expect(string(value)).To(Equal("testputvalue"))
 
-			// get within batch when no batch is happening reeturns error
-			value, err = Store.merkleTree.getValue(ctx, "testputkey", true)
+			// get within a batch that has been committed returns error
+			value, err = storeb.tree.getValue(ctx, "testputkey")
 			Expect(err).ToNot(BeNil())
 		})
 
@@ -135,16 +291,504 @@ var _ = Describe("Merkle", func() {
 
 			ln := &link{key: "fookey", targetNode: n}
 
-			failIfErr(Store.merkleTree.putLink(ctx, "testputlink", ln))
+			failIfErr(storeb.tree.putLink(ctx, "testputlink", ln))
 
 			c, t := commitMerkle(ctx, storeb)
 			GinkgoWriter.Write([]byte(fmt.Sprintf("Commit took %f ms for %d nodes", t, c)))
 
-			n2, err := Store.merkleTree.getLink(ctx, "testputlink", "fookey", false)
+			n2, err := Store.merkleTree.getLink(ctx, "testputlink", "fookey")
 			failIfErr(err)
 
 			Expect(string(n2.data)).To(Equal("foo"))
-			
+
+		})
+
+		It("deletes keys", func() {
+			storeb := openStore(ctx)
+
+			failIfErr(storeb.tree.putValue(ctx, "testdelkey", []byte("testdelvalue")))
+			failIfErr(storeb.tree.putValue(ctx, "testdelkey2", []byte("testdelvalue2")))
+			commitMerkle(ctx, storeb)
+
+			storeb = openStore(ctx)
+			failIfErr(storeb.tree.deleteKey(ctx, "testdelkey2"))
+
+			// deleting again is an error but leaves the tree unchanged
+			root := storeb.tree.getRoot()
+			err := storeb.tree.deleteKey(ctx, "testdelkey2")
+			Expect(err).To(Equal(ErrKeyNotFound))
+			Expect(storeb.tree.getRoot()).To(Equal(root))
+
+			commitMerkle(ctx, storeb)
+
+			value, err := Store.merkleTree.getValue(ctx, "testdelkey2")
+			failIfErr(err)
+			Expect(value).To(BeNil())
+
+			value, err = Store.merkleTree.getValue(ctx, "testdelkey")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("testdelvalue"))
+		})
+
+		It("copies a subtree that does not follow later changes", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "copysrc", []byte("src")))
+			failIfErr(storeb.tree.putValue(ctx, "copysrcchild", []byte("child")))
+			commitMerkle(ctx, storeb)
+
+			storeb = openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "copysrcpending", []byte("pending")))
+			failIfErr(storeb.tree.copySubtree(ctx, "copysrc", "copydst"))
+			failIfErr(storeb.tree.putValue(ctx, "copysrc", []byte("changed")))
+			failIfErr(storeb.tree.putValue(ctx, "copysrcpending", []byte("changed")))
+			failIfErr(storeb.tree.deleteKey(ctx, "copysrcchild"))
+
+			err := storeb.tree.copySubtree(ctx, "copymissing", "copydst2")
+			Expect(errors.Is(err, ErrKeyNotFound)).To(BeTrue())
+
+			commitMerkle(ctx, storeb)
+
+			for key, want := range map[string]string{
+				"copydst":        "src",
+				"copydstchild":   "child",
+				"copydstpending": "pending",
+				"copysrc":        "changed",
+				"copysrcpending": "changed"} {
+				value, err := Store.merkleTree.getValue(ctx, key)
+				failIfErr(err)
+				Expect(string(value)).To(Equal(want), key)
+			}
+			value, err := Store.merkleTree.getValue(ctx, "copysrcchild")
+			failIfErr(err)
+			Expect(value).To(BeNil())
+		})
+
+		It("treats values as absent from their expiry height", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValueWithExpiry(ctx, "expkey", []byte("token"), 10))
+			failIfErr(storeb.tree.putValue(ctx, "expkeynever", []byte("kept")))
+
+			value, err := storeb.tree.getValueAt(ctx, "expkey", 9)
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("token")))
+			commitMerkle(ctx, storeb)
+
+			for height, want := range map[uint64][]byte{9: []byte("token"), 10: nil, 11: nil} {
+				value, err := Store.merkleTree.getValueAt(ctx, "expkey", height)
+				failIfErr(err)
+				Expect(value).To(Equal(want), fmt.Sprint(height))
+			}
+			value, err = Store.merkleTree.getValueAt(ctx, "expkeynever", 1000)
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("kept")))
+			value, err = Store.merkleTree.getValue(ctx, "expkey")
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("token")))
+
+			proof, err := Store.merkleTree.getProof(ctx, "expkey")
+			failIfErr(err)
+			ok, err := VerifyProof(Store.merkleTree.getRoot(), "expkey", []byte("token"), proof)
+			failIfErr(err)
+			Expect(ok).To(BeTrue())
+
+			storeb = openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "expkey", []byte("token")))
+			commitMerkle(ctx, storeb)
+			value, err = Store.merkleTree.getValueAt(ctx, "expkey", 11)
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("token")))
+		})
+
+		It("checks key existence", func() {
+			storeb := openStore(ctx)
+
+			failIfErr(storeb.tree.putValue(ctx, "testhaskey", []byte("testhasvalue")))
+
+			ok, err := storeb.tree.has(ctx, "testhaskey")
+			failIfErr(err)
+			Expect(ok).To(BeTrue())
+
+			ok, err = storeb.tree.has(ctx, "testhasnokey")
+			failIfErr(err)
+			Expect(ok).To(BeFalse())
+
+			ok, err = storeb.tree.has(ctx, "testhas")
+			failIfErr(err)
+			Expect(ok).To(BeFalse())
+
+			commitMerkle(ctx, storeb)
+
+			ok, err = Store.merkleTree.has(ctx, "testhaskey")
+			failIfErr(err)
+			Expect(ok).To(BeTrue())
+
+			ok, err = Store.merkleTree.has(ctx, "testhasnokey")
+			failIfErr(err)
+			Expect(ok).To(BeFalse())
+
+			ok, err = Store.merkleTree.has(ctx, "testhas")
+			failIfErr(err)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("ranges over keys with a prefix", func() {
+			storeb := openStore(ctx)
+
+			failIfErr(storeb.tree.putValue(ctx, "rangeb", []byte("b")))
+			failIfErr(storeb.tree.putValue(ctx, "rangea", []byte("a")))
+			failIfErr(storeb.tree.putValue(ctx, "rangeab", []byte("ab")))
+			failIfErr(storeb.tree.putValue(ctx, "rangxx", []byte("x")))
+
+			expected := []string{"rangea", "rangeab", "rangeb"}
+			keys := make([]string, 0)
+			collect := func(key string) error {
+				keys = append(keys, key)
+				return nil
+			}
+
+			failIfErr(storeb.tree.rangeKeys(ctx, "range", collect))
+			Expect(keys).To(Equal(expected))
+
+			commitMerkle(ctx, storeb)
+
+			keys = keys[:0]
+			failIfErr(Store.merkleTree.rangeKeys(ctx, "range", collect))
+			Expect(keys).To(Equal(expected))
+		})
+
+		It("walks every key in the committed tree", func() {
+			storeb := openStore(ctx)
+			target := Store.merkleTree.rootNode()
+
+			failIfErr(storeb.tree.putValue(ctx, "walkb", []byte("b")))
+			failIfErr(storeb.tree.putValue(ctx, "walka", []byte("a")))
+			failIfErr(storeb.tree.putValue(ctx, "walkab", []byte("ab")))
+			failIfErr(storeb.tree.putLink(ctx, "walkc", &link{key: "acct", targetNode: target}))
+			commitMerkle(ctx, storeb)
+
+			values := make(map[string][]byte)
+			links := make(map[string]spec.Links)
+			failIfErr(Store.merkleTree.walk(ctx, func(key string, data []byte, l spec.Links) error {
+				if strings.HasPrefix(key, "walk") {
+					values[key] = data
+					links[key] = l
+				}
+				return nil
+			}))
+			Expect(values).To(Equal(map[string][]byte{
+				"walka":  []byte("a"),
+				"walkab": []byte("ab"),
+				"walkb":  []byte("b"),
+				"walkc":  nil}))
+			Expect(links["walkc"]).To(Equal(spec.Links{"acct": target.cnode.String()}))
+			Expect(links["walka"]).To(BeEmpty())
+
+			stop := errors.New("stop")
+			calls := 0
+			err := Store.merkleTree.walk(ctx, func(string, []byte, spec.Links) error {
+				calls++
+				return stop
+			})
+			Expect(err).To(Equal(stop))
+			Expect(calls).To(Equal(1))
+		})
+
+		It("keeps concurrently open blocks independent", func() {
+			storeb := openStore(ctx)
+			sb2, err := Store.OpenBlock(2)
+			failIfErr(err)
+			storeb2 := sb2.(*storeBlock)
+
+			_, err = Store.OpenBlock(2)
+			Expect(errors.Is(err, ErrBlockAlreadyOpen)).To(BeTrue())
+
+			failIfErr(storeb.tree.putValue(ctx, "openkey1", []byte("one")))
+			failIfErr(storeb2.tree.putValue(ctx, "openkey2", []byte("two")))
+
+			value, err := storeb.tree.getValue(ctx, "openkey2")
+			failIfErr(err)
+			Expect(value).To(BeNil())
+
+			value, err = storeb2.tree.getValue(ctx, "openkey2")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("two"))
+
+			failIfErr(storeb2.Revert())
+			commitMerkle(ctx, storeb)
+
+			value, err = Store.merkleTree.getValue(ctx, "openkey1")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("one"))
+		})
+
+		It("refuses to commit a block opened before another commit", func() {
+			storeb := openStore(ctx)
+			sb2, err := Store.OpenBlock(2)
+			failIfErr(err)
+			storeb2 := sb2.(*storeBlock)
+
+			failIfErr(storeb.tree.putValue(ctx, "conflictkey1", []byte("one")))
+			_, err = storeb.Submit(ctx, testBlockWithTxns("conflict1", 1))
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+			root := Store.GetRoot()
+
+			failIfErr(storeb2.tree.putValue(ctx, "conflictkey2", []byte("two")))
+			_, err = storeb2.Submit(ctx, testBlockWithTxns("conflict2", 2))
+			failIfErr(err)
+			err = storeb2.Commit(ctx)
+			Expect(errors.Is(err, ErrCommitConflict)).To(BeTrue())
+			failIfErr(storeb2.Revert())
+
+			Expect(Store.GetRoot()).To(Equal(root))
+			value, err := Store.merkleTree.getValue(ctx, "conflictkey1")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("one"))
+		})
+
+		It("puts many entries with the same root as sequential puts", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "manykey", []byte("before")))
+			commitMerkle(ctx, storeb)
+
+			lnode, err := makeNodeFromObj([]byte("linked"), nil)
+			failIfErr(err)
+			entries := []kv{
+				{"manykey", []byte("after"), false},
+				{"manykey2", []byte("two"), false},
+				{"manyother", []byte("other"), false},
+				{"manykey2", []byte("two again"), false},
+				{"manylink", &link{key: "lnk", targetNode: lnode}, true},
+				{"many", []byte("prefix"), false}}
+
+			seq, err := Store.merkleTree.StartBatch(nil)
+			failIfErr(err)
+			for _, e := range entries {
+				failIfErr(seq.put(ctx, e.key, e.value, e.valueIsLink))
+			}
+			many, err := Store.merkleTree.StartBatch(nil)
+			failIfErr(err)
+			failIfErr(many.putMany(ctx, entries))
+
+			Expect(many.getRoot()).To(Equal(seq.getRoot()))
+			value, err := many.getValue(ctx, "manykey2")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("two again"))
+
+			failIfErr(Store.merkleTree.RevertBatch(seq))
+			failIfErr(Store.merkleTree.RevertBatch(many))
+		})
+
+		It("reads its own writes without fetching unwritten nodes", func() {
+			mem := newMemBackend()
+			tree, err := initMerkle(ctx, mem, "")
+			failIfErr(err)
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			// nothing the batch writes is in IPFS until it is committed
+			mb.api = noGetBackend{mem}
+
+			prefix := strings.Repeat("sharedprefix", 8)
+			for _, depth := range []int{1, 4} {
+				prefetchDepth = depth
+				failIfErr(mb.putValue(ctx, prefix+"a", []byte("A")))
+				Expect(mb.getValue(ctx, prefix+"a")).To(Equal([]byte("A")))
+				failIfErr(mb.putValue(ctx, prefix+"b", []byte("B")))
+				Expect(mb.getValue(ctx, prefix+"a")).To(Equal([]byte("A")))
+				Expect(mb.getValue(ctx, prefix+"b")).To(Equal([]byte("B")))
+
+				failIfErr(mb.copySubtree(ctx, prefix, "copied"))
+				Expect(mb.getValue(ctx, "copieda")).To(Equal([]byte("A")))
+				Expect(mb.has(ctx, "copiedb")).To(BeTrue())
+			}
+			prefetchDepth = 1
+		})
+
+		It("resolves several committed levels per get", func() {
+			defer func(c *nodeCache) { cache = c }(cache)
+			cache = nil
+			defer func(depth int) { prefetchDepth = depth }(prefetchDepth)
+
+			mem := newMemBackend()
+			tree, err := initMerkle(ctx, mem, "")
+			failIfErr(err)
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			keys := []string{strings.Repeat("deep", 8), "dotted.key/with/slashes"}
+			for _, k := range keys {
+				failIfErr(mb.putValue(ctx, k, []byte(k)))
+			}
+			failIfErr((&batch{}).commit(ctx, mem, mb.root))
+			failIfErr(tree.CommitBatch(ctx, mb))
+
+			api := &countingGetBackend{memBackend: mem}
+			m, err := initMerkle(ctx, api, tree.getRoot())
+			failIfErr(err)
+			gets := func(key string) int64 {
+				atomic.StoreInt64(&api.gets, 0)
+				mb, err := m.StartBatch(nil)
+				failIfErr(err)
+				v, err := mb.getValue(ctx, key)
+				failIfErr(err)
+				if v != nil {
+					Expect(string(v)).To(Equal(key))
+				}
+				return atomic.LoadInt64(&api.gets)
+			}
+
+			prefetchDepth = 1
+			Expect(gets(keys[0])).To(BeNumerically("==", 32))
+			prefetchDepth = 8
+			Expect(gets(keys[0])).To(BeNumerically("==", 4))
+			Expect(gets(keys[1])).To(BeNumerically(">", 0))
+			Expect(gets(strings.Repeat("deep", 4) + "missing")).To(BeNumerically("<=", 4))
+			Expect(m.rootNode().links["d"].targetNode).To(BeNil())
+		})
+
+		It("skips fetches for keys its filter rules out", func() {
+			defer func(c *nodeCache) { cache = c }(cache)
+			cache = nil
+
+			mem := newMemBackend()
+			tree, err := initMerkle(ctx, mem, "")
+			failIfErr(err)
+			mb, err := tree.StartBatch(nil)
+			failIfErr(err)
+			for i := 0; i < 200; i++ {
+				failIfErr(mb.putValue(ctx, fmt.Sprintf("txn%03d", i), []byte{byte(i)}))
+			}
+			failIfErr((&batch{}).commit(ctx, mem, mb.root))
+			failIfErr(tree.CommitBatch(ctx, mb))
+
+			absentGets := func(m *merkleTreeStruct, api *countingGetBackend) int64 {
+				atomic.StoreInt64(&api.gets, 0)
+				for i := 0; i < 200; i++ {
+					v, err := m.getValue(ctx, fmt.Sprintf("txn%03dx", i))
+					failIfErr(err)
+					Expect(v).To(BeNil())
+				}
+				return atomic.LoadInt64(&api.gets)
+			}
+
+			plainAPI := &countingGetBackend{memBackend: mem}
+			plain, err := initMerkle(ctx, plainAPI, tree.getRoot())
+			failIfErr(err)
+			Expect(absentGets(plain, plainAPI)).To(BeNumerically(">=", 200))
+
+			api := &countingGetBackend{memBackend: mem}
+			filtered, err := initMerkle(ctx, api, tree.getRoot())
+			failIfErr(err)
+			failIfErr(filtered.loadFilter(ctx, 400))
+			Expect(absentGets(filtered, api)).To(BeNumerically("<", 20))
+
+			// keys put and copied after the filter was loaded are found
+			base := filtered.rootNode()
+			mb, err = filtered.StartBatch(nil)
+			failIfErr(err)
+			for i := 0; i < 50; i++ {
+				failIfErr(mb.putValue(ctx, fmt.Sprintf("late%03d", i), []byte{byte(i)}))
+			}
+			failIfErr(mb.copySubtree(ctx, "txn1", "copy"))
+			failIfErr((&batch{}).commit(ctx, mem, mb.root))
+			failIfErr(filtered.CommitBatch(ctx, mb))
+
+			for i := 0; i < 200; i++ {
+				Expect(filtered.getValue(ctx, fmt.Sprintf("txn%03d", i))).To(Equal([]byte{byte(i)}))
+			}
+			for i := 0; i < 50; i++ {
+				Expect(filtered.getValue(ctx, fmt.Sprintf("late%03d", i))).To(Equal([]byte{byte(i)}))
+			}
+			for i := 100; i < 200; i++ {
+				Expect(filtered.getValue(ctx, fmt.Sprintf("copy%02d", i-100))).To(Equal([]byte{byte(i)}))
+			}
+
+			// a batch on another root commits with a filter of its own tree
+			mb, err = filtered.StartBatch(base)
+			failIfErr(err)
+			failIfErr(mb.putValue(ctx, "forked", []byte("forked")))
+			failIfErr((&batch{}).commit(ctx, mem, mb.root))
+			failIfErr(filtered.CommitBatch(ctx, mb))
+			Expect(filtered.getValue(ctx, "forked")).To(Equal([]byte("forked")))
+			Expect(filtered.getValue(ctx, "txn000")).To(Equal([]byte{0}))
+			Expect(filtered.getValue(ctx, "late000")).To(BeNil())
+		})
+
+		It("keeps values of keys that prefix other keys", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "ab", []byte("ab")))
+			failIfErr(storeb.tree.putValue(ctx, "abc", []byte("abc")))
+			failIfErr(storeb.tree.putValue(ctx, "a", []byte("a")))
+			commitMerkle(ctx, storeb)
+
+			for _, k := range []string{"a", "ab", "abc"} {
+				value, err := Store.merkleTree.getValue(ctx, k)
+				failIfErr(err)
+				Expect(string(value)).To(Equal(k))
+			}
+		})
+
+		It("rejects link names that shadow children or the value", func() {
+			storeb := openStore(ctx)
+			n, err := makeNodeFromObj([]byte("target"), nil)
+			failIfErr(err)
+
+			for _, name := range []string{"c", val, ""} {
+				err = storeb.tree.putLink(ctx, "shadow", &link{key: name, targetNode: n})
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue())
+				err = storeb.tree.putMany(ctx, []kv{{"shadow", &link{key: name, targetNode: n}, true}})
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue())
+			}
+			failIfErr(storeb.Revert())
+		})
+
+		It("generates and verifies proofs", func() {
+			storeb := openStore(ctx)
+
+			failIfErr(storeb.tree.putValue(ctx, "proofkey", []byte("proofvalue")))
+			failIfErr(storeb.tree.putValue(ctx, "proofkey2", []byte("proofvalue2")))
+			commitMerkle(ctx, storeb)
+
+			proof, err := Store.merkleTree.getProof(ctx, "proofkey")
+			failIfErr(err)
+			root := Store.merkleTree.getRoot()
+
+			ok, err := VerifyProof(root, "proofkey", []byte("proofvalue"), proof)
+			failIfErr(err)
+			Expect(ok).To(BeTrue())
+
+			ok, err = VerifyProof(root, "proofkey", []byte("tampered"), proof)
+			failIfErr(err)
+			Expect(ok).To(BeFalse())
+
+			// a verifier configured with other encoding settings still
+			// recomputes the nodes as they were written
+			defer func(c nodeCodec, h uint64) { codec, hashFunc = c, h }(codec, hashFunc)
+			codec = jsonCodec{}
+			hashFunc, err = parseHashFunc("blake2b-256")
+			failIfErr(err)
+			ok, err = VerifyProof(root, "proofkey", []byte("proofvalue"), proof)
+			failIfErr(err)
+			Expect(ok).To(BeTrue())
+		})
+
+		It("counts the nodes of a commit IPFS already holds", func() {
+			dedupCheck = true
+			defer func() { dedupCheck = false }()
+			commitValue := func(value string) (int, uint64) {
+				storeb := openStore(ctx)
+				failIfErr(storeb.tree.putValue(ctx, "dedupcommitkey", []byte(value)))
+				nodes, _ := commitMerkle(ctx, storeb)
+				return nodes, Store.Stats().LastCommitDeduped
+			}
+
+			commitValue("first")
+			commitValue("second")
+			before := Store.Stats().NodesDeduped
+			// back to the first tree, every node of which is stored
+			nodes, deduped := commitValue("first")
+			Expect(deduped).To(BeNumerically(">", 0))
+			Expect(deduped).To(Equal(uint64(nodes)))
+			Expect(Store.Stats().NodesDeduped - before).To(Equal(deduped))
 		})
 
 		It("commit time", func() {
@@ -157,14 +801,25 @@ var _ = Describe("Merkle", func() {
 				r.Read(v)
 				keyb := sha256.Sum256(v)
 				key := hex.EncodeToString(keyb[:])
-				err := Store.merkleTree.putValue(ctx, key, v)
+				err := storeb.tree.putValue(ctx, key, v)
 				failIfErr(err)
 				count--
 			}
 
+			var lastDone, lastTotal int
+			// progress is called on the commit workers' goroutines
+			storeb.batch.progress = func(done, total int) {
+				defer GinkgoRecover()
+				Expect(done).To(BeNumerically(">", lastDone))
+				lastDone, lastTotal = done, total
+				GinkgoWriter.Write([]byte(fmt.Sprintf("Committed %d of %d nodes\n", done, total)))
+			}
+
 			GinkgoWriter.Write([]byte("Committing...\n"))
 			c, t := commitMerkle(ctx, storeb)
 			GinkgoWriter.Write([]byte(fmt.Sprintf("Commit took %f ms for %d nodes", t, c)))
+			Expect(lastDone).To(Equal(c))
+			Expect(lastTotal).To(Equal(c))
 		})
 
 	})
@@ -173,37 +828,112 @@ var _ = Describe("Merkle", func() {
 func BenchmarkPut(b *testing.B) {
 	ctx := context.Background()
 	if Store == nil {
+		viper.Set("store.inmemory", true)
 		initialize(ctx)
-		openStore(ctx)
 	}
+	storeb := openStore(ctx)
 	r := rand.Reader
 	value := make([]byte, 32)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		r.Read(value)
 		key := fmt.Sprintf("item%dval%dval%dval%d", i, value[0], value[1], value[2])
-		Store.merkleTree.putValue(ctx, key, value)
+		storeb.tree.putValue(ctx, key, value)
 	}
 }
 
-func commitMerkle(ctx context.Context, storeb *storeBlock) (int, float32) {
-	start := time.Now().UnixNano()
+// noGetBackend is a memBackend that fails every get, for reads that must
+// be served from memory.
+type noGetBackend struct {
+	*memBackend
+}
+
+func (b noGetBackend) get(ctx context.Context, p coreiface.Path) (ipldNode, error) {
+	return nil, fmt.Errorf("unexpected get of %s", p)
+}
+
+// countingGetBackend is a memBackend that counts its gets.
+type countingGetBackend struct {
+	*memBackend
+	gets int64
+}
+
+func (b *countingGetBackend) get(ctx context.Context, p coreiface.Path) (ipldNode, error) {
+	atomic.AddInt64(&b.gets, 1)
+	return b.memBackend.get(ctx, p)
+}
+
+// slowGetBackend is a memBackend whose gets take as long as a round trip
+// to an IPFS daemon, plus the time to load each node the path resolves.
+type slowGetBackend struct {
+	*memBackend
+}
+
+func (b slowGetBackend) get(ctx context.Context, p coreiface.Path) (ipldNode, error) {
+	segs := strings.Count(strings.Trim(p.String(), "/"), "/")
+	time.Sleep(200*time.Microsecond + time.Duration(segs)*20*time.Microsecond)
+	return b.memBackend.get(ctx, p)
+}
 
-	err := storeb.batch.commit(ctx, Store.api, storeb.merkleRoot)
+func BenchmarkGetDeepKey(b *testing.B) {
+	ctx := context.Background()
+	api := slowGetBackend{newMemBackend()}
+	m, err := initMerkle(ctx, api, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	mb, err := m.StartBatch(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	key := strings.Repeat("deepkey", 10)[:64]
+	err = mb.putValue(ctx, key, []byte("value"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = (&batch{}).commit(ctx, api, mb.root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	m.CommitBatch(ctx, mb)
+
+	defer func(c *nodeCache) { cache = c }(cache)
+	cache = nil
+	defer func(depth int) { prefetchDepth = depth }(prefetchDepth)
+	for _, depth := range []int{1, 8} {
+		b.Run(fmt.Sprintf("prefetch=%d", depth), func(b *testing.B) {
+			prefetchDepth = depth
+			for i := 0; i < b.N; i++ {
+				mb, err := m.StartBatch(nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				v, err := mb.getValue(ctx, key)
+				if err != nil || string(v) != "value" {
+					b.Fatal(v, err)
+				}
+			}
+		})
+	}
+}
+
+func commitMerkle(ctx context.Context, storeb *storeBlock) (int, float32) {
+	err := storeb.batch.commit(ctx, Store.api, storeb.tree.root)
 	failIfErr(err)
 
-	nodeCount := len(storeb.batch.nodes) - 1
+	st := Store.Stats()
+	Expect(st.LastCommitNodes).To(Equal(uint64(len(storeb.batch.nodes) - 1)))
 
 	if pin {
 		err = storeb.pinNodes(ctx, storeb.batch.nodes)
 		failIfErr(err)
 	}
 
-	Store.merkleTree.CommitBatch()
-	Store.reset()
+	Store.merkleTree.CommitBatch(ctx, storeb.tree)
+	Store.closeBlock(storeb)
 
-	t := float32(time.Now().UnixNano()-start) / float32(time.Millisecond)
-	return nodeCount, t
+	t := float32(st.LastCommitDuration) / float32(time.Millisecond)
+	return int(st.LastCommitNodes), t
 }
 
 func initialize(ctx context.Context) {
@@ -219,9 +949,7 @@ func openStore(ctx context.Context) *storeBlock {
 	}
 	Store.reset()
 	sb, _ := Store.OpenBlock(1)
-	storeb := sb.(*storeBlock)
-	storeb.batch.dagBatch = Store.api.Dag().Batch(ctx)
-	return storeb
+	return sb.(*storeBlock)
 }
 
 func initViper() {
@@ -230,6 +958,8 @@ func initViper() {
 	viper.SetDefault("store.ipfs.swarmhosts", []string{"/ip4/127.0.0.1/tcp"})
 	viper.SetDefault("store.ipfs.swarmport", 4001)
 	viper.SetDefault("store.ipfs.disablenat", true)
+	viper.SetDefault("store.ipfs.commitworkers", 4)
+	viper.SetDefault("store.ipfs.online", false)
 	viper.SetDefault("store.debug", true)
 }
 
@@ -0,0 +1,172 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+)
+
+// Named trees partition state into namespaces, each a merkle tree with its
+// own root, so that changes in one namespace do not rewrite the nodes of
+// another. A block header links the roots by name from a node under its
+// "trees" link. The default tree stays under "merkle", and the headers of a
+// store that never uses a named tree have no "trees" link.
+
+const treesLink = "trees"
+
+// namedTree is a named tree opened in a block.
+type namedTree struct {
+	m *merkleTreeStruct
+	b *merkleTreeBatch
+}
+
+// Tree returns the named tree as of the current root. A tree that has not
+// been written yet is empty.
+func (s *store) Tree(ctx context.Context, name string) (MerkleTree, error) {
+	err := checkReservedName(name)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	root := s.root
+	s.Unlock()
+
+	return readNamedTree(ctx, s.api, root, name)
+}
+
+// Tree returns the named tree of the block. In an open block the tree starts
+// from the parent's and is committed with the block. The tree of a block
+// returned by GetBlock is read-only.
+func (s *storeBlock) Tree(ctx context.Context, name string) (MerkleTreeWriter, error) {
+	err := checkReservedName(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.readonly {
+		return readNamedTree(ctx, s.store.api, s.blockHeader, name)
+	}
+	if ok, _ := s.IsOpen(); !ok {
+		return nil, ErrStoreNotOpen
+	}
+
+	s.treesMu.Lock()
+	defer s.treesMu.Unlock()
+	if t := s.trees[name]; t != nil {
+		return &batchTree{b: t.b}, nil
+	}
+
+	m, err := loadNamedTree(ctx, s.store.api, s.parent, name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := m.StartBatch(nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.trees == nil {
+		s.trees = make(map[string]*namedTree)
+	}
+	s.trees[name] = &namedTree{m: m, b: b}
+	return &batchTree{b: b}, nil
+}
+
+// readNamedTree returns the named tree of the block header for reading. If
+// the header has no tree by that name, the tree is empty and its root is
+// held in memory only, so that reading it writes nothing to IPFS, as a
+// read-only store requires.
+func readNamedTree(ctx context.Context, api backend, header *node, name string) (MerkleTreeWriter, error) {
+	trees, err := treesNode(ctx, api, header)
+	if err != nil {
+		return nil, err
+	}
+	if trees == nil || trees.links[name] == nil {
+		root, err := emptyTreeRoot()
+		if err != nil {
+			return nil, err
+		}
+		return readonlyTree{&batchTree{b: &merkleTreeBatch{api: api, root: root}}}, nil
+	}
+	root, err := linkTarget(ctx, api, trees.links[name])
+	if err != nil {
+		return nil, err
+	}
+	return readonlyTree{&committedTree{m: &merkleTreeStruct{api: api, root: root}}}, nil
+}
+
+// loadNamedTree returns the named tree of the block header, or a new empty
+// tree, written to IPFS, if the header has none by that name.
+func loadNamedTree(ctx context.Context, api backend, header *node, name string) (*merkleTreeStruct, error) {
+	trees, err := treesNode(ctx, api, header)
+	if err != nil {
+		return nil, err
+	}
+	if trees == nil || trees.links[name] == nil {
+		return initMerkle(ctx, api, "")
+	}
+	root, err := linkTarget(ctx, api, trees.links[name])
+	if err != nil {
+		return nil, err
+	}
+	return &merkleTreeStruct{api: api, root: root}, nil
+}
+
+// treesNode returns the node linking the named tree roots of the block
+// header, or nil if it has none.
+func treesNode(ctx context.Context, api backend, header *node) (*node, error) {
+	lnk := header.links[treesLink]
+	if lnk == nil {
+		return nil, nil
+	}
+	return linkTarget(ctx, api, lnk)
+}
+
+// makeTreesNode returns the node to link under "trees" from the block's
+// header: the parent's, with the roots of the trees opened in the block
+// replaced. It returns nil if neither has a named tree.
+func (s *storeBlock) makeTreesNode(ctx context.Context) (*node, error) {
+	base, err := treesNode(ctx, s.store.api, s.parent)
+	if err != nil {
+		return nil, err
+	}
+
+	s.treesMu.Lock()
+	defer s.treesMu.Unlock()
+	if len(s.trees) == 0 {
+		return base, nil
+	}
+
+	links := make(map[string]*link, len(s.trees))
+	if base != nil {
+		for k, lnk := range base.links {
+			l := *lnk
+			links[k] = &l
+		}
+	}
+	for name, t := range s.trees {
+		t.b.Lock()
+		links[name] = &link{key: name, targetNode: t.b.root}
+		t.b.Unlock()
+	}
+	n, err := makeNodeFromObj(nil, links)
+	if err != nil {
+		return nil, err
+	}
+	for name := range s.trees {
+		n.changedLinks[name] = true
+	}
+	return n, nil
+}
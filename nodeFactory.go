@@ -17,27 +17,70 @@
 package storeipfs
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strconv"
+
 	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
 	mh "gx/ipfs/QmPnFwZ2JXKnXgMw8CdBPxn7FWh6LLdjUjxV1fKHuJnkr8/go-multihash"
-	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
 
 	spec "github.com/blocktop/go-spec"
 	"github.com/gogo/protobuf/proto"
 	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+	"github.com/ipfs/go-ipfs/core/coreapi/interface/options"
 )
 
 type node struct {
 	data         []byte
 	links        map[string]*link
-	cnode        *cbor.Node
+	cnode        ipldNode
 	path         coreiface.ResolvedPath
 	changedLinks map[string]bool
 	changedData  bool
 	fromIPFS     bool
+	expires      uint64 // block number from which data is expired, or 0
+	version      uint64 // layout version, 0 for a node without a marker
+}
+
+// nodeVersion is the version of the node layout written by wrapObj, held in
+// the node's "_v" field. Nodes written before the marker was introduced
+// have no "_v" field and are read as version 0; they keep their encoding,
+// and so their CID, until they are changed. Bump it only when the layout
+// changes, and keep makeNodeFromIPLD able to read every earlier version.
+const nodeVersion = 1
+
+// versionKey is the node field holding the layout version.
+const versionKey = "_v"
+
+// expiresKey is the node field holding the block number from which the
+// value is expired. It is written only for values put with an expiry.
+const expiresKey = "_exp"
+
+// val is the node field holding the node's value. It, versionKey and
+// expiresKey are reserved: a link may not take any of their names.
+// Changing val changes the encoding, and so the CID, of every node.
+const val = "val"
+
+// checkReservedName returns ErrInvalidLinkName if a link named name would
+// collide with a field of the node layout, or with chunksLink, which the
+// store adds to values written by PutReader.
+func checkReservedName(name string) error {
+	if name == chunksLink {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidLinkName, name)
+	}
+	return checkFieldName(name)
+}
+
+// checkFieldName returns ErrInvalidLinkName if a link named name would
+// collide with a field of the node layout.
+func checkFieldName(name string) error {
+	if name == val || name == versionKey || name == expiresKey || name == "" {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidLinkName, name)
+	}
+	return nil
 }
 
 type link struct {
@@ -46,35 +89,43 @@ type link struct {
 	targetCid  cid.Cid
 }
 
-func makeNodeFromNodeHash(ctx context.Context, hash string) (*node, error) {
+func makeNodeFromNodeHash(ctx context.Context, api backend, hash string) (*node, error) {
 	c, err := cid.Parse(hash)
 	if err != nil {
 		return nil, err
 	}
 	path := coreiface.IpldPath(c)
 
-	// TODO add ctx with timeout
-	return getObj(ctx, Store.api, path.String())
+	return getObj(ctx, api, path.String())
 }
 
 func makeNodeFromObj(data []byte, links map[string]*link) (*node, error) {
-	obj := map[string]interface{}{
-		val: data}
+	return makeExpiringNode(data, links, 0)
+}
 
-	if links != nil {
-		for k, ln := range links {
-			if k == val {
-				return nil, fmt.Errorf("link key may to be '%s'", val)
-			}
-			if ln.targetNode == nil {
-				obj[k] = ln.targetCid
-			} else {
-				obj[k] = ln.targetNode.cnode.Cid()
-			}
+// makeExpiringNode is makeNodeFromObj for a value that expires at block
+// number expires, or never if expires is 0.
+func makeExpiringNode(data []byte, links map[string]*link, expires uint64) (*node, error) {
+	if len(data) > maxValueSize {
+		return nil, fmt.Errorf("%w: %d bytes, store.maxvaluesize is %d", ErrValueTooLarge, len(data), maxValueSize)
+	}
+	if len(links) > maxNodeLinks {
+		return nil, fmt.Errorf("%w: %d links, store.maxnodelinks is %d", ErrTooManyLinks, len(links), maxNodeLinks)
+	}
+	cids := make(map[string]cid.Cid, len(links))
+	for k, ln := range links {
+		err := checkFieldName(k)
+		if err != nil {
+			return nil, err
+		}
+		if ln.targetNode == nil {
+			cids[k] = ln.targetCid
+		} else {
+			cids[k] = ln.targetNode.cnode.Cid()
 		}
 	}
 
-	cnode, err := cbor.WrapObject(obj, mh.SHA2_256, -1)
+	cnode, err := wrapExpiringObj(data, cids, expires)
 	if err != nil {
 		return nil, err
 	}
@@ -85,19 +136,93 @@ func makeNodeFromObj(data []byte, links map[string]*link) (*node, error) {
 		links:        links,
 		path:         coreiface.IpldPath(cnode.Cid()),
 		changedData:  false,
-		changedLinks: make(map[string]bool)}
+		changedLinks: make(map[string]bool),
+		expires:      expires,
+		version:      nodeVersion}
 
 	return n, nil
 }
 
-func makeNodeFromCBOR(cnode *cbor.Node) (*node, error) {
+// wrapObj encodes a node object without an expiry.
+func wrapObj(data []byte, links map[string]cid.Cid) (ipldNode, error) {
+	return wrapExpiringObj(data, links, 0)
+}
+
+// wrapExpiringObj encodes a node object with store.ipfs.codec. It is the
+// single place the node layout { "val": data, "<name>": cid, ... } is
+// defined. Both codecs encode map keys in a canonical order, so the
+// encoding, and hence the CID, does not depend on Go map iteration order.
+func wrapExpiringObj(data []byte, links map[string]cid.Cid, expires uint64) (ipldNode, error) {
+	return encodeNode(codec, hashFunc, nodeVersion, data, links, expires)
+}
+
+// encodeNode is wrapExpiringObj with the codec, multihash and layout
+// version given rather than taken from the configuration. Version 0 writes
+// no version marker.
+func encodeNode(nc nodeCodec, mhType uint64, version uint64, data []byte, links map[string]cid.Cid, expires uint64) (ipldNode, error) {
+	obj := map[string]interface{}{
+		val: data}
+
+	for k, c := range links {
+		obj[k] = c
+	}
+	if version > 0 {
+		obj[versionKey] = version
+	}
+	if expires > 0 {
+		obj[expiresKey] = expires
+	}
+
+	return nc.encode(obj, mhType)
+}
+
+// dagPutOptions returns the options for putting the raw data of c so that
+// IPFS computes the same CID.
+func dagPutOptions(c cid.Cid) []options.DagPutOption {
+	prefix := c.Prefix()
+	return []options.DagPutOption{
+		options.Dag.InputEnc("raw"),
+		options.Dag.Codec(prefix.Codec),
+		options.Dag.Hash(prefix.MhType, prefix.MhLength)}
+}
+
+// parseHashFunc returns the multihash code for a hash function name such as
+// "sha2-256" or "blake2b-256".
+func parseHashFunc(name string) (uint64, error) {
+	code, ok := mh.Names[name]
+	if !ok {
+		return 0, fmt.Errorf("store.ipfs.hashfunc: unknown hash function %q", name)
+	}
+	_, err := mh.Sum(nil, code, -1)
+	if err != nil {
+		return 0, fmt.Errorf("store.ipfs.hashfunc: %q is not supported: %v", name, err)
+	}
+	return code, nil
+}
+
+// fieldUint returns the unsigned integer held by a node field decoded with
+// json.Number, and false if the field holds anything else.
+func fieldUint(v interface{}) (uint64, bool) {
+	num, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	u, err := strconv.ParseUint(string(num), 10, 64)
+	return u, err == nil
+}
+
+func makeNodeFromIPLD(cnode ipldNode) (*node, error) {
 	// convert ipld node to map[string]interface{}
 	jb, err := cnode.MarshalJSON()
 	if err != nil {
 		return nil, err
 	}
+	// numbers are decoded as json.Number, so that block numbers above 2^53
+	// are read exactly
 	obj := map[string]interface{}{}
-	err = json.Unmarshal(jb, &obj)
+	dec := json.NewDecoder(bytes.NewReader(jb))
+	dec.UseNumber()
+	err = dec.Decode(&obj)
 	if err != nil {
 		return nil, err
 	}
@@ -109,9 +234,31 @@ func makeNodeFromCBOR(cnode *cbor.Node) (*node, error) {
 		changedData:  false,
 		changedLinks: make(map[string]bool)}
 
+	if v, ok := obj[versionKey]; ok {
+		version, ok := fieldUint(v)
+		if !ok || version > nodeVersion {
+			return nil, fmt.Errorf("%w: %v in %s", ErrUnsupportedNodeVersion, v, cnode.Cid())
+		}
+		n.version = version
+		delete(obj, versionKey)
+	}
+	if v, ok := obj[expiresKey]; ok {
+		expires, ok := fieldUint(v)
+		if !ok || expires < 1 {
+			return nil, fmt.Errorf("invalid %s %v in %s", expiresKey, v, cnode.Cid())
+		}
+		n.expires = expires
+		delete(obj, expiresKey)
+	}
+
 	for k, v := range obj {
 		if k == val {
-			byts, err := base64.StdEncoding.DecodeString(v.(string))
+			// intermediate and deleted nodes carry a null value
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			byts, err := base64.StdEncoding.DecodeString(s)
 			if err != nil {
 				return nil, err
 			}
@@ -132,13 +279,14 @@ func makeNodeFromCBOR(cnode *cbor.Node) (*node, error) {
 }
 
 func recomputeNode(n *node) (*node, error) {
-	n2, err := makeNodeFromObj(n.data, n.links)
+	n2, err := makeExpiringNode(n.data, n.links, n.expires)
 	if err != nil {
 		return nil, err
 	}
 
 	n.cnode = n2.cnode
 	n.path = n2.path
+	n.version = n2.version
 
 	return n, nil
 }
@@ -198,6 +346,10 @@ func makeLinks(specLinks spec.Links) (map[string]*link, error) {
 
 	links := make(map[string]*link, len(specLinks))
 	for name, cidS := range specLinks {
+		err := checkReservedName(name)
+		if err != nil {
+			return nil, err
+		}
 		c, err := cid.Parse(cidS)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,237 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	mh "gx/ipfs/QmPnFwZ2JXKnXgMw8CdBPxn7FWh6LLdjUjxV1fKHuJnkr8/go-multihash"
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+
+	spec "github.com/blocktop/go-spec"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Node factory", func() {
+
+	Describe("hash function", func() {
+		AfterEach(func() {
+			hashFunc = mh.SHA2_256
+		})
+
+		It("wraps nodes with the configured multihash", func() {
+			code, err := parseHashFunc("blake2b-256")
+			failIfErr(err)
+			hashFunc = code
+
+			cnode, err := wrapObj([]byte("blake"), nil)
+			failIfErr(err)
+			Expect(cnode.Cid().Prefix().MhType).To(Equal(uint64(mh.BLAKE2B_MIN + 31)))
+		})
+
+		It("rejects an unknown hash function", func() {
+			_, err := parseHashFunc("md5-ish")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("codec", func() {
+		BeforeEach(func() {
+			var err error
+			codec, err = parseCodec("dag-json")
+			failIfErr(err)
+		})
+
+		AfterEach(func() {
+			codec = cborCodec{}
+		})
+
+		It("round trips a dag-json value node", func() {
+			target, err := makeNodeFromObj([]byte("target"), nil)
+			failIfErr(err)
+			n, err := makeExpiringNode([]byte("json <value>"), map[string]*link{"t": {key: "t", targetNode: target}}, 7)
+			failIfErr(err)
+			Expect(n.cnode.Cid().Type()).To(Equal(uint64(dagJSON)))
+			Expect(string(n.cnode.RawData())).To(HavePrefix(`{"_exp":7,"_v":1,"t":{"/":"`))
+			Expect(string(n.cnode.RawData())).To(ContainSubstring(`"val":{"/":{"bytes":"anNvbiA8dmFsdWU+"}}`))
+
+			decoded, err := decodeNode(n.cnode.RawData(), n.cnode.Cid())
+			failIfErr(err)
+			parsed, err := makeNodeFromIPLD(decoded)
+			failIfErr(err)
+			Expect(parsed.data).To(Equal([]byte("json <value>")))
+			Expect(parsed.expires).To(Equal(uint64(7)))
+			Expect(parsed.links).To(HaveLen(1))
+			Expect(parsed.links["t"].targetCid).To(Equal(target.cnode.Cid()))
+
+			again, err := recomputeNode(parsed)
+			failIfErr(err)
+			Expect(again.cnode.Cid()).To(Equal(n.cnode.Cid()))
+		})
+
+		It("resolves paths through a DAG of mixed codecs", func() {
+			ctx := context.Background()
+			mem := newMemBackend()
+			leaf, err := makeNodeFromObj([]byte("leaf"), nil)
+			failIfErr(err)
+			codec = cborCodec{}
+			root, err := makeNodeFromObj([]byte("root"), map[string]*link{"l": {key: "l", targetNode: leaf}})
+			failIfErr(err)
+			failIfErr(putObj(ctx, mem, leaf))
+			failIfErr(putObj(ctx, mem, root))
+
+			n, err := getObj(ctx, mem, coreiface.IpldPath(root.cnode.Cid()).String()+"/l")
+			failIfErr(err)
+			Expect(n.cnode.Cid()).To(Equal(leaf.cnode.Cid()))
+			Expect(n.data).To(Equal([]byte("leaf")))
+		})
+
+		It("rejects dag-json for a store on an IPFS node", func() {
+			cfg := configFromViper()
+			cfg.InMemory = false
+			cfg.Codec = "dag-json"
+			_, err := InitStoreWithConfig(context.Background(), cfg)
+			Expect(err).To(MatchError(ContainSubstring("store.inmemory")))
+		})
+
+		It("rejects an unknown codec", func() {
+			_, err := parseCodec("dag-xml")
+			Expect(err).To(HaveOccurred())
+			sum, err := mh.Sum([]byte("raw"), mh.SHA2_256, -1)
+			failIfErr(err)
+			_, err = decodeNode([]byte("raw"), cid.NewCidV1(cid.Raw, sum))
+			Expect(errors.Is(err, ErrUnsupportedCodec)).To(BeTrue())
+		})
+	})
+
+	Describe("layout version", func() {
+		It("marks the nodes it writes with the current version", func() {
+			n, err := makeNodeFromObj([]byte("current"), nil)
+			failIfErr(err)
+			Expect(n.cnode.(*cbor.Node).Tree("", -1)).To(ContainElement(versionKey))
+
+			parsed, err := makeNodeFromIPLD(n.cnode)
+			failIfErr(err)
+			Expect(parsed.version).To(Equal(uint64(nodeVersion)))
+			Expect(parsed.links).NotTo(HaveKey(versionKey))
+			Expect(parsed.cnode.Cid()).To(Equal(n.cnode.Cid()))
+		})
+
+		It("reads nodes without a version marker as version 0", func() {
+			cnode, err := encodeNode(cborCodec{}, mh.SHA2_256, 0, []byte("v0"), nil, 0)
+			failIfErr(err)
+			Expect(cnode.(*cbor.Node).Tree("", -1)).NotTo(ContainElement(versionKey))
+
+			parsed, err := makeNodeFromIPLD(cnode)
+			failIfErr(err)
+			Expect(parsed.data).To(Equal([]byte("v0")))
+			Expect(parsed.version).To(BeZero())
+			Expect(parsed.links).NotTo(HaveKey(versionKey))
+		})
+
+		It("rewrites a changed version 0 node with the current version", func() {
+			leaf0, err := encodeNode(cborCodec{}, mh.SHA2_256, 0, []byte("old"), nil, 0)
+			failIfErr(err)
+			root0, err := encodeNode(cborCodec{}, mh.SHA2_256, 0, []byte("tree"), map[string]cid.Cid{"k": leaf0.Cid()}, 0)
+			failIfErr(err)
+			leaf, err := makeNodeFromIPLD(leaf0)
+			failIfErr(err)
+			root, err := makeNodeFromIPLD(root0)
+			failIfErr(err)
+
+			leaf.data = []byte("new")
+			_, err = recomputeNode(leaf)
+			failIfErr(err)
+			root.links["k"].targetNode = leaf
+			_, err = recomputeNode(root)
+			failIfErr(err)
+			Expect(leaf.version).To(Equal(uint64(nodeVersion)))
+			Expect(root.version).To(Equal(uint64(nodeVersion)))
+			failIfErr(verifyNodes([]*node{root, leaf}))
+
+			proof, err := makeProof(context.Background(), nil, root, "k")
+			failIfErr(err)
+			ok, err := VerifyProof(root.cnode.String(), "k", []byte("new"), proof)
+			failIfErr(err)
+			Expect(ok).To(BeTrue())
+		})
+
+		It("rejects nodes with a newer version", func() {
+			obj := map[string]interface{}{val: []byte("future"), versionKey: nodeVersion + 1}
+			cnode, err := cbor.WrapObject(obj, mh.SHA2_256, -1)
+			failIfErr(err)
+
+			_, err = makeNodeFromIPLD(cnode)
+			Expect(errors.Is(err, ErrUnsupportedNodeVersion)).To(BeTrue())
+		})
+
+		It("reads an expiry above 2^53 exactly", func() {
+			expires := uint64(1)<<53 + 1
+			n, err := makeExpiringNode([]byte("late"), nil, expires)
+			failIfErr(err)
+			parsed, err := makeNodeFromIPLD(n.cnode)
+			failIfErr(err)
+			Expect(parsed.expires).To(Equal(expires))
+		})
+
+		It("reserves the version key", func() {
+			Expect(errors.Is(checkLinkName(versionKey), ErrInvalidLinkName)).To(BeTrue())
+		})
+
+		It("rejects links named after a node field", func() {
+			target, err := makeNodeFromObj([]byte("target"), nil)
+			failIfErr(err)
+			for _, name := range []string{val, versionKey} {
+				_, err = makeNodeFromObj(nil, map[string]*link{name: {key: name, targetNode: target}})
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue(), name)
+				_, err = makeLinks(spec.Links{name: target.cnode.String()})
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue(), name)
+			}
+		})
+	})
+
+	It("encodes the same node to the same CID regardless of map order", func() {
+		target, err := wrapObj([]byte("target"), nil)
+		failIfErr(err)
+		names := make([]string, 20)
+		for i := range names {
+			names[i] = fmt.Sprintf("link%02d", i)
+		}
+
+		var first *cid.Cid
+		for i := 0; i < 20; i++ {
+			links := make(map[string]cid.Cid)
+			for _, j := range rand.Perm(len(names)) {
+				links[names[j]] = target.Cid()
+			}
+			cnode, err := wrapObj([]byte("data"), links)
+			failIfErr(err)
+			c := cnode.Cid()
+			if first == nil {
+				first = &c
+			}
+			Expect(c).To(Equal(*first))
+		}
+	})
+})
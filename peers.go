@@ -0,0 +1,54 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"fmt"
+)
+
+// PeerInfo describes a libp2p peer.
+type PeerInfo struct {
+	ID    string
+	Addrs []string // listen addresses for the local peer, the connection address otherwise
+	Self  bool     // the peer of this store's IPFS node
+}
+
+// Peers returns the local peer followed by the peers it is connected to.
+// An offline node has no listen addresses and no connected peers.
+func (s *store) Peers(ctx context.Context) ([]PeerInfo, error) {
+	if s.ipfs == nil {
+		return nil, fmt.Errorf("%w: the store has no IPFS node", ErrIPFSDown)
+	}
+
+	self := PeerInfo{ID: s.ipfs.Identity.Pretty(), Self: true}
+	host := s.ipfs.PeerHost
+	if host == nil {
+		return []PeerInfo{self}, nil
+	}
+	for _, a := range host.Addrs() {
+		self.Addrs = append(self.Addrs, a.String())
+	}
+
+	peers := []PeerInfo{self}
+	for _, c := range host.Network().Conns() {
+		peers = append(peers, PeerInfo{
+			ID:    c.RemotePeer().Pretty(),
+			Addrs: []string{c.RemoteMultiaddr().String()}})
+	}
+	return peers, nil
+}
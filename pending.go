@@ -0,0 +1,339 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	spec "github.com/blocktop/go-spec"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+)
+
+// A submitted block is logged to store.pendingdir as a CAR file named after
+// its block number, holding the block header, every node Commit would
+// write and the nodes the merkle batch spilled before Submit. The log is
+// removed when the block is committed or reverted. A log left by a process
+// that stopped in between is read by InitStore, which reopens the block as
+// submitted. It is not committed: the caller finds it with PendingBlocks
+// and commits or reverts it.
+
+const pendingExt = ".car"
+
+func (s *store) pendingFile(blockNumber uint64) string {
+	return path.Join(s.pendingDir, strconv.FormatUint(blockNumber, 10)+pendingExt)
+}
+
+// writePending logs the block header of s, if store.pendingdir is set.
+// Spilled nodes are no longer held in memory, so they are read back from
+// IPFS.
+func (s *storeBlock) writePending(ctx context.Context, header *node) error {
+	if s.store.pendingDir == "" {
+		return nil
+	}
+	nodes, err := collectChangedNodes(header, make([]*node, 1), make(map[string]int))
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = writeCARHeader(&buf, header.cnode.Cid())
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes[1:] {
+		err = writeCARBlock(&buf, n.cnode.Cid(), n.cnode.RawData())
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range s.spilled {
+		cnode, err := s.store.api.get(ctx, coreiface.IpldPath(c))
+		if err != nil {
+			return fmt.Errorf("spilled node %s: %w", c, err)
+		}
+		err = writeCARBlock(&buf, c, cnode.RawData())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(s.store.pendingDir, os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.store.pendingFile(s.blockNumber), buf.Bytes())
+}
+
+// removePending removes the log of s. A log that cannot be removed is only
+// reported, since a log of a committed block is dropped by InitStore.
+func (s *storeBlock) removePending() {
+	if s.store.pendingDir == "" {
+		return
+	}
+	err := os.Remove(s.store.pendingFile(s.blockNumber))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("failed to remove pending block log", "number", s.blockNumber, "err", err)
+	}
+}
+
+// recoverPending reopens the blocks logged in store.pendingdir. Logs of
+// blocks that were committed before the restart, the root, one of its
+// ancestors or another block the store already knows, are removed.
+func (s *store) recoverPending(ctx context.Context) error {
+	if s.pendingDir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(s.pendingDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, pendingExt) {
+			continue
+		}
+		blockNumber, err := strconv.ParseUint(strings.TrimSuffix(name, pendingExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		file := path.Join(s.pendingDir, name)
+		sb, err := s.readPending(ctx, file, blockNumber)
+		if err != nil {
+			return fmt.Errorf("pending block %s: %w", file, err)
+		}
+		committed, err := s.isCommitted(ctx, sb.blockHeader, blockNumber)
+		if err != nil {
+			return fmt.Errorf("pending block %s: %w", file, err)
+		}
+		if committed {
+			sb.removePending()
+			continue
+		}
+
+		s.storeBlocks[blockNumber] = sb
+		s.blockRoots[sb.blockHash] = sb.blockHeader
+		logger.Info("pending block recovered", "number", blockNumber, "hash", sb.blockHash, "root", sb.GetRoot())
+	}
+	return nil
+}
+
+// isCommitted reports whether header is a block header the store already
+// holds: one of s.blockRoots, or the header at blockNumber in the chain of
+// the root.
+func (s *store) isCommitted(ctx context.Context, header *node, blockNumber uint64) (bool, error) {
+	c := header.cnode.Cid()
+	for _, n := range s.blockRoots {
+		if n.cnode.Cid().Equals(c) {
+			return true, nil
+		}
+	}
+	n, err := s.chainHeader(ctx, blockNumber)
+	if err != nil || n == nil {
+		return false, err
+	}
+	return n.cnode.Cid().Equals(c), nil
+}
+
+// readPending reads a block log into a submitted store block. The nodes of
+// the log are linked together and marked changed, so that Commit writes
+// and pins them as it would have before the restart.
+func (s *store) readPending(ctx context.Context, file string, blockNumber uint64) (*storeBlock, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	nodes := make(map[string]*node)
+	roots, err := readCAR(f, func(cnode ipldNode) error {
+		n, err := makeNodeFromIPLD(cnode)
+		if err != nil {
+			return err
+		}
+		n.changedData = true
+		nodes[cnode.String()] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		for k, lnk := range n.links {
+			if tn := nodes[lnk.targetCid.String()]; tn != nil {
+				lnk.targetNode = tn
+				n.changedLinks[k] = true
+			}
+		}
+	}
+
+	header := nodes[roots[0].String()]
+	if header == nil {
+		return nil, fmt.Errorf("block header %s is not in the log", roots[0])
+	}
+	bh, err := blockHeaderFromBytes(header.data)
+	if err != nil {
+		return nil, err
+	}
+	if bh.blockNumber != blockNumber {
+		return nil, fmt.Errorf("%w: logged as %d, header has %d", ErrWrongBlockNumber, blockNumber, bh.blockNumber)
+	}
+	parent, err := headerLinkTarget(ctx, s.api, header, "parent")
+	if err != nil {
+		return nil, err
+	}
+	merkleRoot, err := headerLinkTarget(ctx, s.api, header, "merkle")
+	if err != nil {
+		return nil, err
+	}
+	parentRoot, err := headerLinkTarget(ctx, s.api, parent, "merkle")
+	if err != nil {
+		return nil, err
+	}
+	tree, err := recoveredBatch(ctx, s.merkleTree, parentRoot, merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	trees, err := s.recoveredTrees(ctx, parent, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storeBlock{
+		store:       s,
+		parent:      parent,
+		blockNumber: blockNumber,
+		merkleRoot:  merkleRoot,
+		tree:        tree,
+		batch:       &batch{},
+		blockHeader: header,
+		blockHash:   bh.blockID,
+		trees:       trees,
+		opened:      true}, nil
+}
+
+// recoveredBatch returns the batch that took the tree of m from base, the
+// merkle root of the recovered block's parent, to root, as StartBatch and
+// the puts of the block left it before the restart. The keys it changed,
+// which the filter and the key count learn on commit, are found by diffing
+// the two trees.
+func recoveredBatch(ctx context.Context, m *merkleTreeStruct, base *node, root *node) (*merkleTreeBatch, error) {
+	d := &TreeDiff{}
+	err := diffNodes(ctx, m.api, base, root, "", d)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &merkleTreeBatch{
+		api:    m.api,
+		root:   root,
+		base:   base.cnode.Cid(),
+		forked: !m.rootNode().cnode.Cid().Equals(base.cnode.Cid()),
+		track:  m.filter() != nil,
+		added:  len(d.Added) - len(d.Removed)}
+	for _, changes := range [][]KeyChange{d.Added, d.Modified} {
+		for _, change := range changes {
+			if b.track {
+				b.keys = append(b.keys, change.Key)
+			}
+			if len(change.Key) > b.depth {
+				b.depth = len(change.Key)
+			}
+		}
+	}
+	return b, nil
+}
+
+// recoveredTrees returns the named trees whose roots the recovered block
+// header changes from its parent's, each with the batch that changed it.
+func (s *store) recoveredTrees(ctx context.Context, parent *node, header *node) (map[string]*namedTree, error) {
+	trees, err := treesNode(ctx, s.api, header)
+	if err != nil || trees == nil {
+		return nil, err
+	}
+	parentTrees, err := treesNode(ctx, s.api, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	var named map[string]*namedTree
+	for name, lnk := range trees.links {
+		if parentTrees != nil && parentTrees.links[name] != nil && linkCid(parentTrees.links[name]) == linkCid(lnk) {
+			continue
+		}
+		m, err := loadNamedTree(ctx, s.api, parent, name)
+		if err != nil {
+			return nil, err
+		}
+		root, err := linkTarget(ctx, s.api, lnk)
+		if err != nil {
+			return nil, err
+		}
+		b, err := recoveredBatch(ctx, m, m.rootNode(), root)
+		if err != nil {
+			return nil, err
+		}
+		if named == nil {
+			named = make(map[string]*namedTree)
+		}
+		named[name] = &namedTree{m: m, b: b}
+	}
+	return named, nil
+}
+
+func headerLinkTarget(ctx context.Context, api backend, header *node, name string) (*node, error) {
+	lnk := header.links[name]
+	if lnk == nil || lnk.targetCid == cid.Undef {
+		return nil, fmt.Errorf("block header %s has no %s link", header.cnode.String(), name)
+	}
+	return linkTarget(ctx, api, lnk)
+}
+
+// PendingBlocks returns the open blocks that have been submitted but not
+// committed, in block number order. After InitStore these are the blocks
+// recovered from store.pendingdir.
+func (s *store) PendingBlocks() []spec.StoreBlock {
+	s.Lock()
+	defer s.Unlock()
+
+	var sbs []*storeBlock
+	for _, sb := range s.storeBlocks {
+		if sb.blockHeader != nil {
+			sbs = append(sbs, sb)
+		}
+	}
+	sort.Slice(sbs, func(i, j int) bool { return sbs[i].blockNumber < sbs[j].blockNumber })
+
+	pending := make([]spec.StoreBlock, len(sbs))
+	for i, sb := range sbs {
+		pending[i] = sb
+	}
+	return pending
+}
@@ -0,0 +1,273 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+)
+
+// With store.ipfs.pin set, every node a block writes is pinned directly.
+// UnpinBlock releases those pins for a block that is no longer needed,
+// keeping each node that a live block still reaches. The live blocks are
+// those on the chain of the current root and the other blocks retained by
+// this store, less the blocks already unpinned, together with the nodes
+// pinned by open blocks. Liveness is found by walking the DAG rather than
+// counted, so nodes shared with blocks committed before a restart stay
+// pinned. The walk follows only the store's own nodes: the targets of
+// TreePutLink links are the caller's to pin.
+//
+// The retained and unpinned blocks are kept in memory. After a restart,
+// blocks unpinned earlier count as live again, which keeps their shared
+// nodes pinned but unpins nothing that is still reached.
+
+func (s *store) retainBlock(blockHash string, header *node) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.retained == nil {
+		s.retained = make(map[string]string)
+	}
+	s.retained[blockHash] = header.cnode.String()
+}
+
+// UnpinBlock releases the pins held for a block committed by this store.
+// Nodes still reachable from a live block stay pinned. It walks the DAG of
+// every live block, so its cost grows with the size of the pinned state
+// rather than of the block. The block stays retained until every unpin
+// succeeds, so a failed UnpinBlock can be retried.
+func (s *store) UnpinBlock(ctx context.Context, blockHash string) error {
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+
+	s.Lock()
+	headerCid, ok := s.retained[blockHash]
+	if !ok {
+		s.Unlock()
+		return fmt.Errorf("block %s is not retained by this store", blockHash)
+	}
+	if headerCid == s.root.cnode.String() {
+		s.Unlock()
+		return fmt.Errorf("block %s is the current root", blockHash)
+	}
+	root := s.root
+	var others []string
+	for hash, cidS := range s.retained {
+		if hash != blockHash {
+			others = append(others, cidS)
+		}
+	}
+	released := map[string]bool{headerCid: true}
+	for cidS := range s.unpinned {
+		released[cidS] = true
+	}
+	live := make(map[string]bool)
+	for _, sb := range s.storeBlocks {
+		for _, p := range sb.pinned {
+			live[strings.TrimPrefix(p.String(), "/ipld/")] = true
+		}
+	}
+	s.Unlock()
+
+	header, err := makeNodeFromNodeHash(ctx, s.api, headerCid)
+	if err != nil {
+		return err
+	}
+	heads := []*node{root}
+	for _, cidS := range others {
+		n, err := makeNodeFromNodeHash(ctx, s.api, cidS)
+		if err != nil {
+			return err
+		}
+		heads = append(heads, n)
+	}
+
+	err = s.walkLive(ctx, heads, released, live, func(*node) error { return nil })
+	if err != nil {
+		return err
+	}
+
+	// live is closed under links, so the walk stops at the live nodes
+	var unpin []*node
+	err = walkStored(ctx, s.api, header, live, func(n *node) error {
+		unpin = append(unpin, n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range unpin {
+		ok, err := s.api.pinned(ctx, n.cnode.Cid())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = s.api.unpin(ctx, n.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	delete(s.retained, blockHash)
+	if s.unpinned == nil {
+		s.unpinned = make(map[string]bool)
+	}
+	s.unpinned[headerCid] = true
+	return nil
+}
+
+// walkLive calls visit with every stored node reachable from the block
+// headers heads that is not in live, adding each to live. It follows
+// parent links to older blocks; the DAGs of headers in released are not
+// walked, though their parents still are. A header already in live is
+// taken to have its parents in live too.
+func (s *store) walkLive(ctx context.Context, heads []*node, released, live map[string]bool, visit func(n *node) error) error {
+	headers := make(map[string]bool)
+	for _, h := range heads {
+		for h != nil && !headers[h.cnode.String()] && !live[h.cnode.String()] {
+			headers[h.cnode.String()] = true
+			if !released[h.cnode.String()] {
+				err := walkStored(ctx, s.api, h, live, visit)
+				if err != nil {
+					return err
+				}
+			}
+			var err error
+			h, err = storedTarget(ctx, s.api, h.links["parent"])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkStored is walkDAG over the store's own nodes below the block header
+// header. It does not follow the header's parent link, nor links to nodes
+// that are not stored locally or not encoded with a store codec.
+func walkStored(ctx context.Context, api backend, header *node, visited map[string]bool, visit func(n *node) error) error {
+	var walk func(n *node) error
+	walk = func(n *node) error {
+		cidS := n.cnode.String()
+		if visited[cidS] {
+			return nil
+		}
+		visited[cidS] = true
+
+		err := visit(n)
+		if err != nil {
+			return err
+		}
+		for k, lnk := range n.links {
+			if n == header && k == "parent" {
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			tn, err := storedTarget(ctx, api, lnk)
+			if err != nil {
+				return err
+			}
+			if tn == nil {
+				continue
+			}
+			err = walk(tn)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(header)
+}
+
+// storedTarget is linkTarget for links to the store's own nodes. It
+// returns nil for a nil link, or for a target that is not stored locally
+// or not encoded with a store codec, without fetching it.
+func storedTarget(ctx context.Context, api backend, lnk *link) (*node, error) {
+	if lnk == nil {
+		return nil, nil
+	}
+	if lnk.targetNode != nil {
+		return lnk.targetNode, nil
+	}
+	if lnk.targetCid == cid.Undef || codecs[lnk.targetCid.Type()] == nil {
+		return nil, nil
+	}
+	ok, err := api.has(ctx, lnk.targetCid)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return linkTarget(ctx, api, lnk)
+}
+
+func linkCid(lnk *link) string {
+	if lnk.targetNode != nil {
+		return lnk.targetNode.cnode.String()
+	}
+	return lnk.targetCid.String()
+}
+
+// pinRoot pins the block header root recursively, protecting every node
+// reachable from it with a single pin, and releases the recursive pin of
+// the previous root. The previous root's nodes stay pinned where the new
+// root reaches them, as it does through its parent link. A recursive pin
+// also covers the targets of TreePutLink links, which IPFS fetches if they
+// are not stored locally, so Commit blocks until they are found; do not
+// combine store.ipfs.pinrecursive with links to nodes that may be
+// unreachable.
+func (s *store) pinRoot(ctx context.Context, root *node) error {
+	err := s.api.pin(ctx, root.path, true)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	prev := s.rootPin
+	s.rootPin = root.path
+	s.Unlock()
+
+	s.unpinRoot(ctx, prev, root)
+	return nil
+}
+
+// swapRootPin records root, already pinned recursively, as the root pin
+// and releases the pin of the previous root. s must be locked.
+func (s *store) swapRootPin(ctx context.Context, root *node) {
+	prev := s.rootPin
+	s.rootPin = root.path
+	s.unpinRoot(ctx, prev, root)
+}
+
+// unpinRoot releases the recursive pin of prev, the root pin before root.
+func (s *store) unpinRoot(ctx context.Context, prev coreiface.Path, root *node) {
+	if prev != nil && prev.String() != root.path.String() {
+		err := s.api.unpin(ctx, prev)
+		if err != nil {
+			logger.Error("failed to unpin the previous root", "path", prev, "err", err)
+		}
+	}
+}
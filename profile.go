@@ -0,0 +1,88 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Profile collects the durations of the steps of a Submit and Commit run
+// with a context returned by WithProfiling. Steps are recorded as named
+// spans in the order they end. Steps run in parallel, such as the chunks of
+// a batch commit, each record a span, so spans may overlap.
+type Profile struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// Span is the duration of one step.
+type Span struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+type profileKey struct{}
+
+// WithProfiling returns a context that records the steps of the store
+// operations it is passed to in the returned Profile.
+func (s *store) WithProfiling(ctx context.Context) (context.Context, *Profile) {
+	p := &Profile{}
+	return context.WithValue(ctx, profileKey{}, p), p
+}
+
+// Spans returns the spans recorded so far.
+func (p *Profile) Spans() []Span {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	spans := make([]Span, len(p.spans))
+	copy(spans, p.spans)
+	return spans
+}
+
+// Total returns the sum of the durations of the spans named name.
+func (p *Profile) Total(name string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var total time.Duration
+	for _, sp := range p.spans {
+		if sp.Name == name {
+			total += sp.Duration
+		}
+	}
+	return total
+}
+
+func noSpan() {}
+
+// startSpan starts a span named name if ctx carries a Profile and returns
+// the function that ends it. Without a Profile it costs a context lookup.
+func startSpan(ctx context.Context, name string) func() {
+	p, ok := ctx.Value(profileKey{}).(*Profile)
+	if !ok {
+		return noSpan
+	}
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		p.mu.Lock()
+		p.spans = append(p.spans, Span{Name: name, Start: start, Duration: d})
+		p.mu.Unlock()
+	}
+}
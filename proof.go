@@ -0,0 +1,159 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+)
+
+// MerkleProof holds the nodes on the path from a merkle root to a key.
+// Nodes[0] is the root and Nodes[len(key)] is the node holding the value.
+type MerkleProof struct {
+	Nodes []ProofNode
+}
+
+// ProofNode is one node of a MerkleProof. Links maps link names to CIDs
+// and omits the link followed by the path, which the verifier recomputes.
+// Data is nil for the terminal node since the verifier supplies the value.
+// Cid is the node's CID, from which the verifier takes the codec and hash
+// function to recompute it with.
+type ProofNode struct {
+	Data    []byte
+	Links   map[string]string
+	Expires uint64 // block number from which the value is expired, or 0
+	Version uint64 // layout version of the node, see nodeVersion
+	Cid     string
+}
+
+func (m *merkleTreeStruct) getProof(ctx context.Context, key string) (*MerkleProof, error) {
+	return makeProof(ctx, m.api, m.rootNode(), key)
+}
+
+func (b *merkleTreeBatch) getProof(ctx context.Context, key string) (*MerkleProof, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return nil, ErrNotInBatch
+	}
+	return makeProof(ctx, b.api, b.root, key)
+}
+
+func makeProof(ctx context.Context, api backend, n *node, key string) (*MerkleProof, error) {
+	proof := &MerkleProof{Nodes: make([]ProofNode, len(key)+1)}
+	for i := 0; i <= len(key); i++ {
+		pn := ProofNode{Links: make(map[string]string, len(n.links)), Expires: n.expires, Version: n.version, Cid: n.cnode.String()}
+		var next string
+		if i < len(key) {
+			pn.Data = n.data
+			next = key[i : i+1]
+		}
+		for k, lnk := range n.links {
+			if k == next {
+				continue
+			}
+			if lnk.targetNode == nil {
+				pn.Links[k] = lnk.targetCid.String()
+			} else {
+				pn.Links[k] = lnk.targetNode.cnode.String()
+			}
+		}
+		proof.Nodes[i] = pn
+
+		if i == len(key) {
+			break
+		}
+		lnk := n.links[next]
+		if lnk == nil {
+			return nil, ErrKeyNotFound
+		}
+		var err error
+		n, err = linkTarget(ctx, api, lnk)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			return nil, ErrKeyNotFound
+		}
+	}
+
+	return proof, nil
+}
+
+// VerifyProof checks that value is stored at key in the merkle tree with the
+// given root CID. The node CIDs are recomputed from the proof bottom-up, so
+// no IPFS node is needed. Each node is encoded with the codec and hash
+// function of its CID in the proof, or of the root CID if the proof does
+// not give one, so a proof verifies whatever store.ipfs.codec and
+// store.ipfs.hashfunc the verifying process has.
+func VerifyProof(root string, key string, value []byte, proof *MerkleProof) (bool, error) {
+	if proof == nil || len(proof.Nodes) != len(key)+1 {
+		return false, errors.New("proof does not match the key length")
+	}
+	rootCid, err := cid.Parse(root)
+	if err != nil {
+		return false, err
+	}
+
+	var childCid cid.Cid
+	for i := len(key); i >= 0; i-- {
+		pn := proof.Nodes[i]
+		data := pn.Data
+		if i == len(key) {
+			data = value
+		}
+
+		links := make(map[string]cid.Cid, len(pn.Links)+1)
+		for k, cidS := range pn.Links {
+			err := checkFieldName(k)
+			if err != nil {
+				return false, err
+			}
+			c, err := cid.Parse(cidS)
+			if err != nil {
+				return false, err
+			}
+			links[k] = c
+		}
+		if i < len(key) {
+			links[key[i:i+1]] = childCid
+		}
+
+		prefix := rootCid.Prefix()
+		if i > 0 && pn.Cid != "" {
+			c, err := cid.Parse(pn.Cid)
+			if err != nil {
+				return false, err
+			}
+			prefix = c.Prefix()
+		}
+		nc := codecs[prefix.Codec]
+		if nc == nil {
+			return false, fmt.Errorf("%w: 0x%x in %s", ErrUnsupportedCodec, prefix.Codec, pn.Cid)
+		}
+		cnode, err := encodeNode(nc, prefix.MhType, pn.Version, data, links, pn.Expires)
+		if err != nil {
+			return false, err
+		}
+		childCid = cnode.Cid()
+	}
+
+	return childCid.Equals(rootCid), nil
+}
@@ -0,0 +1,101 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// RemotePinner pins a committed block root with a remote pinning service.
+type RemotePinner interface {
+	Pin(ctx context.Context, cid string, name string) error
+}
+
+var remotePinner RemotePinner
+var remotePinStrict bool
+
+// SetRemotePinner sets the remote pinner used after each commit, replacing
+// the one configured by store.ipfs.remotepin. Passing nil disables remote
+// pinning.
+func SetRemotePinner(p RemotePinner) {
+	remotePinner = p
+}
+
+// httpPinner pins through the IPFS Pinning Service API.
+type httpPinner struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func newHTTPPinner(endpoint, token string) *httpPinner {
+	return &httpPinner{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		client:   http.DefaultClient}
+}
+
+func (p *httpPinner) Pin(ctx context.Context, cid string, name string) error {
+	body, err := json.Marshal(map[string]string{"cid": cid, "name": name})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.endpoint+"/pins", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote pin of %s failed: %s: %s", cid, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// remotePin pins a block root with the remote pinner, if any. Failures are
+// logged and only returned when store.ipfs.remotepin.strict is set.
+func remotePin(ctx context.Context, root *node, blockHash string) error {
+	if remotePinner == nil {
+		return nil
+	}
+	err := remotePinner.Pin(ctx, root.cnode.String(), blockHash)
+	if err == nil {
+		return nil
+	}
+	logger.Error("remote pin failed", "root", root.cnode.String(), "block", blockHash, "err", err)
+	if remotePinStrict {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Remote pinning", func() {
+
+	var ctx context.Context
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		SetRemotePinner(nil)
+		remotePinStrict = false
+	})
+
+	It("posts pins to the pinning service API", func() {
+		var got map[string]string
+		var auth string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.URL.Path).To(Equal("/pins"))
+			auth = r.Header.Get("Authorization")
+			failIfErr(json.NewDecoder(r.Body).Decode(&got))
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer srv.Close()
+
+		p := newHTTPPinner(srv.URL+"/", "secret")
+		failIfErr(p.Pin(ctx, "bafyroot", "block1"))
+		Expect(auth).To(Equal("Bearer secret"))
+		Expect(got).To(Equal(map[string]string{"cid": "bafyroot", "name": "block1"}))
+	})
+
+	It("reports service errors", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+		}))
+		defer srv.Close()
+
+		err := newHTTPPinner(srv.URL, "wrong").Pin(ctx, "bafyroot", "block1")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("bad token"))
+	})
+
+	It("pins the block root on commit", func() {
+		p := &testPinner{}
+		SetRemotePinner(p)
+
+		storeb := openStore(ctx)
+		root, err := storeb.Submit(ctx, &testBlock{hash: "remotepinned", number: 1})
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+		Expect(p.pinned).To(Equal([]string{root}))
+	})
+
+	It("fails the commit in strict mode", func() {
+		SetRemotePinner(&testPinner{err: errors.New("service down")})
+
+		storeb := openStore(ctx)
+		_, err := storeb.Submit(ctx, &testBlock{hash: "remotelenient", number: 1})
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+
+		remotePinStrict = true
+		storeb = openStore(ctx)
+		_, err = storeb.Submit(ctx, &testBlock{hash: "remotestrict", number: 1})
+		failIfErr(err)
+		Expect(storeb.Commit(ctx)).To(HaveOccurred())
+		failIfErr(storeb.Revert())
+	})
+})
+
+type testPinner struct {
+	pinned []string
+	err    error
+}
+
+func (p *testPinner) Pin(ctx context.Context, cid string, name string) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.pinned = append(p.pinned, cid)
+	return nil
+}
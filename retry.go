@@ -0,0 +1,77 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var maxRetries = defaultMaxRetries
+var retryBackoff = defaultRetryBackoff
+
+const (
+	defaultMaxRetries   = 2
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// retry calls op until it succeeds or returns an error that is not
+// retryable, retrying at most maxRetries times. The wait before each retry
+// starts at retryBackoff and doubles. An error returned after more than one
+// attempt is wrapped with the attempt count; an error from the first
+// attempt is returned as is, so that callers may compare it directly.
+func retry(ctx context.Context, op func(ctx context.Context) error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt > maxRetries || !isRetryable(ctx, err) {
+			if attempt > 1 {
+				return fmt.Errorf("failed after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		atomic.AddUint64(&stats.retries, 1)
+		logDebug("retrying", "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("failed after %d attempts: %w", attempt, err)
+		}
+		backoff *= 2
+	}
+}
+
+// isRetryable reports whether err may succeed on retry: a fetch that timed
+// out, a network deadline or an error that reports itself as temporary.
+// Nothing is retried once ctx is done.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, ErrFetchTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
@@ -0,0 +1,136 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// flakyBackend fails the first failures gets with err.
+type flakyBackend struct {
+	*memBackend
+	failures int
+	err      error
+	gets     int
+}
+
+func (b *flakyBackend) get(ctx context.Context, p coreiface.Path) (ipldNode, error) {
+	b.gets++
+	if b.gets <= b.failures {
+		return nil, b.err
+	}
+	return b.memBackend.get(ctx, p)
+}
+
+// blockingBackend blocks every get until its context is done.
+type blockingBackend struct {
+	*memBackend
+}
+
+func (b blockingBackend) get(ctx context.Context, p coreiface.Path) (ipldNode, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Temporary() bool { return true }
+
+var _ = Describe("Retry", func() {
+	var ctx context.Context
+	var n *node
+	var api *flakyBackend
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		maxRetries = 3
+		retryBackoff = time.Millisecond
+
+		var err error
+		n, err = makeNodeFromObj([]byte("flaky"), nil)
+		failIfErr(err)
+		api = &flakyBackend{memBackend: newMemBackend(), err: temporaryError{}}
+		failIfErr(api.put(ctx, []ipldNode{n.cnode}))
+	})
+
+	AfterEach(func() {
+		maxRetries = defaultMaxRetries
+		retryBackoff = defaultRetryBackoff
+	})
+
+	It("retries temporary errors until the get succeeds", func() {
+		api.failures = 2
+		got, err := getObj(ctx, api, n.path.String())
+		failIfErr(err)
+		Expect(got.data).To(Equal([]byte("flaky")))
+		Expect(api.gets).To(Equal(3))
+	})
+
+	It("wraps the last error with the attempt count", func() {
+		api.failures = 10
+		_, err := getObj(ctx, api, n.path.String())
+		Expect(errors.Is(err, temporaryError{})).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("4 attempts"))
+		Expect(api.gets).To(Equal(4))
+	})
+
+	Describe("store.ipfs.fetchtimeout", func() {
+		var saved time.Duration
+		var savedCache *nodeCache
+
+		BeforeEach(func() {
+			saved, savedCache = fetchTimeout, cache
+			cache = nil
+		})
+
+		AfterEach(func() {
+			fetchTimeout, cache = saved, savedCache
+		})
+
+		It("reports a fetch that exceeds it as ErrFetchTimeout", func() {
+			fetchTimeout = 10 * time.Millisecond
+			_, err := getObj(ctx, blockingBackend{api.memBackend}, n.path.String())
+			Expect(errors.Is(err, ErrFetchTimeout)).To(BeTrue())
+		})
+
+		It("returns the caller's deadline unchanged", func() {
+			fetchTimeout = time.Minute
+			tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			_, err := getObj(tctx, blockingBackend{api.memBackend}, n.path.String())
+			Expect(err).To(Equal(context.DeadlineExceeded))
+		})
+	})
+
+	It("does not retry a missing link", func() {
+		api.failures = 1
+		api.err = cbor.ErrNoSuchLink
+		_, err := getObj(ctx, api, n.path.String())
+		Expect(err).To(Equal(cbor.ErrNoSuchLink))
+		Expect(api.gets).To(Equal(1))
+	})
+})
@@ -0,0 +1,99 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// RootSigner signs committed roots. The libp2p private key of the IPFS
+// node is a RootSigner.
+type RootSigner interface {
+	Sign(data []byte) ([]byte, error)
+}
+
+// RootVerifier checks root signatures. The libp2p public key of the
+// signing node, which peers derive from its peer ID, is a RootVerifier.
+type RootVerifier interface {
+	Verify(data []byte, sig []byte) (bool, error)
+}
+
+// signedRootPrefix is prepended to the root CID before signing, so that a
+// root signature cannot be taken for a signature of anything else.
+const signedRootPrefix = "storeipfs-signed-root/1 "
+
+func signedRootMessage(root string) []byte {
+	return []byte(signedRootPrefix + root)
+}
+
+// signRoot signs the current root with s.signer and writes the signature
+// to the signature file next to the root file. It does nothing without a
+// signer or if the root is already signed. s must be locked.
+func (s *store) signRoot() error {
+	if s.signer == nil {
+		return nil
+	}
+	root := s.root.cnode.String()
+	if root == s.signedRoot {
+		return nil
+	}
+
+	sig, err := s.signer.Sign(signedRootMessage(root))
+	if err != nil {
+		return fmt.Errorf("signing root %s: %v", root, err)
+	}
+	if s.rootFile != "" {
+		content := fmt.Sprintf("%s %s\n", root, base64.StdEncoding.EncodeToString(sig))
+		err = writeFileAtomic(s.rootFile+".sig", []byte(content))
+		if err != nil {
+			return err
+		}
+	}
+	s.signedRoot = root
+	s.rootSig = sig
+	return nil
+}
+
+// GetSignedRoot returns the current root and its signature by the IPFS
+// node's private key. It returns ErrRootNotSigned unless the store was
+// opened with store.ipfs.signroots set.
+func (s *store) GetSignedRoot() (string, []byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.signer == nil || s.signedRoot != s.root.cnode.String() {
+		return "", nil, ErrRootNotSigned
+	}
+	sig := make([]byte, len(s.rootSig))
+	copy(sig, s.rootSig)
+	return s.signedRoot, sig, nil
+}
+
+// VerifySignedRoot checks that sig is a signature of root by the private
+// key of pub, as returned by GetSignedRoot. It returns ErrBadRootSignature
+// if it is not.
+func VerifySignedRoot(pub RootVerifier, root string, sig []byte) error {
+	ok, err := pub.Verify(signedRootMessage(root), sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRootSignature, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: root %s", ErrBadRootSignature, root)
+	}
+	return nil
+}
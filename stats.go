@@ -0,0 +1,71 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// StoreStats holds cumulative counters for the store.
+type StoreStats struct {
+	NodesPut           uint64        // nodes written to IPFS
+	NodesDeduped       uint64        // nodes committed that IPFS already held, see store.ipfs.dedupcheck
+	DagGets            uint64        // nodes fetched from IPFS
+	CacheHits          uint64        // node cache hits
+	CacheMisses        uint64        // node cache misses
+	Retries            uint64        // IPFS operations retried
+	LastCommitNodes    uint64        // nodes written by the last batch commit
+	LastCommitDeduped  uint64        // of LastCommitNodes, those IPFS already held
+	LastCommitDuration time.Duration // duration of the last batch commit
+}
+
+// counters are updated with atomic operations.
+type counters struct {
+	nodesPut           uint64
+	nodesDeduped       uint64
+	dagGets            uint64
+	retries            uint64
+	lastCommitNodes    uint64
+	lastCommitDeduped  uint64
+	lastCommitDuration int64
+}
+
+var stats counters
+
+// Stats returns a snapshot of the store counters. It is safe to call
+// concurrently with any other store operation.
+func (s *store) Stats() StoreStats {
+	st := StoreStats{
+		NodesPut:           atomic.LoadUint64(&stats.nodesPut),
+		NodesDeduped:       atomic.LoadUint64(&stats.nodesDeduped),
+		DagGets:            atomic.LoadUint64(&stats.dagGets),
+		Retries:            atomic.LoadUint64(&stats.retries),
+		LastCommitNodes:    atomic.LoadUint64(&stats.lastCommitNodes),
+		LastCommitDeduped:  atomic.LoadUint64(&stats.lastCommitDeduped),
+		LastCommitDuration: time.Duration(atomic.LoadInt64(&stats.lastCommitDuration))}
+	if cache != nil {
+		st.CacheHits, st.CacheMisses = cache.stats()
+	}
+	return st
+}
+
+func (c *counters) recordCommit(nodes int, deduped int, d time.Duration) {
+	atomic.StoreUint64(&c.lastCommitNodes, uint64(nodes))
+	atomic.StoreUint64(&c.lastCommitDeduped, uint64(deduped))
+	atomic.StoreInt64(&c.lastCommitDuration, int64(d))
+}
@@ -21,6 +21,15 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
 	cbor "gx/ipfs/QmSywXfm2v4Qkp4DcFqo8eehj49dJK3bdUnaLVxrdFLMQn/go-ipld-cbor"
@@ -28,22 +37,46 @@ import (
 	spec "github.com/blocktop/go-spec"
 	"github.com/ipfs/go-ipfs/core"
 	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
-	"github.com/ipfs/go-ipfs/core/coreapi/interface/options"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type store struct {
-	Root       string
-	root       *node
-	api        coreiface.CoreAPI
-	ipfs       *core.IpfsNode
-	merkleTree *merkleTreeStruct
-	storeBlock *storeBlock
-	rootFile   string
-	blockRoots map[string]*node // [blockID]rootNode
+	sync.Mutex
+	Root        string
+	root        *node
+	api         backend
+	ipfs        *core.IpfsNode
+	ownsNode    bool // ipfs is closed with the store, see InitStoreWithNode
+	readOnly    bool // mutations return ErrReadOnly, see InitStoreReadOnly
+	merkleTree  *merkleTreeStruct
+	storeBlock  *storeBlock            // most recently opened block
+	storeBlocks map[uint64]*storeBlock // [blockNumber]open block
+	rootFile    string
+	pendingDir  string            // submitted blocks are logged here, see pending.go
+	blockRoots  map[string]*node  // [blockID]rootNode
+	pinMu       sync.RWMutex      // held for writing by UnpinBlock, see pin.go
+	retained    map[string]string // [blockID]header cid
+	unpinned    map[string]bool   // [cid]header released by UnpinBlock
+	checkpoint  string            // root cid at the last Checkpoint
+	closing     bool              // CloseContext called, no new blocks
+	closed      bool              // IPFS node closed
+	drained     chan struct{}     // closed when closing and no block is open
+	subs        subscribers       // see events.go
+	ipnsKey     string            // key PublishRoot publishes under
+	autoPublish bool              // publish the root after each commit
+	publishMu   sync.Mutex        // serializes PublishRoot
+	rootPin     coreiface.Path    // root pinned recursively, see pinRoot
+	gateway     net.Listener      // see store.ipfs.gateway.addr
+	signer      RootSigner        // signs each root, see signing.go
+	signedRoot  string            // root cid signed by rootSig
+	rootSig     []byte
 }
 
+// storeMu guards assignment of the Store global on close.
+var storeMu sync.Mutex
+
 // ensure that store fulfills the interface specification
-var _ spec.Store = (*store)(nil) 
+var _ spec.Store = (*store)(nil)
 
 type blockHeader struct {
 	blockID       string
@@ -51,64 +84,405 @@ type blockHeader struct {
 	blockNumber   uint64
 }
 
-const dagBatchSize = 700
-
+// OpenBlock opens a block for writing. Blocks with different numbers may be
+// open at the same time, each with its own merkle tree batch.
 func (s *store) OpenBlock(blockNumber uint64) (spec.StoreBlock, error) {
-	if s.storeBlock != nil {
-		return nil, errors.New("a block is already open")
+	if s.readOnly {
+		return nil, ErrReadOnly
 	}
+	s.Lock()
+	defer s.Unlock()
 
-	sb, err := newstoreBlock(s.root, blockNumber)
+	if s.closing {
+		return nil, ErrStoreClosed
+	}
+	if s.storeBlocks[blockNumber] != nil {
+		return nil, fmt.Errorf("%w: block %d", ErrBlockAlreadyOpen, blockNumber)
+	}
+
+	sb, err := newstoreBlock(s, s.root, nil, blockNumber)
 	if err != nil {
 		return nil, err
 	}
+	s.storeBlocks[blockNumber] = sb
 	s.storeBlock = sb
 
 	return sb, nil
 }
 
+// OpenBlockOn opens a block for writing on top of the block parentHash
+// rather than the current root, starting from that block's merkle tree.
+// parentHash is a block hash submitted to this store or the CID of a block
+// header. Committing the block makes it the current root.
+func (s *store) OpenBlockOn(ctx context.Context, parentHash string, blockNumber uint64) (spec.StoreBlock, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	s.Lock()
+	parent := s.blockRoots[parentHash]
+	s.Unlock()
+
+	if parent == nil {
+		c, err := cid.Parse(parentHash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, parentHash)
+		}
+		parent, err = getObj(ctx, s.api, coreiface.IpldPath(c).String())
+		if err != nil {
+			return nil, err
+		}
+	}
+	merkleLink := parent.links["merkle"]
+	if merkleLink == nil {
+		return nil, fmt.Errorf("%w: %s has no merkle tree", ErrBlockNotFound, parentHash)
+	}
+	merkleRoot, err := linkTarget(ctx, s.api, merkleLink)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closing {
+		return nil, ErrStoreClosed
+	}
+	if s.storeBlocks[blockNumber] != nil {
+		return nil, fmt.Errorf("%w: block %d", ErrBlockAlreadyOpen, blockNumber)
+	}
+
+	sb, err := newstoreBlock(s, parent, merkleRoot, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	s.storeBlocks[blockNumber] = sb
+	s.storeBlock = sb
+
+	return sb, nil
+}
+
+// AppendBlock puts block on top of the current root and commits it, as
+// OpenBlock, Submit and Commit do in turn, and returns the new root. It is
+// for a linear chain: no other block may be open, and block must follow
+// the block at the current root by parent hash and block number. The first
+// block on the nil root is taken as it is. The block is reverted if it
+// fails to commit.
+func (s *store) AppendBlock(ctx context.Context, block spec.Block) (string, error) {
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+	s.Lock()
+	if s.closing {
+		s.Unlock()
+		return "", ErrStoreClosed
+	}
+	if len(s.storeBlocks) > 0 {
+		s.Unlock()
+		return "", fmt.Errorf("%w: cannot append block %d", ErrBlockAlreadyOpen, block.BlockNumber())
+	}
+	err := checkSuccessor(s.root, block)
+	if err != nil {
+		s.Unlock()
+		return "", err
+	}
+	sb, err := newstoreBlock(s, s.root, nil, block.BlockNumber())
+	if err != nil {
+		s.Unlock()
+		return "", err
+	}
+	s.storeBlocks[block.BlockNumber()] = sb
+	s.storeBlock = sb
+	s.Unlock()
+
+	_, err = sb.Submit(ctx, block)
+	if err != nil {
+		sb.Revert()
+		return "", err
+	}
+	root, err := sb.CommitRoot(ctx)
+	if err != nil {
+		sb.Revert()
+		return "", err
+	}
+	return root, nil
+}
+
+// checkSuccessor returns ErrParentMismatch if block does not name the block
+// of the header parent as its parent, and ErrBlockNotSuccessor if its number
+// does not follow. Any block follows the nil root.
+func checkSuccessor(parent *node, block spec.Block) error {
+	if parent.links["parent"] == nil {
+		return nil
+	}
+	bh, err := blockHeaderFromBytes(parent.data)
+	if err != nil {
+		return err
+	}
+	if block.ParentHash() != bh.blockID {
+		return fmt.Errorf("%w: block %s has parent %s, the root is block %s", ErrParentMismatch, block.Hash(), block.ParentHash(), bh.blockID)
+	}
+	if block.BlockNumber() != bh.blockNumber+1 {
+		return fmt.Errorf("%w: block %d on parent %d", ErrBlockNotSuccessor, block.BlockNumber(), bh.blockNumber)
+	}
+	return nil
+}
+
 func (s *store) GetBlock(ctx context.Context, blockHash string) (spec.StoreBlock, error) {
+	s.Lock()
 	rootNode := s.blockRoots[blockHash]
+	s.Unlock()
 	if rootNode == nil {
 		return nil, nil
 	}
-	bh, err := blockHeaderFromBytes(rootNode.data) 
-	if err != nil {
+	return s.readonlyBlock(ctx, rootNode)
+}
+
+// GetBlockByNumber returns the block at height blockNumber on the chain
+// ending at the current root, found by following parent links. Blocks on
+// other forks are not considered. It returns nil if the chain has not
+// reached that height.
+func (s *store) GetBlockByNumber(ctx context.Context, blockNumber uint64) (spec.StoreBlock, error) {
+	n, err := s.chainHeader(ctx, blockNumber)
+	if err != nil || n == nil {
 		return nil, err
 	}
-	parentLink := rootNode.links["parent"]
-	if parentLink.targetNode == nil {
-		pn, err := getObj(ctx, Store.api, coreiface.IpldPath(parentLink.targetCid).String())
+	return s.readonlyBlock(ctx, n)
+}
+
+// blockHeaderByHash returns the header of block blockHash from
+// s.blockRoots or, for a block committed before the store was opened, from
+// the chain ending at the current root, following parent links from the
+// root. It returns nil if neither has the block, after walking the whole
+// chain.
+func (s *store) blockHeaderByHash(ctx context.Context, blockHash string) (*node, error) {
+	s.Lock()
+	n := s.blockRoots[blockHash]
+	if n == nil {
+		n = s.root
+	}
+	s.Unlock()
+
+	for {
+		parentLink := n.links["parent"]
+		if parentLink == nil {
+			// the nil root
+			return nil, nil
+		}
+		bh, err := blockHeaderFromBytes(n.data)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("block chain broken at %s: %w", n.cnode.String(), err)
+		}
+		if bh.blockID == blockHash {
+			return n, nil
+		}
+		n, err = linkTarget(ctx, s.api, parentLink)
+		if err != nil {
+			return nil, fmt.Errorf("block chain broken at block %d: %w", bh.blockNumber, err)
+		}
+		if n == nil {
+			return nil, fmt.Errorf("block chain broken at block %d: no parent", bh.blockNumber)
 		}
-		parentLink.targetNode = pn
 	}
-	merkleLink := rootNode.links["merkle"]
-	if merkleLink.targetNode == nil {
-		mn, err := getObj(ctx, Store.api, coreiface.IpldPath(merkleLink.targetCid).String())
+}
+
+// chainHeader returns the block header at blockNumber on the chain ending
+// at the current root, or nil if the chain has not reached that height.
+func (s *store) chainHeader(ctx context.Context, blockNumber uint64) (*node, error) {
+	s.Lock()
+	n := s.root
+	s.Unlock()
+
+	for {
+		parentLink := n.links["parent"]
+		if parentLink == nil {
+			// the nil root
+			return nil, nil
+		}
+		bh, err := blockHeaderFromBytes(n.data)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("block chain broken at %s: %w", n.cnode.String(), err)
 		}
-		merkleLink.targetNode = mn
+		if bh.blockNumber == blockNumber {
+			return n, nil
+		}
+		if bh.blockNumber < blockNumber {
+			return nil, nil
+		}
+		n, err = linkTarget(ctx, s.api, parentLink)
+		if err != nil {
+			return nil, fmt.Errorf("block chain broken at block %d: %w", bh.blockNumber, err)
+		}
+		if n == nil {
+			return nil, fmt.Errorf("block chain broken at block %d: no parent", bh.blockNumber)
+		}
+	}
+}
+
+// BlockInfo describes a block in the chain.
+type BlockInfo struct {
+	Hash       string
+	Number     uint64
+	MerkleRoot string
+}
+
+// maxBlockHistory caps the number of blocks returned by BlockHistory.
+const maxBlockHistory = 1000
+
+// BlockHistory returns up to limit blocks, starting with fromHash and
+// following parent links toward the nil root. A limit of zero or more than
+// maxBlockHistory returns at most maxBlockHistory blocks.
+func (s *store) BlockHistory(ctx context.Context, fromHash string, limit int) ([]BlockInfo, error) {
+	if limit <= 0 || limit > maxBlockHistory {
+		limit = maxBlockHistory
+	}
+
+	s.Lock()
+	n := s.blockRoots[fromHash]
+	s.Unlock()
+	if n == nil {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, fromHash)
+	}
+
+	var history []BlockInfo
+	for len(history) < limit {
+		parentLink := n.links["parent"]
+		if parentLink == nil {
+			// the nil root
+			break
+		}
+		bh, err := blockHeaderFromBytes(n.data)
+		if err != nil {
+			return nil, fmt.Errorf("block chain broken at %s: %w", n.cnode.String(), err)
+		}
+		info := BlockInfo{Hash: bh.blockID, Number: bh.blockNumber}
+		if merkleLink := n.links["merkle"]; merkleLink != nil {
+			info.MerkleRoot = linkCid(merkleLink)
+		}
+		history = append(history, info)
+
+		n, err = linkTarget(ctx, s.api, parentLink)
+		if err != nil {
+			return nil, fmt.Errorf("block chain broken at block %d: %w", bh.blockNumber, err)
+		}
+		if n == nil {
+			return nil, fmt.Errorf("block chain broken at block %d: no parent", bh.blockNumber)
+		}
+	}
+	return history, nil
+}
+
+// readonlyBlock makes a read-only store block from a block header node.
+// The header may be shared with other readers, so its parent and merkle
+// root are resolved without attaching them to its links.
+func (s *store) readonlyBlock(ctx context.Context, rootNode *node) (spec.StoreBlock, error) {
+	bh, err := blockHeaderFromBytes(rootNode.data)
+	if err != nil {
+		return nil, err
 	}
-	sb := &storeBlock{}
+	parent, err := headerLinkTarget(ctx, s.api, rootNode, "parent")
+	if err != nil {
+		return nil, err
+	}
+	merkleRoot, err := headerLinkTarget(ctx, s.api, rootNode, "merkle")
+	if err != nil {
+		return nil, err
+	}
+	sb := &storeBlock{store: s}
 	sb.blockHeader = rootNode
 	sb.blockNumber = bh.blockNumber
-	sb.merkleRoot = merkleLink.targetNode
-	sb.parent = parentLink.targetNode
+	sb.merkleRoot = merkleRoot
+	sb.parent = parent
 	sb.readonly = true
 
 	return sb, nil
 }
 
+// StoreBlock returns the most recently opened block, or nil once that block
+// has been committed or reverted.
 func (s *store) StoreBlock() spec.StoreBlock {
+	s.Lock()
+	defer s.Unlock()
+	if s.storeBlock == nil {
+		return nil
+	}
 	return s.storeBlock
-} 
+}
 
+// Close closes the IPFS node without waiting for open blocks. Use
+// CloseContext to let commits in progress finish first. A node passed to
+// InitStoreWithNode is left running.
 func (s *store) Close() {
-	s.ipfs.Close()
-	Store = nil
+	s.Lock()
+	s.closing = true
+	s.Unlock()
+	s.shutdown()
+}
+
+// CloseContext refuses new blocks, waits until every open block has been
+// committed or reverted, writes the root file and closes the IPFS node. If
+// ctx is done first it returns ctx's error and the store stays open, still
+// refusing new blocks.
+func (s *store) CloseContext(ctx context.Context) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return ErrStoreClosed
+	}
+	s.closing = true
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+		if len(s.storeBlocks) == 0 {
+			close(s.drained)
+		}
+	}
+	drained := s.drained
+	s.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.Lock()
+		open := len(s.storeBlocks)
+		s.Unlock()
+		return fmt.Errorf("%d blocks still open: %w", open, ctx.Err())
+	}
+
+	s.Lock()
+	err := s.writeRootFile(ctx)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.shutdown()
+	return nil
+}
+
+// shutdown closes the IPFS node once and clears the Store global if it
+// still refers to s.
+func (s *store) shutdown() {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
+	}
+	s.closed = true
+	s.Unlock()
+
+	if s.gateway != nil {
+		s.gateway.Close()
+	}
+	if s.ipfs != nil && s.ownsNode {
+		s.ipfs.Close()
+	}
+	releaseConfig()
+
+	storeMu.Lock()
+	if Store == s {
+		Store = nil
+	}
+	storeMu.Unlock()
+	logger.Info("store closed", "root", s.Root)
 }
 
 func (s *store) GetRoot() string {
@@ -145,7 +519,152 @@ func (s *store) Get(ctx context.Context, hash string, obj spec.Marshalled) error
 	return nil
 }
 
+// getManyWorkers bounds the number of concurrent fetches of GetMany.
+const getManyWorkers = 16
+
+// GetManyError is returned by GetMany when some of the hashes could not be
+// fetched. Errs[i] is the error for hashes[i], or nil if it was fetched.
+type GetManyError struct {
+	Errs []error
+}
+
+func (e *GetManyError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d gets failed, first: %v", failed, len(e.Errs), first)
+}
+
+// GetMany is Get for each of hashes, fetching concurrently. The result has
+// one object per hash, in the same order, made by factory. An object that
+// could not be fetched is nil and its error is reported in a *GetManyError.
+func (s *store) GetMany(ctx context.Context, hashes []string, factory func() spec.Marshalled) ([]spec.Marshalled, error) {
+	objs := make([]spec.Marshalled, len(hashes))
+	errs := make([]error, len(hashes))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < getManyWorkers && w < len(hashes); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				obj := factory()
+				errs[i] = s.Get(ctx, hashes[i], obj)
+				if errs[i] == nil {
+					objs[i] = obj
+				}
+			}
+		}()
+	}
+	for i := range hashes {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return objs, &GetManyError{Errs: errs}
+		}
+	}
+	return objs, nil
+}
+
+// NodeMeta describes a stored node.
+type NodeMeta struct {
+	Cid   string   // CID of the node
+	Size  int      // size of the encoded node in bytes
+	Links []string // sorted names of the node's links
+}
+
+// GetWithMeta is Get, also returning the node's metadata.
+func (s *store) GetWithMeta(ctx context.Context, hash string, obj spec.Marshalled) (NodeMeta, error) {
+	c, err := cid.Parse(hash)
+	if err != nil {
+		return NodeMeta{}, err
+	}
+
+	n, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return NodeMeta{}, err
+	}
+
+	obj.Unmarshal(n.data, makeSpecLinks(n.links))
+
+	meta := NodeMeta{
+		Cid:   n.cnode.String(),
+		Size:  len(n.cnode.RawData()),
+		Links: make([]string, 0, len(n.links))}
+	for k := range n.links {
+		meta.Links = append(meta.Links, k)
+	}
+	sort.Strings(meta.Links)
+
+	return meta, nil
+}
+
+// GetLinks returns the links of the stored node with the given hash. A node
+// without links returns empty links.
+func (s *store) GetLinks(ctx context.Context, hash string) (spec.Links, error) {
+	c, err := cid.Parse(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return nil, err
+	}
+
+	links := makeSpecLinks(n.links)
+	if links == nil {
+		links = make(map[string]string)
+	}
+	return links, nil
+}
+
+// GetRawNode returns the encoded bytes of the stored node with the given
+// hash, for diagnosing encoding problems.
+func (s *store) GetRawNode(ctx context.Context, hash string) ([]byte, error) {
+	c, err := cid.Parse(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return nil, err
+	}
+	return n.cnode.RawData(), nil
+}
+
+// DumpNodeJSON returns the stored node with the given hash as JSON, with
+// links shown as {"/": cid}.
+func (s *store) DumpNodeJSON(ctx context.Context, hash string) ([]byte, error) {
+	c, err := cid.Parse(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return nil, err
+	}
+	return n.cnode.MarshalJSON()
+}
+
 func (s *store) Put(ctx context.Context, obj spec.Marshalled) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	data, specLinks, err := obj.Marshal()
 	if err != nil {
 		return err
@@ -162,46 +681,492 @@ func (s *store) Put(ctx context.Context, obj spec.Marshalled) error {
 }
 
 func (s *store) TreeGet(ctx context.Context, key string, obj spec.Marshalled) error {
-	if s.storeBlock != nil {
-
-	}
-	n, err := s.merkleTree.getNode(ctx, key, "", false) 
+	n, err := s.merkleTree.getNode(ctx, key, "")
 	if err != nil {
 		return err
 	}
+	if n == nil {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
 
 	obj.Unmarshal(n.data, makeSpecLinks(n.links))
 
 	return nil
 }
 
+// GetValueAtRoot returns the value at key in the merkle tree of the block
+// header rootCID, which need not be the current root. It returns nil if the
+// key is not in that tree.
+func (s *store) GetValueAtRoot(ctx context.Context, rootCID string, key string) ([]byte, error) {
+	err := checkKeyLength(key)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cid.Parse(rootCID)
+	if err != nil {
+		return nil, err
+	}
+	root, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return nil, err
+	}
+	merkleLink := root.links["merkle"]
+	if merkleLink == nil {
+		return nil, fmt.Errorf("%w: %s has no merkle tree", ErrBlockNotFound, rootCID)
+	}
+	merkleRoot, err := linkTarget(ctx, s.api, merkleLink)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getKey(ctx, s.api, merkleRoot, key)
+	if err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, nil
+	}
+	return n.data, nil
+}
+
+// GetAccountTransactions returns the hashes of the transactions in which
+// the account at address took part in role, in lexical order, as of the
+// committed tree. It skips the first offset hashes and returns at most limit
+// hashes, or all remaining hashes if limit is zero or less.
+func (s *store) GetAccountTransactions(ctx context.Context, address string, role string, offset int, limit int) ([]string, error) {
+	links, err := s.merkleTree.getLinks(ctx, "acttxn"+role+address)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(links))
+	for name := range links {
+		// single-character links are children of the trie node
+		if len(name) > 1 {
+			hashes = append(hashes, name)
+		}
+	}
+	sort.Strings(hashes)
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(hashes) {
+		offset = len(hashes)
+	}
+	hashes = hashes[offset:]
+	if limit > 0 && limit < len(hashes) {
+		hashes = hashes[:limit]
+	}
+	return hashes, nil
+}
+
+// GetTransactionBlock returns the CID of the block that included the
+// transaction txHash, as of the committed tree. It returns "" and no error
+// if the transaction is not indexed.
+func (s *store) GetTransactionBlock(ctx context.Context, txHash string) (string, error) {
+	n, err := s.merkleTree.getLink(ctx, "txnblk"+txHash, "blk")
+	if err != nil {
+		return "", err
+	}
+	if n == nil {
+		return "", nil
+	}
+	return n.cnode.String(), nil
+}
+
+// TreePutLink puts a named link at key to the existing node targetCID in
+// the most recently opened block. It returns ErrStoreNotOpen if no block is
+// open.
+func (s *store) TreePutLink(ctx context.Context, key string, linkName string, targetCID string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.Lock()
+	sb := s.storeBlock
+	s.Unlock()
+	if sb == nil {
+		return ErrStoreNotOpen
+	}
+	return sb.TreePutLink(ctx, key, linkName, targetCID)
+}
+
 func (s *store) reset() {
+	s.Lock()
+	defer s.Unlock()
 	s.storeBlock = nil
+	s.storeBlocks = make(map[uint64]*storeBlock)
+}
+
+func (s *store) closeBlock(sb *storeBlock) {
+	s.Lock()
+	defer s.Unlock()
+	if s.storeBlocks[sb.blockNumber] == sb {
+		delete(s.storeBlocks, sb.blockNumber)
+	}
+	if s.storeBlock == sb {
+		s.storeBlock = nil
+	}
+	if s.drained != nil && len(s.storeBlocks) == 0 {
+		select {
+		case <-s.drained:
+		default:
+			close(s.drained)
+		}
+	}
 }
 
 func (s *store) setRoot(ctx context.Context, root *node) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.setRootLocked(ctx, root)
+}
+
+// setRootLocked is setRoot with s locked. The current root is left as it
+// was if the root file cannot be written.
+func (s *store) setRootLocked(ctx context.Context, root *node) error {
+	prev, prevRoot := s.root, s.Root
 	s.root = root
 	s.Root = root.cnode.String()
 
 	err := s.writeRootFile(ctx)
+	if err != nil {
+		s.root, s.Root = prev, prevRoot
+		return err
+	}
+	return nil
+}
+
+// CompareAndSetRoot makes newRoot, the CID of a block header, the current
+// root if the root file still holds expectedOld. Otherwise it returns
+// ErrRootConflict, so that a writer holding a stale root does not clobber a
+// root written by another process sharing the data directory. An empty
+// expectedOld matches a missing root file. The root file is locked from
+// the read to the write, so two processes using CompareAndSetRoot cannot
+// both succeed from the same root; writers that do not use it are not
+// excluded.
+func (s *store) CompareAndSetRoot(ctx context.Context, expectedOld, newRoot string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	n, merkleRoot, err := s.loadRoot(ctx, newRoot)
+	if err != nil {
+		return err
+	}
+	var filter *bloomFilter
+	if merkleRoot != nil {
+		filter, err = s.merkleTree.filterFor(ctx, merkleRoot)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rootFile != "" {
+		unlock, err := lockRootFile(s.rootFile)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	current, err := s.readRoot()
+	if err != nil {
+		return err
+	}
+	if current != expectedOld {
+		return fmt.Errorf("%w: expected %s, found %s", ErrRootConflict, expectedOld, current)
+	}
+
+	err = s.setRootLocked(ctx, n)
 	if err != nil {
 		return err
 	}
+	if merkleRoot != nil {
+		s.merkleTree.Lock()
+		s.merkleTree.root = merkleRoot
+		if filter != nil {
+			s.merkleTree.bloom = filter
+		}
+		s.merkleTree.size = treeSize{}
+		s.merkleTree.Unlock()
+	}
 	return nil
 }
 
-func getObj(ctx context.Context, api coreiface.CoreAPI, path string) (*node, error) {
+// loadRoot fetches the block header rootCID and its merkle root, which is
+// nil if the header has no merkle link.
+func (s *store) loadRoot(ctx context.Context, rootCID string) (*node, *node, error) {
+	c, err := cid.Parse(rootCID)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return nil, nil, err
+	}
+	var merkleRoot *node
+	if merkleLink := n.links["merkle"]; merkleLink != nil {
+		merkleRoot, err = linkTarget(ctx, s.api, merkleLink)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return n, merkleRoot, nil
+}
+
+// Snapshot checkpoints the store and returns the root it wrote, which
+// RestoreFromRoot can return the store to as long as the root's nodes are
+// kept, for instance by pinning it recursively.
+func (s *store) Snapshot(ctx context.Context) (string, error) {
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.checkpointLocked(ctx)
+	if err != nil {
+		return "", err
+	}
+	return s.Root, nil
+}
+
+// RestoreFromRoot makes rootCID, the CID of a block header or a root from
+// Snapshot, the current root and its merkle tree the committed tree, as
+// InitStore does with the root file. The root and its merkle root must
+// resolve. It refuses while a block is open, since the block would commit
+// on top of the root it was opened on.
+func (s *store) RestoreFromRoot(ctx context.Context, rootCID string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	n, merkleRoot, err := s.loadRoot(ctx, rootCID)
+	if err != nil {
+		return err
+	}
+	if merkleRoot == nil {
+		return fmt.Errorf("%w: %s has no merkle tree", ErrBlockNotFound, rootCID)
+	}
+
+	filter, err := s.merkleTree.filterFor(ctx, merkleRoot)
+	if err != nil {
+		return err
+	}
+
+	// no block may open between the check and the swap
+	s.Lock()
+	defer s.Unlock()
+	if len(s.storeBlocks) > 0 {
+		return fmt.Errorf("%w: cannot restore %s", ErrBlockAlreadyOpen, rootCID)
+	}
+	if pinRecursive {
+		err = s.api.pin(ctx, n.path, true)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.setRootLocked(ctx, n)
+	if err != nil {
+		return err
+	}
+	if pinRecursive {
+		s.swapRootPin(ctx, n)
+	}
+	s.merkleTree.Lock()
+	s.merkleTree.root = merkleRoot
+	if filter != nil {
+		s.merkleTree.bloom = filter
+	}
+	s.merkleTree.size = treeSize{}
+	s.merkleTree.Unlock()
+	logger.Info("root restored", "root", rootCID)
+	return nil
+}
+
+// readRoot returns the root CID held in the root file, or "" if there is
+// none. An in-memory store has no root file and returns its current root.
+func (s *store) readRoot() (string, error) {
+	if s.rootFile == "" {
+		return s.root.cnode.String(), nil
+	}
+	b, err := ioutil.ReadFile(s.rootFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	p, err := parseRootFile(b)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrCorruptRootFile, s.rootFile, err)
+	}
+	return strings.TrimPrefix(p, "/ipld/"), nil
+}
+
+// Checkpoint puts the current root and writes it to the root file, so that
+// the latest state survives a crash or can be read by another process. It
+// does nothing if the root has not changed since the last checkpoint.
+func (s *store) Checkpoint(ctx context.Context) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.checkpointLocked(ctx)
+}
+
+// checkpointLocked is Checkpoint with s locked.
+func (s *store) checkpointLocked(ctx context.Context) error {
+	rootCid := s.root.cnode.String()
+	if rootCid == s.checkpoint {
+		return nil
+	}
+
+	err := putObj(ctx, s.api, s.root)
+	if err != nil {
+		return err
+	}
+	err = s.writeRootFile(ctx)
+	if err != nil {
+		return err
+	}
+	s.checkpoint = rootCid
+	return nil
+}
+
+// HealthCheck reports whether the store can serve reads: the IPFS node is
+// running and online if configured so, and the root and its merkle root are
+// stored. It fetches only the root, so it is cheap enough to poll.
+func (s *store) HealthCheck(ctx context.Context) error {
+	s.Lock()
+	closed := s.closed
+	root := s.root
+	s.Unlock()
+
+	if closed {
+		return fmt.Errorf("%w: the store is closed", ErrIPFSDown)
+	}
+	if s.ipfs != nil && online && !s.ipfs.IsOnline {
+		return fmt.Errorf("%w: the node is offline", ErrIPFSDown)
+	}
+
+	// bypass the node cache so that the root is read from the backend
+	_, err := s.api.get(ctx, root.path)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrRootUnresolvable, root.cnode.String(), err)
+	}
+
+	merkleLink := root.links["merkle"]
+	if merkleLink == nil {
+		return fmt.Errorf("%w: the root has no merkle link", ErrMerkleRootMissing)
+	}
+	c, err := cid.Parse(linkCid(merkleLink))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMerkleRootMissing, err)
+	}
+	ok, err := s.api.has(ctx, c)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrMerkleRootMissing, c, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMerkleRootMissing, c)
+	}
+	return nil
+}
+
+// getObj fetches the node at path, which may resolve links below a CID. A
+// path through a link that does not exist fails with cbor.ErrNoSuchLink;
+// use getObjOptional where that means a missing key.
+func getObj(ctx context.Context, api backend, path string) (*node, error) {
+	ctx, span := startTrace(ctx, "storeipfs.getObj")
+	if span == nil {
+		return fetchObj(ctx, api, path)
+	}
+	span.SetAttributes(attribute.String("ipfs.path", path))
+	n, err := fetchObj(ctx, api, path)
+	if n != nil {
+		span.SetAttributes(attribute.String("ipfs.cid", n.cnode.String()))
+	}
+	endTrace(span, err)
+	return n, err
+}
+
+// getObjOptional is getObj, returning a nil node rather than an error for
+// a path through a link that does not exist. A node that is linked but
+// cannot be fetched is still an error.
+func getObjOptional(ctx context.Context, api backend, path string) (*node, error) {
+	n, err := getObj(ctx, api, path)
+	if errors.Is(err, cbor.ErrNoSuchLink) {
+		return nil, nil
+	}
+	return n, err
+}
+
+func fetchObj(ctx context.Context, api backend, path string) (*node, error) {
 	cpath, err := coreiface.ParsePath(path)
 	if err != nil {
 		return nil, err
 	}
 
-	ipldNode, err := api.Dag().Get(ctx, cpath)
+	if cache != nil {
+		if cnode, ok := cache.get(path); ok {
+			n, err := makeNodeFromIPLD(cnode)
+			if err != nil {
+				return nil, err
+			}
+			n.fromIPFS = true
+			return n, nil
+		}
+	}
+
+	var cnode ipldNode
+	err = retry(ctx, func(ctx context.Context) error {
+		fetchCtx := ctx
+		if fetchTimeout > 0 {
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithTimeout(ctx, fetchTimeout)
+			defer cancel()
+		}
+
+		atomic.AddUint64(&stats.dagGets, 1)
+		var err error
+		cnode, err = api.get(fetchCtx, cpath)
+		if err != nil && ctx.Err() == nil && fetchCtx.Err() == context.DeadlineExceeded {
+			return ErrFetchTimeout
+		}
+		return err
+	})
+	if err != nil && ctx.Err() != nil {
+		// the caller's deadline or cancellation, not store.ipfs.fetchtimeout
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		if errors.Is(err, ErrFetchTimeout) {
+			logger.Error("fetch timed out", "path", path, "timeout", fetchTimeout)
+			return nil, err
+		}
+		if errors.Is(err, cbor.ErrNoSuchLink) {
+			// a missing key, not a failed fetch
+			return nil, err
+		}
+		logger.Error("fetch failed", "path", path, "err", err)
+		if !online {
+			return nil, fmt.Errorf("%w: %s: %v", ErrOffline, path, err)
+		}
 		return nil, err
 	}
 
-	n, err := makeNodeFromCBOR(ipldNode.(*cbor.Node))
+	if cache != nil {
+		cache.add(path, cnode)
+		cache.add(coreiface.IpldPath(cnode.Cid()).String(), cnode)
+	}
+
+	n, err := makeNodeFromIPLD(cnode)
 	if err != nil {
 		return nil, err
 	}
@@ -209,33 +1174,77 @@ func getObj(ctx context.Context, api coreiface.CoreAPI, path string) (*node, err
 	return n, nil
 }
 
-func putObj(ctx context.Context, api coreiface.CoreAPI, n *node) error {
-	path, err := api.Dag().Put(ctx, bytes.NewReader(n.cnode.RawData()), options.Dag.InputEnc("raw"))
-	if err != nil {
-		return err
+func putObj(ctx context.Context, api backend, n *node) error {
+	ctx, span := startTrace(ctx, "storeipfs.putObj")
+	if span != nil {
+		span.SetAttributes(attribute.String("ipfs.cid", n.cnode.String()))
 	}
-
-	if pin {
-		err = api.Pin().Add(ctx, path, options.Pin.Recursive(false))
+	err := retry(ctx, func(ctx context.Context) error {
+		return api.put(ctx, []ipldNode{n.cnode})
+	})
+	if err == nil {
+		atomic.AddUint64(&stats.nodesPut, 1)
+		if pin {
+			err = api.pin(ctx, n.path, false)
+		}
 	}
+	endTrace(span, err)
 	return err
 }
 
+// blockHeaderToBytes encodes the block header as the uvarint-prefixed
+// blockID and parentBlockID followed by the uvarint blockNumber.
 func blockHeaderToBytes(bh *blockHeader) ([]byte, error) {
-	buf := &bytes.Buffer{}
-	err := binary.Write(buf, binary.BigEndian, *bh)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64+len(bh.blockID)+len(bh.parentBlockID))
+	buf = appendUvarint(buf, uint64(len(bh.blockID)))
+	buf = append(buf, bh.blockID...)
+	buf = appendUvarint(buf, uint64(len(bh.parentBlockID)))
+	buf = append(buf, bh.parentBlockID...)
+	buf = appendUvarint(buf, bh.blockNumber)
+	return buf, nil
 }
 
 func blockHeaderFromBytes(b []byte) (*blockHeader, error) {
 	bh := &blockHeader{}
-	buf := bytes.NewBuffer(b)
-	err := binary.Read(buf, binary.BigEndian, bh)
+	buf := bytes.NewReader(b)
+
+	var err error
+	bh.blockID, err = readString(buf)
+	if err != nil {
+		return nil, err
+	}
+	bh.parentBlockID, err = readString(buf)
 	if err != nil {
 		return nil, err
 	}
+	bh.blockNumber, err = binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("block header: %v", err)
+	}
+	if buf.Len() != 0 {
+		return nil, fmt.Errorf("block header: %d trailing bytes", buf.Len())
+	}
 	return bh, nil
 }
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(b, tmp[:n]...)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", fmt.Errorf("block header: %v", err)
+	}
+	if l > uint64(r.Len()) {
+		return "", fmt.Errorf("block header: string length %d exceeds data", l)
+	}
+	s := make([]byte, l)
+	_, err = io.ReadFull(r, s)
+	if err != nil {
+		return "", fmt.Errorf("block header: %v", err)
+	}
+	return string(s), nil
+}
@@ -2,37 +2,56 @@ package storeipfs
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"strconv"
+	"sync"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
 
 	spec "github.com/blocktop/go-spec"
-	"github.com/ipfs/go-ipfs/core/coreapi/interface/options"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var _ spec.StoreBlock = (*storeBlock)(nil)
 
 type storeBlock struct {
+	store       *store
 	parent      *node
 	blockNumber uint64
 	merkleRoot  *node
+	tree        *merkleTreeBatch
 	batch       *batch
 	blockHeader *node
 	opened      bool
-	readonly	  bool
+	readonly    bool
+	blockHash   string
+	pinned      []coreiface.Path      // paths pinned for this block, unpinned on Revert
+	spilled     []cid.Cid             // nodes written by writeSpilled, logged by writePending
+	trees       map[string]*namedTree // named trees opened in this block
+	treesMu     sync.Mutex
 }
 
-func newstoreBlock(parent *node, blockNumber uint64) (*storeBlock, error) {
-	merkleRoot, err := Store.merkleTree.StartBatch()
+// newstoreBlock opens a block of st on parent with a merkle batch starting
+// from merkleRoot, or from the committed merkle root if merkleRoot is nil.
+func newstoreBlock(st *store, parent *node, merkleRoot *node, blockNumber uint64) (*storeBlock, error) {
+	tree, err := st.merkleTree.StartBatch(merkleRoot)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &storeBlock{
+		store:       st,
 		parent:      parent,
 		blockNumber: blockNumber,
-		merkleRoot:  merkleRoot}
+		merkleRoot:  tree.root,
+		tree:        tree,
+		opened:      true}
 
 	s.batch = &batch{}
+	if spillNodes > 0 {
+		tree.spill = s.writeSpilled
+	}
 
 	return s, nil
 }
@@ -46,15 +65,128 @@ func (s *storeBlock) IsOpen() (bool, uint64) {
 }
 
 func (s *storeBlock) Submit(ctx context.Context, block spec.Block) (string, error) {
+	ctx, span := startTrace(ctx, "storeipfs.Submit")
+	if span != nil {
+		span.SetAttributes(
+			attribute.String("block.hash", block.Hash()),
+			attribute.Int64("block.number", int64(block.BlockNumber())),
+			attribute.Int("block.transactions", len(block.Transactions())))
+	}
+	root, err := s.submit(ctx, block)
+	if span != nil && err == nil {
+		span.SetAttributes(attribute.String("ipfs.root", root))
+	}
+	endTrace(span, err)
+	return root, err
+}
+
+func (s *storeBlock) submit(ctx context.Context, block spec.Block) (string, error) {
 	if ok, _ := s.IsOpen(); !ok {
-		return "", errors.New("store is not currently open")
+		return "", ErrStoreNotOpen
 	}
 	if block.BlockNumber() != s.blockNumber {
-		return "", errors.New("store was open for a different block number")
+		return "", fmt.Errorf("%w: open for %d, got %d", ErrWrongBlockNumber, s.blockNumber, block.BlockNumber())
+	}
+	if s.blockHeader != nil {
+		// Submitting the same block again returns the same root without
+		// putting its entries a second time.
+		if block.Hash() == s.blockHash {
+			return s.blockHeader.cnode.String(), nil
+		}
+		return "", fmt.Errorf("%w: %s was submitted, got %s", ErrBlockAlreadySubmitted, s.blockHash, block.Hash())
+	}
+	if strictBlockNumbers {
+		parentNumber, err := headerBlockNumber(s.parent)
+		if err != nil {
+			return "", err
+		}
+		if block.BlockNumber() != parentNumber+1 {
+			return "", fmt.Errorf("%w: block %d on parent %d", ErrBlockNotSuccessor, block.BlockNumber(), parentNumber)
+		}
+	}
+
+	trees, err := s.makeTreesNode(ctx)
+	if err != nil {
+		return "", err
+	}
+	bhnode, err := makeBlockHeaderNode(ctx, s.tree, s.parent, trees, block)
+	if err != nil {
+		return "", err
+	}
+	err = s.writePending(ctx, bhnode)
+	if err != nil {
+		return "", err
+	}
+
+	s.blockHeader = bhnode
+	s.blockHash = block.Hash()
+
+	rootHash := bhnode.cnode.String()
+	s.store.Lock()
+	s.store.blockRoots[block.Hash()] = bhnode
+	s.store.Unlock()
+
+	return rootHash, nil
+}
+
+// PredictRoot returns the root that Submit would return for block, without
+// changing the block's merkle tree.
+func (s *storeBlock) PredictRoot(ctx context.Context, block spec.Block) (string, error) {
+	if ok, _ := s.IsOpen(); !ok {
+		return "", ErrStoreNotOpen
+	}
+	if block.BlockNumber() != s.blockNumber {
+		return "", fmt.Errorf("%w: open for %d, got %d", ErrWrongBlockNumber, s.blockNumber, block.BlockNumber())
+	}
+
+	s.tree.Lock()
+	defer s.tree.Unlock()
+	if s.tree.closed {
+		return "", ErrNotInBatch
+	}
+	scratch := &merkleTreeBatch{api: s.tree.api, root: s.tree.root, cow: true}
+
+	trees, err := s.makeTreesNode(ctx)
+	if err != nil {
+		return "", err
+	}
+	bhnode, err := makeBlockHeaderNode(ctx, scratch, s.parent, trees, block)
+	if err != nil {
+		return "", err
+	}
+	return bhnode.cnode.String(), nil
+}
+
+// VerifyBlockRoot reports whether submitting block to this store block
+// would produce claimedRoot. The tree is not changed.
+func (s *storeBlock) VerifyBlockRoot(ctx context.Context, block spec.Block, claimedRoot string) (bool, error) {
+	root, err := s.PredictRoot(ctx, block)
+	if err != nil {
+		return false, err
+	}
+	return root == claimedRoot, nil
+}
+
+// headerBlockNumber returns the block number of the block header n, or 0 for
+// the nil root.
+func headerBlockNumber(n *node) (uint64, error) {
+	if n.links["parent"] == nil {
+		return 0, nil
+	}
+	bh, err := blockHeaderFromBytes(n.data)
+	if err != nil {
+		return 0, err
 	}
+	return bh.blockNumber, nil
+}
 
+// makeBlockHeaderNode puts the block's accounts, transactions and block
+// into tree and returns the resulting block header node, linking trees, if
+// not nil, as the roots of the named trees.
+func makeBlockHeaderNode(ctx context.Context, tree *merkleTreeBatch, parent *node, trees *node, block spec.Block) (*node, error) {
 	txns := block.Transactions()
 	txnodes := make(map[string]*link, len(txns))
+	var entries []kv
 	for i, t := range txns {
 
 		parties := t.Parties()
@@ -62,47 +194,36 @@ func (s *storeBlock) Submit(ctx context.Context, block spec.Block) (string, erro
 		for role, acct := range parties {
 			anode, err := makeNodeFromAccount(acct)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			prtynodes[role] = &link{key: role, targetNode: anode}
-			err = Store.merkleTree.putLink(ctx, makeAccountKey(acct), &link{key: "acct", targetNode: anode})
-			if err != nil {
-				return "", err
-			}
+			entries = append(entries, kv{makeAccountKey(acct), &link{key: "acct", targetNode: anode}, true})
 		}
 
 		tnode, err := makeNodeFromTransaction(t)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		k := strconv.FormatInt(int64(i), 10)
 		txnodes[k] = &link{key: "txn" + k, targetNode: tnode}
 
-		err = Store.merkleTree.putLink(ctx, makeTransactionKey(t), &link{key: "txn", targetNode: tnode})
-		if err != nil {
-			return "", err
-		}
+		entries = append(entries, kv{makeTransactionKey(t), &link{key: "txn", targetNode: tnode}, true})
 		for role, acct := range parties {
-			err = Store.merkleTree.putLink(ctx, makeAccountTransactionKey(acct, role), &link{key: t.Hash(), targetNode: tnode})
-			if err != nil {
-				return "", err
-			}
+			entries = append(entries, kv{makeAccountTransactionKey(acct, role), &link{key: t.Hash(), targetNode: tnode}, true})
 		}
 	}
 
 	bnode, err := makeNodeFromBlock(block)
 	if err != nil {
-		return "", err
-	}
-	err = Store.merkleTree.putLink(ctx, makeBlockKey(block), &link{key: "blk", targetNode: bnode})
-	if err != nil {
-		return "", err
+		return nil, err
 	}
+	entries = append(entries, kv{makeBlockKey(block), &link{key: "blk", targetNode: bnode}, true})
 	for _, t := range txns {
-		err = Store.merkleTree.putLink(ctx, makeTransactionBlockKey(t), &link{key: "blk", targetNode: bnode})
-		if err != nil {
-			return "", err
-		}
+		entries = append(entries, kv{makeTransactionBlockKey(t), &link{key: "blk", targetNode: bnode}, true})
+	}
+	err = tree.putMany(ctx, entries)
+	if err != nil {
+		return nil, err
 	}
 
 	bh := &blockHeader{
@@ -112,91 +233,331 @@ func (s *storeBlock) Submit(ctx context.Context, block spec.Block) (string, erro
 
 	data, err := blockHeaderToBytes(bh)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	links := map[string]*link{
-		"parent": &link{key: "parent", targetNode: s.parent},
+		"parent": &link{key: "parent", targetNode: parent},
 		"block":  &link{key: "block", targetNode: bnode},
-		"merkle": &link{key: "merkle", targetNode: s.merkleRoot}}
+		"merkle": &link{key: "merkle", targetNode: tree.root}}
+	if trees != nil {
+		links[treesLink] = &link{key: treesLink, targetNode: trees}
+	}
 
 	bhnode, err := makeNodeFromObj(data, links)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	bhnode.changedData = true
 	bhnode.changedLinks["block"] = true
 	bhnode.changedLinks["merkle"] = true
+	if trees != nil && len(trees.changedLinks) > 0 {
+		bhnode.changedLinks[treesLink] = true
+	}
 
-	s.blockHeader = bhnode
+	return bhnode, nil
+}
 
-	rootHash := bhnode.cnode.String()
-	Store.blockRoots[block.Hash()] = bhnode
+// Commit commits the submitted block, making its header the store root.
+// It is CommitRoot without the root, for spec.StoreBlock; prefer
+// CommitRoot.
+func (s *storeBlock) Commit(ctx context.Context) error {
+	_, err := s.CommitRoot(ctx)
+	return err
+}
 
-	return rootHash, nil
+// CommitRoot commits the submitted block and returns the new store root,
+// the CID of the block header.
+func (s *storeBlock) CommitRoot(ctx context.Context) (string, error) {
+	ctx, span := startTrace(ctx, "storeipfs.Commit")
+	if span != nil {
+		span.SetAttributes(
+			attribute.String("block.hash", s.blockHash),
+			attribute.Int64("block.number", int64(s.blockNumber)))
+	}
+	err := s.commit(ctx)
+	if span != nil {
+		span.SetAttributes(attribute.Int("ipfs.nodes", s.batch.nodeCount()))
+	}
+	endTrace(span, err)
+	if err != nil {
+		return "", err
+	}
+	return s.blockHeader.cnode.String(), nil
 }
 
-func (s *storeBlock) Commit(ctx context.Context) error {
+func (s *storeBlock) commit(ctx context.Context) error {
 	if ok, _ := s.IsOpen(); !ok {
-		return errors.New("store is not currently open")
+		return ErrStoreNotOpen
 	}
 	if s.blockHeader == nil {
-		return errors.New("no block has been submitted")
+		return ErrNoBlockSubmitted
+	}
+	// checked before writing anything; CommitBatch checks again
+	if s.store.merkleTree.stale(s.tree) {
+		return ErrCommitConflict
+	}
+	for _, t := range s.trees {
+		if t.m.stale(t.b) {
+			return ErrCommitConflict
+		}
 	}
 
-	err := s.batch.commit(ctx, Store.api, s.blockHeader)
+	end := startSpan(ctx, "batchCommit")
+	err := s.batch.commit(ctx, s.store.api, s.blockHeader)
+	end()
 	if err != nil {
 		return err
 	}
 
+	if durability == durabilityFsync {
+		end = startSpan(ctx, "syncDatastore")
+		err = s.store.api.sync(ctx)
+		end()
+		if err != nil {
+			return err
+		}
+	}
+
 	if pin {
+		end = startSpan(ctx, "pinNodes")
 		err = s.pinNodes(ctx, s.batch.nodes)
+		end()
+		if err != nil {
+			return err
+		}
+		s.store.retainBlock(s.blockHash, s.blockHeader)
+	}
+
+	if pinRecursive {
+		end = startSpan(ctx, "pinRoot")
+		err = s.store.pinRoot(ctx, s.blockHeader)
+		end()
 		if err != nil {
 			return err
 		}
 	}
 
-	err = Store.merkleTree.CommitBatch()
+	end = startSpan(ctx, "remotePin")
+	err = remotePin(ctx, s.blockHeader, s.blockHash)
+	end()
 	if err != nil {
 		return err
 	}
 
-	err = Store.setRoot(ctx, s.blockHeader)
+	// The trees are committed before the root that links them. If a later
+	// tree or the root fails, the trees committed so far are rolled back,
+	// so that they stay in step with GetRoot and the commit can be retried.
+	undo, err := s.store.merkleTree.commitBatch(ctx, s.tree)
 	if err != nil {
 		return err
 	}
+	undos := []func(){undo}
+	for _, t := range s.trees {
+		undo, err = t.m.commitBatch(ctx, t.b)
+		if err != nil {
+			undoCommits(undos)
+			return err
+		}
+		undos = append(undos, undo)
+	}
 
-	Store.reset()
+	end = startSpan(ctx, "setRoot")
+	err = s.store.setRoot(ctx, s.blockHeader)
+	end()
+	if err != nil {
+		undoCommits(undos)
+		return err
+	}
+	s.store.publishAfterCommit()
+	s.store.publishCommit(CommitEvent{
+		Hash:   s.blockHash,
+		Number: s.blockNumber,
+		Root:   s.blockHeader.cnode.String()})
+
+	s.removePending()
+	s.store.closeBlock(s)
 	s.opened = false
 	return nil
 }
 
+// undoCommits calls the undo functions of tree commits in reverse order.
+func undoCommits(undos []func()) {
+	for i := len(undos) - 1; i >= 0; i-- {
+		undos[i]()
+	}
+}
+
+// PendingNodeCount returns the number of nodes that Commit would write. Before
+// Submit it counts only the changed nodes of the merkle tree.
+func (s *storeBlock) PendingNodeCount() (int, error) {
+	if ok, _ := s.IsOpen(); !ok {
+		return 0, ErrStoreNotOpen
+	}
+
+	root := s.blockHeader
+	if root == nil {
+		s.tree.Lock()
+		defer s.tree.Unlock()
+		root = s.tree.root
+	}
+
+	// nodes[0] is nil, as in batch.commit
+	nodes, err := collectChangedNodes(root, make([]*node, 1), make(map[string]int))
+	if err != nil {
+		return 0, err
+	}
+	return len(nodes) - 1, nil
+}
+
+// writeSpilled writes nodes spilled by the merkle batch during Submit, and
+// pins them if store.ipfs.pin is set. The pins are released by Revert. It
+// is called with the batch locked, which also guards s.spilled.
+func (s *storeBlock) writeSpilled(ctx context.Context, nodes []*node) error {
+	if s.store.pendingDir != "" {
+		for _, n := range nodes {
+			s.spilled = append(s.spilled, n.cnode.Cid())
+		}
+	}
+	for start := 0; start < len(nodes); start += dagBatchSize {
+		end := start + dagBatchSize
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		err := putChunk(ctx, s.store.api, nodes[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	if pin {
+		return s.pinNodes(ctx, nodes)
+	}
+	return nil
+}
+
+// pinNodes pins nodes on up to store.ipfs.commitworkers goroutines. The
+// pins are not recursive, so they can be taken in any order.
 func (s *storeBlock) pinNodes(ctx context.Context, nodes []*node) error {
-	for _, n := range nodes {
-		if n == nil {
-			continue
+	return s.pinNodesWith(ctx, nodes, commitWorkers)
+}
+
+// pinNodesWith pins nodes in chunks of store.ipfs.dagbatchsize shared among
+// workers goroutines, stopping between pins once ctx is done or a pin
+// fails. Every node pinned is added to s.pinned, even when pinning fails,
+// so that Revert releases it.
+func (s *storeBlock) pinNodesWith(ctx context.Context, nodes []*node, workers int) error {
+	s.store.pinMu.RLock()
+	defer s.store.pinMu.RUnlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	chunks := make(chan []*node)
+	errs := make(chan error, workers)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var pinnedMu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				for _, n := range chunk {
+					if n == nil {
+						continue
+					}
+					if ctx.Err() != nil {
+						return
+					}
+					err := s.store.api.pin(ctx, n.path, false)
+					if err != nil {
+						errs <- err
+						cancel()
+						return
+					}
+					pinnedMu.Lock()
+					s.pinned = append(s.pinned, n.path)
+					pinnedMu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for start := 0; start < len(nodes); start += dagBatchSize {
+		end := start + dagBatchSize
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		select {
+		case chunks <- nodes[start:end]:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
 		}
-		err := Store.api.Pin().Add(ctx, n.path, options.Pin.Recursive(false))
+	}
+	close(chunks)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	return ctx.Err()
+}
+
+func (s *storeBlock) unpinNodes(ctx context.Context) error {
+	s.store.pinMu.RLock()
+	defer s.store.pinMu.RUnlock()
+
+	for len(s.pinned) > 0 {
+		p := s.pinned[len(s.pinned)-1]
+		err := s.store.api.unpin(ctx, p)
 		if err != nil {
 			return err
 		}
+		s.pinned = s.pinned[:len(s.pinned)-1]
 	}
 	return nil
 }
 
 func (s *storeBlock) Revert() error {
 	if ok, _ := s.IsOpen(); !ok {
-		return errors.New("store is not currently open")
+		return ErrStoreNotOpen
 	}
 
-	err := Store.merkleTree.RevertBatch()
+	err := s.store.merkleTree.RevertBatch(s.tree)
 	if err != nil {
 		return err
 	}
+	for _, t := range s.trees {
+		err = t.m.RevertBatch(t.b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Release any pins taken by a commit that failed part way through.
+	err = s.unpinNodes(context.Background())
+	if err != nil {
+		logger.Error("failed to unpin reverted block", "number", s.blockNumber, "err", err)
+		return err
+	}
 
-	Store.reset()
+	if s.blockHash != "" {
+		s.store.Lock()
+		delete(s.store.blockRoots, s.blockHash)
+		s.store.Unlock()
+	}
+
+	s.removePending()
+	s.store.closeBlock(s)
 	s.opened = false
+	logger.Info("block reverted", "number", s.blockNumber, "hash", s.blockHash)
 	return nil
 }
 
@@ -207,12 +568,29 @@ func (s *storeBlock) GetRoot() string {
 	return s.blockHeader.cnode.String()
 }
 
+// TreeGet reads a key from the block's merkle tree. A read-only block
+// returned by GetBlock reads the tree as of that block.
 func (s *storeBlock) TreeGet(ctx context.Context, key string, obj spec.Marshalled) error {
-
-	n, err := Store.merkleTree.getNode(ctx, key, "", true)
+	var n *node
+	var err error
+	switch {
+	case s.readonly:
+		err = checkKeyLength(key)
+		if err != nil {
+			return err
+		}
+		n, err = getKey(ctx, s.store.api, s.merkleRoot, key)
+	case s.tree == nil:
+		return ErrStoreNotOpen
+	default:
+		n, err = s.tree.getNode(ctx, key, "")
+	}
 	if err != nil {
 		return err
 	}
+	if n == nil {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
 
 	obj.Unmarshal(n.data, makeSpecLinks(n.links))
 
@@ -230,7 +608,52 @@ func (s *storeBlock) TreePut(ctx context.Context, key string, obj spec.Marshalle
 	}
 	n, err := makeNodeFromObj(data, links)
 	if err != nil {
-		return err
+		return keyError(key, err)
+	}
+	if s.tree == nil {
+		return ErrStoreNotOpen
+	}
+	return s.tree.putNode(ctx, key, n)
+}
+
+// TreePutBatch puts every entry as TreePut would, in one pass over the
+// tree. Either all entries are put or, on error, the block's tree is left
+// unchanged.
+func (s *storeBlock) TreePutBatch(ctx context.Context, entries map[string]spec.Marshalled) error {
+	kvs := make([]kv, 0, len(entries))
+	for key, obj := range entries {
+		data, specLinks, err := obj.Marshal()
+		if err != nil {
+			return err
+		}
+		links, err := makeLinks(specLinks)
+		if err != nil {
+			return err
+		}
+		n, err := makeNodeFromObj(data, links)
+		if err != nil {
+			return keyError(key, err)
+		}
+		kvs = append(kvs, kv{key, n.data, false})
+		for _, lnk := range n.links {
+			kvs = append(kvs, kv{key, lnk, true})
+		}
+	}
+	if s.tree == nil {
+		return ErrStoreNotOpen
+	}
+	return s.tree.putManyAtomic(ctx, kvs)
+}
+
+// TreePutLink puts a named link at key to the existing node targetCID,
+// which need not be stored locally.
+func (s *storeBlock) TreePutLink(ctx context.Context, key string, linkName string, targetCID string) error {
+	c, err := cid.Parse(targetCID)
+	if err != nil {
+		return fmt.Errorf("invalid link target %q for %s: %w", targetCID, key, err)
+	}
+	if s.tree == nil {
+		return ErrStoreNotOpen
 	}
-	return Store.merkleTree.putNode(ctx, key, n)
+	return s.tree.putLink(ctx, key, &link{key: linkName, targetCid: c})
 }
@@ -0,0 +1,2275 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	spec "github.com/blocktop/go-spec"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/ipfs/go-ipfs/core"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+
+	var ctx context.Context
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	Describe("InitStoreWithConfig", func() {
+		It("returns a store without setting the global", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+			Expect(s).NotTo(BeIdenticalTo(Store))
+			Expect(s.rootFile).To(BeEmpty())
+
+			failIfErr(s.Put(ctx, &testValue{data: []byte("configured")}))
+			hash, err := s.Hash([]byte("configured"), nil)
+			failIfErr(err)
+			v := &testValue{}
+			failIfErr(s.Get(ctx, hash, v))
+			Expect(v.data).To(Equal([]byte("configured")))
+
+			err = Store.Get(ctx, hash, v)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("keeps the blocks of two stores apart", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s1, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s1.Close()
+			s2, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s2.Close()
+
+			sb1, err := s1.OpenBlock(1)
+			failIfErr(err)
+			root1, err := sb1.Submit(ctx, testBlockWithTxns("storeone", 1))
+			failIfErr(err)
+			failIfErr(sb1.Commit(ctx))
+
+			sb2, err := s2.OpenBlock(1)
+			failIfErr(err)
+			root2, err := sb2.Submit(ctx, testBlockWithTxns("storetwo", 1))
+			failIfErr(err)
+			failIfErr(sb2.Commit(ctx))
+
+			Expect(s1.GetRoot()).To(Equal(root1))
+			Expect(s2.GetRoot()).To(Equal(root2))
+			sb, err := s2.GetBlock(ctx, "storeone")
+			failIfErr(err)
+			Expect(sb).To(BeNil())
+			hash, err := s1.GetTransactionBlock(ctx, "storetwotx1")
+			failIfErr(err)
+			Expect(hash).To(BeEmpty())
+		})
+
+		It("publishes the root to IPNS after each commit", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			cfg.IPNSAutoPublish = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+
+			name, err := s.PublishRoot(ctx)
+			failIfErr(err)
+			Expect(name).To(Equal(defaultIPNSKey))
+			root, err := s.ResolveRoot(ctx, name)
+			failIfErr(err)
+			Expect(root).To(Equal(s.GetRoot()))
+
+			sb, err := s.OpenBlock(1)
+			failIfErr(err)
+			header, err := sb.Submit(ctx, testBlockWithTxns("ipns", 1))
+			failIfErr(err)
+			failIfErr(sb.Commit(ctx))
+			Eventually(func() string {
+				root, _ := s.ResolveRoot(ctx, name)
+				return root
+			}).Should(Equal(header))
+		})
+
+		It("returns the committed root from CommitRoot", func() {
+			dir, err := ioutil.TempDir("", "commitroot")
+			failIfErr(err)
+			defer os.RemoveAll(dir)
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+			s.rootFile = path.Join(dir, "root")
+
+			sb, err := s.OpenBlock(1)
+			failIfErr(err)
+			submitted, err := sb.Submit(ctx, testBlockWithTxns("commitroot", 1))
+			failIfErr(err)
+			root, err := sb.(*storeBlock).CommitRoot(ctx)
+			failIfErr(err)
+			Expect(root).To(Equal(submitted))
+			Expect(root).To(Equal(s.GetRoot()))
+
+			content, err := ioutil.ReadFile(s.rootFile)
+			failIfErr(err)
+			rootPath, err := parseRootFile(content)
+			failIfErr(err)
+			Expect(rootPath).To(Equal("/ipld/" + root))
+
+			_, err = sb.(*storeBlock).CommitRoot(ctx)
+			Expect(errors.Is(err, ErrStoreNotOpen)).To(BeTrue())
+		})
+
+		It("rolls the trees back if the root cannot be written", func() {
+			dir, err := ioutil.TempDir("", "commitfail")
+			failIfErr(err)
+			defer os.RemoveAll(dir)
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+			root := s.GetRoot()
+			merkleRoot := s.merkleTree.getRoot()
+
+			sb, err := s.OpenBlock(1)
+			failIfErr(err)
+			failIfErr(sb.(*storeBlock).tree.putValue(ctx, "failkey", []byte("kept")))
+			t, err := sb.(*storeBlock).Tree(ctx, "accounts")
+			failIfErr(err)
+			failIfErr(t.Put(ctx, "alice", []byte("10")))
+			submitted, err := sb.Submit(ctx, testBlockWithTxns("commitfail", 1))
+			failIfErr(err)
+
+			s.rootFile = path.Join(dir, "missing", "root")
+			Expect(sb.Commit(ctx)).NotTo(Succeed())
+			Expect(s.GetRoot()).To(Equal(root))
+			Expect(s.merkleTree.getRoot()).To(Equal(merkleRoot))
+			value, err := s.merkleTree.getValue(ctx, "failkey")
+			failIfErr(err)
+			Expect(value).To(BeNil())
+			Expect(sb.(*storeBlock).trees["accounts"].b.closed).To(BeFalse())
+
+			s.rootFile = path.Join(dir, "root")
+			failIfErr(sb.Commit(ctx))
+			Expect(s.GetRoot()).To(Equal(submitted))
+			value, err = s.merkleTree.getValue(ctx, "failkey")
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("kept")))
+		})
+
+		DescribeTable("commits at each store.ipfs.durability",
+			func(level string) {
+				defer func() { durability = durabilityFlush }()
+				dir, err := ioutil.TempDir("", "durability")
+				failIfErr(err)
+				defer os.RemoveAll(dir)
+				cfg := configFromViper()
+				cfg.InMemory = true
+				s, err := InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer s.Close()
+				s.rootFile = path.Join(dir, "root")
+				durability = level
+
+				root, err := s.AppendBlock(ctx, testBlockWithTxns("durability"+level, 1))
+				failIfErr(err)
+				Expect(s.readRoot()).To(Equal(root))
+			},
+			Entry("none", "none"),
+			Entry("flush", "flush"),
+			Entry("fsync", "fsync"),
+		)
+
+		It("rejects an unknown store.ipfs.durability", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			cfg.Durability = "sometimes"
+			_, err := InitStoreWithConfig(ctx, cfg)
+			Expect(err).To(MatchError(ContainSubstring("store.ipfs.durability")))
+		})
+
+		Context("with store.pendingdir", func() {
+			var cfg StoreConfig
+			var dir string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "pending")
+				failIfErr(err)
+				cfg = configFromViper()
+				cfg.InMemory = true
+				cfg.PendingDir = dir
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			// submitAndCrash submits block 1 to a new store and closes the
+			// store without committing or reverting, leaving the log as a
+			// process that stopped between Submit and Commit would.
+			submitAndCrash := func() string {
+				s, err := InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer s.Close()
+				sb, err := s.OpenBlock(1)
+				failIfErr(err)
+				failIfErr(sb.(*storeBlock).tree.putValue(ctx, "crashkey", []byte("logged")))
+				root, err := sb.Submit(ctx, testBlockWithTxns("crash", 1))
+				failIfErr(err)
+				Expect(path.Join(dir, "1.car")).To(BeAnExistingFile())
+				return root
+			}
+
+			It("recovers a block submitted before a crash and commits it", func() {
+				root := submitAndCrash()
+
+				s, err := InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer s.Close()
+				Expect(s.GetRoot()).NotTo(Equal(root))
+
+				pending := s.PendingBlocks()
+				Expect(pending).To(HaveLen(1))
+				open, number := pending[0].IsOpen()
+				Expect(open).To(BeTrue())
+				Expect(number).To(Equal(uint64(1)))
+				Expect(pending[0].GetRoot()).To(Equal(root))
+				_, err = s.OpenBlock(1)
+				Expect(errors.Is(err, ErrBlockAlreadyOpen)).To(BeTrue())
+
+				failIfErr(pending[0].Commit(ctx))
+				Expect(s.GetRoot()).To(Equal(root))
+				value, err := s.merkleTree.getValue(ctx, "crashkey")
+				failIfErr(err)
+				Expect(value).To(Equal([]byte("logged")))
+				hash, err := s.GetTransactionBlock(ctx, "crashtx1")
+				failIfErr(err)
+				Expect(hash).To(Equal("crash"))
+				Expect(path.Join(dir, "1.car")).NotTo(BeAnExistingFile())
+				Expect(s.PendingBlocks()).To(BeEmpty())
+			})
+
+			It("recovers the nodes the batch spilled before Submit", func() {
+				s, err := InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer func(n int) { spillNodes = n }(spillNodes)
+				spillNodes = 10
+				sb, err := s.OpenBlock(1)
+				failIfErr(err)
+				entries := largeEntries(200)
+				failIfErr(sb.(*storeBlock).tree.putMany(ctx, entries))
+				Expect(sb.(*storeBlock).spilled).NotTo(BeEmpty())
+				root, err := sb.Submit(ctx, testBlockWithTxns("spill", 1))
+				failIfErr(err)
+				s.Close()
+
+				s, err = InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer s.Close()
+				pending := s.PendingBlocks()
+				Expect(pending).To(HaveLen(1))
+				failIfErr(pending[0].Commit(ctx))
+				Expect(s.GetRoot()).To(Equal(root))
+				for _, e := range entries {
+					value, err := s.merkleTree.getValue(ctx, e.key)
+					failIfErr(err)
+					Expect(value).To(Equal(e.value))
+				}
+			})
+
+			It("recovers a block's filter keys, key count and named trees", func() {
+				cfg.BloomKeys = 100
+				s, err := InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				sb, err := s.OpenBlock(1)
+				failIfErr(err)
+				failIfErr(sb.(*storeBlock).tree.putValue(ctx, "crashkey", []byte("logged")))
+				t, err := sb.(*storeBlock).Tree(ctx, "accounts")
+				failIfErr(err)
+				failIfErr(t.Put(ctx, "alice", []byte("10")))
+				root, err := sb.Submit(ctx, testBlockWithTxns("crash", 1))
+				failIfErr(err)
+				s.Close()
+
+				s, err = InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer s.Close()
+				keys, _, err := s.TreeSize(ctx, false)
+				failIfErr(err)
+				pending := s.PendingBlocks()
+				Expect(pending).To(HaveLen(1))
+				Expect(pending[0].(*storeBlock).trees).To(HaveKey("accounts"))
+				failIfErr(pending[0].Commit(ctx))
+				Expect(s.GetRoot()).To(Equal(root))
+
+				Expect(s.merkleTree.mayHold("crashkey")).To(BeTrue())
+				value, err := s.merkleTree.getValue(ctx, "crashkey")
+				failIfErr(err)
+				Expect(value).To(Equal([]byte("logged")))
+				kept, _, err := s.TreeSize(ctx, false)
+				failIfErr(err)
+				exact, _, err := s.TreeSize(ctx, true)
+				failIfErr(err)
+				Expect(kept).To(Equal(exact))
+				Expect(kept).To(BeNumerically(">", keys))
+				accounts, err := s.Tree(ctx, "accounts")
+				failIfErr(err)
+				value, err = accounts.Get(ctx, "alice")
+				failIfErr(err)
+				Expect(value).To(Equal([]byte("10")))
+			})
+
+			It("drops the log of a block committed before the crash", func() {
+				s, err := InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer s.Close()
+				sb, err := s.OpenBlock(1)
+				failIfErr(err)
+				_, err = sb.Submit(ctx, testBlockWithTxns("logged", 1))
+				failIfErr(err)
+				log, err := ioutil.ReadFile(path.Join(dir, "1.car"))
+				failIfErr(err)
+				failIfErr(sb.Commit(ctx))
+				sb, err = s.OpenBlock(2)
+				failIfErr(err)
+				_, err = sb.Submit(ctx, &testBlock{hash: "logged2", parentHash: "logged", number: 2})
+				failIfErr(err)
+				failIfErr(sb.Commit(ctx))
+
+				// a log left behind for a block that is now an ancestor
+				// of the root, whether or not the store has its header
+				for _, forget := range []bool{false, true} {
+					failIfErr(ioutil.WriteFile(path.Join(dir, "1.car"), log, 0644))
+					if forget {
+						s.Lock()
+						delete(s.blockRoots, "logged")
+						s.Unlock()
+					}
+					failIfErr(s.recoverPending(ctx))
+					Expect(s.PendingBlocks()).To(BeEmpty())
+					Expect(path.Join(dir, "1.car")).NotTo(BeAnExistingFile())
+				}
+			})
+
+			It("rolls back a recovered block with Revert", func() {
+				submitAndCrash()
+
+				s, err := InitStoreWithConfig(ctx, cfg)
+				failIfErr(err)
+				defer s.Close()
+				root := s.GetRoot()
+
+				pending := s.PendingBlocks()
+				Expect(pending).To(HaveLen(1))
+				failIfErr(pending[0].Revert())
+				Expect(s.GetRoot()).To(Equal(root))
+				Expect(path.Join(dir, "1.car")).NotTo(BeAnExistingFile())
+
+				sb, err := s.OpenBlock(1)
+				failIfErr(err)
+				failIfErr(sb.Revert())
+			})
+		})
+
+		It("keeps committed nodes through GC with store.ipfs.pinrecursive", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			defer func(p bool) { pinRecursive = p }(pinRecursive)
+			pinRecursive = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+
+			for i, hash := range []string{"recursive1", "recursive2"} {
+				sb, err := s.OpenBlock(uint64(i + 1))
+				failIfErr(err)
+				failIfErr(sb.(*storeBlock).tree.putValue(ctx, hash, []byte("kept")))
+				_, err = sb.Submit(ctx, testBlockWithTxns(hash, uint64(i+1)))
+				failIfErr(err)
+				failIfErr(sb.Commit(ctx))
+			}
+			orphan, err := makeNodeFromObj([]byte("orphan"), nil)
+			failIfErr(err)
+			failIfErr(putObj(ctx, s.api, orphan))
+
+			mem := s.api.(*memBackend)
+			rootPins := map[string]bool{s.root.cnode.Cid().KeyString(): true}
+			Expect(mem.pins).To(Equal(rootPins))
+			freed, err := s.GC(ctx)
+			failIfErr(err)
+			Expect(freed).To(BeNumerically(">", 0))
+			Expect(mem.pins).To(Equal(rootPins))
+
+			for _, hash := range []string{"recursive1", "recursive2"} {
+				value, err := s.merkleTree.getValue(ctx, hash)
+				failIfErr(err)
+				Expect(value).To(Equal([]byte("kept")))
+			}
+			ok, err := mem.has(ctx, orphan.cnode.Cid())
+			failIfErr(err)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("rejects settings that differ from those of an open store", func() {
+			if Store == nil {
+				initialize(ctx)
+			}
+			cfg := configFromViper()
+			cfg.InMemory = true
+			cfg.MaxKeyLength = maxKeyLength + 1
+			_, err := InitStoreWithConfig(ctx, cfg)
+			Expect(errors.Is(err, ErrConfigConflict)).To(BeTrue())
+			Expect(maxKeyLength).To(Equal(configFromViper().MaxKeyLength))
+
+			cfg.MaxKeyLength = maxKeyLength
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			s.Close()
+		})
+
+		It("rejects invalid settings", func() {
+			cfg := DefaultStoreConfig()
+			cfg.InMemory = true
+			cfg.DagBatchSize = 0
+			_, err := InitStoreWithConfig(ctx, cfg)
+			Expect(err).To(MatchError(ContainSubstring("dagbatchsize")))
+		})
+	})
+
+	Describe("InitStoreWithNode", func() {
+		It("uses a node it did not create and leaves it running", func() {
+			node, err := core.NewNode(ctx, &core.BuildCfg{NilRepo: true})
+			failIfErr(err)
+			defer node.Close()
+
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithNode(ctx, node, cfg)
+			failIfErr(err)
+			_, err = s.AppendBlock(ctx, testBlockWithTxns("withnode1", 1))
+			failIfErr(err)
+			s.Close()
+
+			// the node is still running, so a second store can write to it
+			s, err = InitStoreWithNode(ctx, node, cfg)
+			failIfErr(err)
+			defer s.Close()
+			root, err := s.AppendBlock(ctx, testBlockWithTxns("withnode2", 1))
+			failIfErr(err)
+			c, err := cid.Decode(root)
+			failIfErr(err)
+			has, err := node.Blockstore.Has(c)
+			failIfErr(err)
+			Expect(has).To(BeTrue())
+		})
+
+		It("requires a node", func() {
+			_, err := InitStoreWithNode(ctx, nil, configFromViper())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("gateway", func() {
+		It("serves the root over HTTP", func() {
+			node, err := core.NewNode(ctx, &core.BuildCfg{NilRepo: true})
+			failIfErr(err)
+			defer node.Close()
+
+			cfg := configFromViper()
+			cfg.InMemory = true
+			cfg.GatewayAddr = "127.0.0.1:0"
+			s, err := InitStoreWithNode(ctx, node, cfg)
+			failIfErr(err)
+			_, err = s.AppendBlock(ctx, testBlockWithTxns("gateway1", 1))
+			failIfErr(err)
+			url := "http://" + s.GatewayAddr() + "/ipfs/"
+
+			resp, err := http.Get(url + s.GetRoot())
+			failIfErr(err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			failIfErr(err)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/cbor"))
+			Expect(body).To(Equal(s.root.cnode.RawData()))
+
+			resp, err = http.Get(url + s.GetRoot() + "/nosuchlink")
+			failIfErr(err)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+			s.Close()
+			_, err = http.Get(url + s.GetRoot())
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("requires an IPFS node", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			cfg.GatewayAddr = "127.0.0.1:0"
+			_, err := InitStoreWithConfig(ctx, cfg)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("read-only", func() {
+		var node *core.IpfsNode
+		var dir string
+		var ro *store
+
+		BeforeEach(func() {
+			var err error
+			node, err = core.NewNode(ctx, &core.BuildCfg{NilRepo: true})
+			failIfErr(err)
+			dir, err = ioutil.TempDir("", "readonly")
+			failIfErr(err)
+
+			cfg := configFromViper()
+			cfg.InMemory = false
+			cfg.DataDir = dir
+			w, err := InitStoreWithNode(ctx, node, cfg)
+			failIfErr(err)
+			sb, err := w.OpenBlock(1)
+			failIfErr(err)
+			failIfErr(sb.(*storeBlock).tree.putValue(ctx, "readonlykey", []byte("value")))
+			_, err = sb.Submit(ctx, testBlockWithTxns("readonly", 1))
+			failIfErr(err)
+			failIfErr(sb.Commit(ctx))
+			w.Close()
+
+			cfg.ReadOnly = true
+			ro, err = InitStoreWithNode(ctx, node, cfg)
+			failIfErr(err)
+		})
+
+		AfterEach(func() {
+			ro.Close()
+			node.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("serves reads", func() {
+			root, err := ro.readRoot()
+			failIfErr(err)
+			Expect(ro.GetRoot()).To(Equal(root))
+
+			v := &testValue{}
+			failIfErr(ro.TreeGet(ctx, "readonlykey", v))
+			Expect(v.data).To(Equal([]byte("value")))
+			sb, err := ro.GetBlockByNumber(ctx, 1)
+			failIfErr(err)
+			Expect(sb).NotTo(BeNil())
+		})
+
+		It("returns ErrReadOnly from every mutation and keeps the root file", func() {
+			rootFile, err := ioutil.ReadFile(ro.rootFile)
+			failIfErr(err)
+			root := ro.GetRoot()
+
+			_, err = ro.OpenBlock(2)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			_, err = ro.OpenBlockOn(ctx, "readonly", 2)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			block := testBlockWithTxns("readonly2", 2)
+			block.parentHash = "readonly"
+			_, err = ro.AppendBlock(ctx, block)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			err = ro.Put(ctx, &testValue{data: []byte("put")})
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			_, err = ro.PutReader(ctx, strings.NewReader("put"), nil)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			_, err = ro.ImportCAR(ctx, strings.NewReader(""))
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			err = ro.TreePutLink(ctx, "readonlykey", "link", root)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			err = ro.CompareAndSetRoot(ctx, root, NilStoreRoot)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			err = ro.RestoreFromRoot(ctx, NilStoreRoot)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			_, err = ro.Snapshot(ctx)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			err = ro.Checkpoint(ctx)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			_, err = ro.Compact(ctx)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			_, err = ro.GC(ctx)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+			err = ro.setRoot(ctx, ro.root)
+			Expect(errors.Is(err, ErrReadOnly)).To(BeTrue())
+
+			// reading a tree that was never written puts nothing
+			api := ro.api
+			ro.api = noPutBackend{api}
+			tree, err := ro.Tree(ctx, "unwritten")
+			failIfErr(err)
+			Expect(tree.Get(ctx, "key")).To(BeNil())
+			sb, err := ro.GetBlockByNumber(ctx, 1)
+			failIfErr(err)
+			blockTree, err := sb.(*storeBlock).Tree(ctx, "unwritten")
+			failIfErr(err)
+			Expect(blockTree.Has(ctx, "key")).To(BeFalse())
+			ro.api = api
+
+			failIfErr(ro.CloseContext(ctx))
+			Expect(ro.GetRoot()).To(Equal(root))
+			after, err := ioutil.ReadFile(ro.rootFile)
+			failIfErr(err)
+			Expect(after).To(Equal(rootFile))
+		})
+	})
+
+	Describe("revert", func() {
+		It("forgets a submitted block", func() {
+			storeb := openStore(ctx)
+			block := &testBlock{hash: "revertblock", number: 1}
+
+			_, err := storeb.Submit(ctx, block)
+			failIfErr(err)
+			failIfErr(storeb.Revert())
+
+			sb, err := Store.GetBlock(ctx, block.Hash())
+			failIfErr(err)
+			Expect(sb).To(BeNil())
+			Expect(storeb.pinned).To(BeEmpty())
+		})
+
+		It("logs the reverted block", func() {
+			l := &testLogger{}
+			SetLogger(l)
+			defer SetLogger(nil)
+
+			storeb := openStore(ctx)
+			failIfErr(storeb.Revert())
+
+			Expect(l.infos).To(ContainElement("block reverted"))
+		})
+	})
+
+	Describe("Submit", func() {
+		It("returns the same root when the block is submitted again", func() {
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+			block := testBlockWithTxns("resubmit", 1)
+
+			root, err := storeb.Submit(ctx, block)
+			failIfErr(err)
+			count, err := storeb.PendingNodeCount()
+			failIfErr(err)
+
+			again, err := storeb.Submit(ctx, block)
+			failIfErr(err)
+			Expect(again).To(Equal(root))
+			after, err := storeb.PendingNodeCount()
+			failIfErr(err)
+			Expect(after).To(Equal(count))
+		})
+
+		It("rejects a different block", func() {
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+
+			root, err := storeb.Submit(ctx, testBlockWithTxns("submitfirst", 1))
+			failIfErr(err)
+			_, err = storeb.Submit(ctx, testBlockWithTxns("submitsecond", 1))
+			Expect(errors.Is(err, ErrBlockAlreadySubmitted)).To(BeTrue())
+			Expect(storeb.GetRoot()).To(Equal(root))
+
+			sb, err := Store.GetBlock(ctx, "submitsecond")
+			failIfErr(err)
+			Expect(sb).To(BeNil())
+		})
+
+		Describe("with store.strictblocknumbers", func() {
+			DescribeTable("checks the block number against the parent",
+				func(number uint64, ok bool) {
+					Store.reset()
+					headers := commitChain(ctx, fmt.Sprintf("strict%d", number), 2)
+					strictBlockNumbers = true
+					defer func() { strictBlockNumbers = false }()
+
+					sb, err := Store.OpenBlockOn(ctx, headers[1], number)
+					failIfErr(err)
+					defer sb.Revert()
+
+					_, err = sb.Submit(ctx, &testBlock{hash: fmt.Sprintf("strictnext%d", number), number: number})
+					if ok {
+						failIfErr(err)
+					} else {
+						Expect(errors.Is(err, ErrBlockNotSuccessor)).To(BeTrue())
+					}
+				},
+				Entry("the successor", uint64(3), true),
+				Entry("a gap", uint64(5), false),
+				Entry("a regression", uint64(1), false))
+		})
+	})
+
+	Describe("SubscribeCommits", func() {
+		It("delivers committed blocks in order", func() {
+			events := Store.SubscribeCommits()
+			other := Store.SubscribeCommits()
+			Store.Unsubscribe(other)
+			Expect(other).To(BeClosed())
+
+			openStore(ctx)
+			headers := commitChain(ctx, "subscribe", 2)
+			Store.Unsubscribe(events)
+
+			var received []CommitEvent
+			for e := range events {
+				received = append(received, e)
+			}
+			Expect(received).To(Equal([]CommitEvent{
+				{Hash: "subscribe1", Number: 1, Root: headers[0]},
+				{Hash: "subscribe2", Number: 2, Root: headers[1]}}))
+		})
+	})
+
+	Describe("GetBlock", func() {
+		It("reads a historical block's tree", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.TreePut(ctx, "histkey", &testValue{data: []byte("old")}))
+			_, err := storeb.Submit(ctx, &testBlock{hash: "hist1", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			sb, err := Store.OpenBlock(2)
+			failIfErr(err)
+			failIfErr(sb.TreePut(ctx, "histkey", &testValue{data: []byte("new")}))
+			_, err = sb.Submit(ctx, &testBlock{hash: "hist2", parentHash: "hist1", number: 2})
+			failIfErr(err)
+			failIfErr(sb.Commit(ctx))
+
+			old, err := Store.GetBlock(ctx, "hist1")
+			failIfErr(err)
+			v := &testValue{}
+			failIfErr(old.TreeGet(ctx, "histkey", v))
+			Expect(string(v.data)).To(Equal("old"))
+
+			err = old.TreeGet(ctx, "histmissing", v)
+			Expect(errors.Is(err, ErrKeyNotFound)).To(BeTrue())
+			// reads leave the block's tree as it was loaded
+			Expect(old.(*storeBlock).merkleRoot.links["h"].targetNode).To(BeNil())
+
+			// as does opening a block on a header other readers share
+			header, err := getObj(ctx, Store.api, Store.root.path.String())
+			failIfErr(err)
+			block, err := Store.readonlyBlock(ctx, header)
+			failIfErr(err)
+			Expect(block.(*storeBlock).merkleRoot).NotTo(BeNil())
+			Expect(block.(*storeBlock).parent).NotTo(BeNil())
+			Expect(header.links["merkle"].targetNode).To(BeNil())
+			Expect(header.links["parent"].targetNode).To(BeNil())
+		})
+	})
+
+	Describe("OpenBlockOn", func() {
+		It("commits a competing branch from an older block", func() {
+			Store.reset()
+			headers := commitChain(ctx, "fork", 2)
+
+			sb, err := Store.OpenBlock(3)
+			failIfErr(err)
+			failIfErr(sb.TreePut(ctx, "forkkey", &testValue{data: []byte("main")}))
+			_, err = sb.Submit(ctx, &testBlock{hash: "fork3", parentHash: "fork2", number: 3})
+			failIfErr(err)
+			failIfErr(sb.Commit(ctx))
+
+			sb, err = Store.OpenBlockOn(ctx, "fork1", 2)
+			failIfErr(err)
+			v := &testValue{}
+			err = sb.TreeGet(ctx, "forkkey", v)
+			Expect(errors.Is(err, ErrKeyNotFound)).To(BeTrue())
+			failIfErr(sb.TreePut(ctx, "forkkey", &testValue{data: []byte("fork")}))
+			root, err := sb.Submit(ctx, &testBlock{hash: "fork2b", parentHash: "fork1", number: 2})
+			failIfErr(err)
+			failIfErr(sb.Commit(ctx))
+
+			Expect(Store.GetRoot()).To(Equal(root))
+			Expect(sb.(*storeBlock).parent.cnode.String()).To(Equal(headers[0]))
+			failIfErr(Store.TreeGet(ctx, "forkkey", v))
+			Expect(string(v.data)).To(Equal("fork"))
+
+			history, err := Store.BlockHistory(ctx, "fork2b", 2)
+			failIfErr(err)
+			Expect(history[1].Hash).To(Equal("fork1"))
+		})
+	})
+
+	Describe("GetBlockByNumber", func() {
+		It("finds a block on the current chain", func() {
+			Store.reset()
+			headers := commitChain(ctx, "bynumber", 3)
+
+			sb, err := Store.GetBlockByNumber(ctx, 2)
+			failIfErr(err)
+			Expect(sb.GetRoot()).To(Equal(headers[1]))
+
+			sb, err = Store.GetBlockByNumber(ctx, 4)
+			failIfErr(err)
+			Expect(sb).To(BeNil())
+		})
+	})
+
+	Describe("BlockHistory", func() {
+		It("walks the parent chain newest first", func() {
+			Store.reset()
+			commitChain(ctx, "history", 5)
+
+			history, err := Store.BlockHistory(ctx, "history5", 5)
+			failIfErr(err)
+			Expect(history).To(HaveLen(5))
+			for i, info := range history {
+				Expect(info.Hash).To(Equal(fmt.Sprintf("history%d", 5-i)))
+				Expect(info.Number).To(Equal(uint64(5 - i)))
+				Expect(info.MerkleRoot).NotTo(BeEmpty())
+			}
+
+			history, err = Store.BlockHistory(ctx, "history3", 2)
+			failIfErr(err)
+			Expect(history).To(HaveLen(2))
+			Expect(history[1].Hash).To(Equal("history2"))
+		})
+	})
+
+	Describe("offline", func() {
+		It("fails cleanly for nodes that are not stored locally", func() {
+			cnode, err := wrapObj([]byte("never put"), nil)
+			failIfErr(err)
+
+			_, err = getObj(ctx, Store.api, coreiface.IpldPath(cnode.Cid()).String())
+			Expect(errors.Is(err, ErrOffline)).To(BeTrue())
+		})
+	})
+
+	Describe("GetMany", func() {
+		It("returns objects in order with an error for each missing hash", func() {
+			var hashes []string
+			for _, v := range []string{"many1", "many2"} {
+				failIfErr(Store.Put(ctx, &testValue{data: []byte(v)}))
+				h, err := Store.Hash([]byte(v), nil)
+				failIfErr(err)
+				hashes = append(hashes, h)
+			}
+			missing, err := Store.Hash([]byte("never stored"), nil)
+			failIfErr(err)
+			hashes = []string{hashes[0], missing, hashes[1], "not-a-cid"}
+
+			objs, err := Store.GetMany(ctx, hashes, func() spec.Marshalled { return &testValue{} })
+			var manyErr *GetManyError
+			Expect(errors.As(err, &manyErr)).To(BeTrue())
+			Expect(objs).To(HaveLen(4))
+			Expect(objs[0].(*testValue).data).To(Equal([]byte("many1")))
+			Expect(objs[2].(*testValue).data).To(Equal([]byte("many2")))
+			Expect(objs[1]).To(BeNil())
+			Expect(objs[3]).To(BeNil())
+			Expect(manyErr.Errs[0]).NotTo(HaveOccurred())
+			Expect(manyErr.Errs[1]).To(HaveOccurred())
+			Expect(manyErr.Errs[2]).NotTo(HaveOccurred())
+			Expect(manyErr.Errs[3]).To(HaveOccurred())
+		})
+	})
+
+	Describe("GetWithMeta", func() {
+		It("returns the node CID, size and link names", func() {
+			storeb := openStore(ctx)
+			root, err := storeb.Submit(ctx, &testBlock{hash: "meta", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			v := &testValue{}
+			meta, err := Store.GetWithMeta(ctx, root, v)
+			failIfErr(err)
+			Expect(meta.Cid).To(Equal(root))
+			Expect(meta.Size).To(Equal(len(storeb.blockHeader.cnode.RawData())))
+			Expect(meta.Links).To(Equal([]string{"block", "merkle", "parent"}))
+			Expect(v.data).To(Equal(storeb.blockHeader.data))
+		})
+	})
+
+	Describe("GetRawNode", func() {
+		It("returns the encoded bytes and JSON of value and link-only nodes", func() {
+			value, err := makeNodeFromObj([]byte("rawvalue"), nil)
+			failIfErr(err)
+			linkOnly, err := makeNodeFromObj(nil, map[string]*link{"target": {key: "target", targetNode: value}})
+			failIfErr(err)
+			failIfErr(putObj(ctx, Store.api, value))
+			failIfErr(putObj(ctx, Store.api, linkOnly))
+
+			for _, n := range []*node{value, linkOnly} {
+				raw, err := Store.GetRawNode(ctx, n.cnode.String())
+				failIfErr(err)
+				Expect(raw).To(Equal(n.cnode.RawData()))
+
+				sum, err := n.cnode.Cid().Prefix().Sum(raw)
+				failIfErr(err)
+				Expect(sum.Equals(n.cnode.Cid())).To(BeTrue())
+			}
+
+			js, err := Store.DumpNodeJSON(ctx, linkOnly.cnode.String())
+			failIfErr(err)
+			var obj map[string]interface{}
+			failIfErr(json.Unmarshal(js, &obj))
+			Expect(obj["target"]).To(Equal(map[string]interface{}{"/": value.cnode.String()}))
+		})
+	})
+
+	Describe("GetLinks", func() {
+		It("returns the links of a block header", func() {
+			storeb := openStore(ctx)
+			root, err := storeb.Submit(ctx, &testBlock{hash: "links", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			links, err := Store.GetLinks(ctx, root)
+			failIfErr(err)
+			Expect(links).To(HaveLen(3))
+			Expect(links["parent"]).To(Equal(storeb.parent.cnode.String()))
+			Expect(links["merkle"]).To(Equal(storeb.tree.root.cnode.String()))
+			Expect(links).To(HaveKey("block"))
+
+			blockLinks, err := Store.GetLinks(ctx, links["block"])
+			failIfErr(err)
+			Expect(blockLinks).NotTo(BeNil())
+			Expect(blockLinks).To(BeEmpty())
+		})
+	})
+
+	Describe("PredictRoot", func() {
+		It("predicts the submitted root without changing the tree", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "predictkey", []byte("predicted")))
+			before := storeb.tree.getRoot()
+
+			block := testBlockWithTxns("predict", 1)
+			predicted, err := storeb.PredictRoot(ctx, block)
+			failIfErr(err)
+			Expect(storeb.tree.getRoot()).To(Equal(before))
+			has, err := storeb.tree.has(ctx, makeBlockKey(block))
+			failIfErr(err)
+			Expect(has).To(BeFalse())
+
+			root, err := storeb.Submit(ctx, block)
+			failIfErr(err)
+			Expect(predicted).To(Equal(root))
+			failIfErr(storeb.Revert())
+		})
+	})
+
+	Describe("VerifyBlockRoot", func() {
+		It("detects a tampered transaction", func() {
+			proposer := openStore(ctx)
+			claimed, err := proposer.Submit(ctx, testBlockWithTxns("verify", 1))
+			failIfErr(err)
+			failIfErr(proposer.Revert())
+
+			validator := openStore(ctx)
+			ok, err := validator.VerifyBlockRoot(ctx, testBlockWithTxns("verify", 1), claimed)
+			failIfErr(err)
+			Expect(ok).To(BeTrue())
+
+			tampered := testBlockWithTxns("verify", 1)
+			tampered.txns[1].(*testTransaction).parties["to"] = &testAccount{address: "mallory"}
+			ok, err = validator.VerifyBlockRoot(ctx, tampered, claimed)
+			failIfErr(err)
+			Expect(ok).To(BeFalse())
+			failIfErr(validator.Revert())
+		})
+	})
+
+	Describe("Checkpoint", func() {
+		It("persists the current root", func() {
+			storeb := openStore(ctx)
+			_, err := storeb.Submit(ctx, &testBlock{hash: "checkpoint", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			failIfErr(Store.Checkpoint(ctx))
+			prev, err := Store.getPreviousRoot(ctx)
+			failIfErr(err)
+			Expect(prev.cnode.String()).To(Equal(Store.GetRoot()))
+
+			put := Store.Stats().NodesPut
+			failIfErr(Store.Checkpoint(ctx))
+			Expect(Store.Stats().NodesPut).To(Equal(put))
+		})
+	})
+
+	Describe("HealthCheck", func() {
+		It("passes for an initialized store", func() {
+			failIfErr(Store.HealthCheck(ctx))
+		})
+
+		It("reports an unresolvable root and a missing merkle root", func() {
+			mem := newMemBackend()
+			merkle, err := makeNodeFromObj([]byte("tree"), nil)
+			failIfErr(err)
+			root, err := makeNodeFromObj([]byte("root"), map[string]*link{"merkle": {key: "merkle", targetNode: merkle}})
+			failIfErr(err)
+			s := &store{api: mem, root: root}
+
+			err = s.HealthCheck(ctx)
+			Expect(errors.Is(err, ErrRootUnresolvable)).To(BeTrue())
+
+			failIfErr(putObj(ctx, mem, root))
+			err = s.HealthCheck(ctx)
+			Expect(errors.Is(err, ErrMerkleRootMissing)).To(BeTrue())
+
+			failIfErr(putObj(ctx, mem, merkle))
+			failIfErr(s.HealthCheck(ctx))
+		})
+	})
+
+	Describe("Peers", func() {
+		It("returns the local peer of an offline node", func() {
+			peers, err := Store.Peers(ctx)
+			failIfErr(err)
+			Expect(peers).NotTo(BeEmpty())
+			Expect(peers[0].Self).To(BeTrue())
+			Expect(peers[0].ID).To(Equal(Store.ipfs.Identity.Pretty()))
+		})
+
+		It("fails without an IPFS node", func() {
+			_, err := (&store{api: newMemBackend()}).Peers(ctx)
+			Expect(errors.Is(err, ErrIPFSDown)).To(BeTrue())
+		})
+	})
+
+	Describe("VerifyTree", func() {
+		It("finds no problems in the committed store", func() {
+			commitChain(ctx, "verify", 2)
+			problems, err := Store.VerifyTree(ctx, false)
+			failIfErr(err)
+			Expect(problems).To(BeEmpty())
+		})
+
+		It("reports dangling child links", func() {
+			mem := newMemBackend()
+			lost1, err := makeNodeFromObj([]byte("never flushed"), nil)
+			failIfErr(err)
+			lost2, err := makeNodeFromObj([]byte("also never flushed"), nil)
+			failIfErr(err)
+			a, err := makeNodeFromObj([]byte("a"), map[string]*link{"b": {key: "b", targetNode: lost1}})
+			failIfErr(err)
+			merkle, err := makeNodeFromObj([]byte("tree"), map[string]*link{
+				"a": {key: "a", targetNode: a},
+				"c": {key: "c", targetNode: lost2}})
+			failIfErr(err)
+			root, err := makeNodeFromObj([]byte("root"), map[string]*link{"merkle": {key: "merkle", targetNode: merkle}})
+			failIfErr(err)
+			for _, n := range []*node{a, merkle, root} {
+				failIfErr(putObj(ctx, mem, n))
+			}
+			s := &store{api: mem, root: root}
+
+			problems, err := s.VerifyTree(ctx, false)
+			failIfErr(err)
+			Expect(problems).To(ConsistOf(
+				ContainSubstring("root/merkle/a/b: dangling link to "+lost1.cnode.String()),
+				ContainSubstring("root/merkle/c: dangling link to "+lost2.cnode.String())))
+
+			problems, err = s.VerifyTree(ctx, true)
+			failIfErr(err)
+			Expect(problems).To(HaveLen(1))
+		})
+	})
+
+	Describe("WalkDAG", func() {
+		var s *store
+		var top *node
+		BeforeEach(func() {
+			mem := newMemBackend()
+			a, err := makeNodeFromObj([]byte("a"), nil)
+			failIfErr(err)
+			b, err := makeNodeFromObj([]byte("b"), nil)
+			failIfErr(err)
+			mid, err := makeNodeFromObj([]byte("mid"), map[string]*link{
+				"a": {key: "a", targetNode: a},
+				"b": {key: "b", targetNode: b}})
+			failIfErr(err)
+			top, err = makeNodeFromObj([]byte("top"), map[string]*link{
+				"mid":    {key: "mid", targetNode: mid},
+				"shared": {key: "shared", targetNode: a}})
+			failIfErr(err)
+			for _, n := range []*node{a, b, mid, top} {
+				failIfErr(putObj(ctx, mem, n))
+			}
+			s = &store{api: mem}
+		})
+
+		It("visits each node of a DAG once", func() {
+			visited := make(map[string]int)
+			err := s.WalkDAG(ctx, top.cnode.String(), func(c string, raw []byte) error {
+				visited[c]++
+				return nil
+			})
+			failIfErr(err)
+			Expect(visited).To(HaveLen(4))
+			for _, count := range visited {
+				Expect(count).To(Equal(1))
+			}
+			Expect(visited).To(HaveKey(top.cnode.String()))
+		})
+
+		It("returns the first error of visit", func() {
+			stop := errors.New("stop")
+			calls := 0
+			err := s.WalkDAG(ctx, top.cnode.String(), func(c string, raw []byte) error {
+				calls++
+				return stop
+			})
+			Expect(err).To(Equal(stop))
+			Expect(calls).To(Equal(1))
+		})
+
+		It("stops when the context is done", func() {
+			cctx, cancel := context.WithCancel(ctx)
+			calls := 0
+			err := s.WalkDAG(cctx, top.cnode.String(), func(c string, raw []byte) error {
+				calls++
+				cancel()
+				return nil
+			})
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(calls).To(Equal(1))
+		})
+	})
+
+	Describe("CompareAndSetRoot", func() {
+		It("rejects a stale writer", func() {
+			openStore(ctx)
+			headers := commitChain(ctx, "cas", 2)
+			Expect(Store.GetRoot()).To(Equal(headers[1]))
+
+			failIfErr(Store.CompareAndSetRoot(ctx, headers[1], headers[0]))
+			Expect(Store.GetRoot()).To(Equal(headers[0]))
+
+			// a writer that still holds headers[1] as the root
+			err := Store.CompareAndSetRoot(ctx, headers[1], headers[0])
+			Expect(errors.Is(err, ErrRootConflict)).To(BeTrue())
+
+			failIfErr(Store.CompareAndSetRoot(ctx, headers[0], headers[1]))
+			prev, err := Store.getPreviousRoot(ctx)
+			failIfErr(err)
+			Expect(prev.cnode.String()).To(Equal(headers[1]))
+		})
+
+		It("waits for another process holding the root file lock", func() {
+			dir, err := ioutil.TempDir("", "rootlock")
+			failIfErr(err)
+			defer os.RemoveAll(dir)
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+			var headers []string
+			for i := 1; i <= 2; i++ {
+				sb, err := s.OpenBlock(uint64(i))
+				failIfErr(err)
+				header, err := sb.Submit(ctx, testBlockWithTxns(fmt.Sprintf("caslock%d", i), uint64(i)))
+				failIfErr(err)
+				failIfErr(sb.Commit(ctx))
+				headers = append(headers, header)
+			}
+			s.rootFile = path.Join(dir, "root")
+			failIfErr(s.setRoot(ctx, s.root))
+
+			// the other process writes headers[0] before releasing the lock
+			holder := exec.Command(os.Args[0], "-test.run=^TestHoldRootLock$")
+			holder.Env = append(os.Environ(), "STOREIPFS_LOCK_ROOT="+s.rootFile, "STOREIPFS_LOCK_ROOT_WRITE="+headers[0])
+			stdin, err := holder.StdinPipe()
+			failIfErr(err)
+			stdout, err := holder.StdoutPipe()
+			failIfErr(err)
+			failIfErr(holder.Start())
+			defer holder.Wait()
+			line, err := bufio.NewReader(stdout).ReadString('\n')
+			failIfErr(err)
+			Expect(line).To(Equal("locked\n"))
+
+			done := make(chan error, 1)
+			go func() {
+				done <- s.CompareAndSetRoot(ctx, headers[1], headers[0])
+			}()
+			Consistently(done, 300*time.Millisecond).ShouldNot(Receive())
+			stdin.Close()
+			var casErr error
+			Eventually(done, 5*time.Second).Should(Receive(&casErr))
+			Expect(errors.Is(casErr, ErrRootConflict)).To(BeTrue())
+			Expect(s.GetRoot()).To(Equal(headers[1]))
+		})
+	})
+
+	Describe("root file", func() {
+		var dir string
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "rootfile")
+			failIfErr(err)
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("writes atomically and keeps the previous root", func() {
+			n1, err := makeNodeFromObj([]byte("root1"), nil)
+			failIfErr(err)
+			n2, err := makeNodeFromObj([]byte("root2"), nil)
+			failIfErr(err)
+			s := &store{rootFile: path.Join(dir, "root")}
+
+			s.root = n1
+			failIfErr(s.writeRootFile(ctx))
+			s.root = n2
+			failIfErr(s.writeRootFile(ctx))
+
+			b, err := ioutil.ReadFile(s.rootFile)
+			failIfErr(err)
+			p, err := parseRootFile(b)
+			failIfErr(err)
+			Expect(p).To(Equal(n2.path.String()))
+
+			b, err = ioutil.ReadFile(s.rootFile + ".bak")
+			failIfErr(err)
+			p, err = parseRootFile(b)
+			failIfErr(err)
+			Expect(p).To(Equal(n1.path.String()))
+		})
+
+		It("reports a corrupt root file", func() {
+			n, err := makeNodeFromObj([]byte("root"), nil)
+			failIfErr(err)
+			s := &store{rootFile: path.Join(dir, "root"), root: n}
+			failIfErr(s.writeRootFile(ctx))
+
+			b, err := ioutil.ReadFile(s.rootFile)
+			failIfErr(err)
+			failIfErr(ioutil.WriteFile(s.rootFile, b[:len(b)-10], 0644))
+
+			_, err = s.getPreviousRoot(ctx)
+			Expect(errors.Is(err, ErrCorruptRootFile)).To(BeTrue())
+		})
+
+		It("reads a root file without a checksum", func() {
+			p, err := parseRootFile([]byte("/ipld/zdpuAnwvRTxrMDKGgLo1a2PmHpvuBcmbByGmL5ezMNpNUTTvH"))
+			failIfErr(err)
+			Expect(p).To(Equal("/ipld/zdpuAnwvRTxrMDKGgLo1a2PmHpvuBcmbByGmL5ezMNpNUTTvH"))
+		})
+	})
+
+	Describe("block header", func() {
+		DescribeTable("round trips through bytes",
+			func(bh blockHeader) {
+				byts, err := blockHeaderToBytes(&bh)
+				failIfErr(err)
+				got, err := blockHeaderFromBytes(byts)
+				failIfErr(err)
+				Expect(*got).To(Equal(bh))
+			},
+			Entry("empty strings", blockHeader{}),
+			Entry("hex hashes", blockHeader{blockID: "a1b2c3", parentBlockID: "d4e5f6", blockNumber: 42}),
+			Entry("unicode hashes", blockHeader{blockID: "blöck☃", parentBlockID: "親", blockNumber: 1}),
+			Entry("max block number", blockHeader{blockID: "max", parentBlockID: "max-1", blockNumber: ^uint64(0)}),
+		)
+
+		It("rejects truncated data", func() {
+			byts, err := blockHeaderToBytes(&blockHeader{blockID: "truncated", blockNumber: 7})
+			failIfErr(err)
+			_, err = blockHeaderFromBytes(byts[:len(byts)-3])
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("UnpinBlock", func() {
+		It("keeps nodes shared with a newer block", func() {
+			pin = true
+			defer func() { pin = false }()
+
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "unpinshared", []byte("shared")))
+			failIfErr(storeb.tree.putValue(ctx, "unpinold", []byte("old")))
+			_, err := storeb.Submit(ctx, &testBlock{hash: "unpin1", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+			header1 := storeb.blockHeader.cnode
+			old, err := Store.merkleTree.getNode(ctx, "unpinold", "")
+			failIfErr(err)
+
+			sb, err := Store.OpenBlock(2)
+			failIfErr(err)
+			storeb2 := sb.(*storeBlock)
+			failIfErr(storeb2.tree.putValue(ctx, "unpinold", []byte("new")))
+			_, err = storeb2.Submit(ctx, &testBlock{hash: "unpin2", parentHash: "unpin1", number: 2})
+			failIfErr(err)
+			failIfErr(storeb2.Commit(ctx))
+
+			failIfErr(Store.UnpinBlock(ctx, "unpin1"))
+
+			shared, err := Store.merkleTree.getNode(ctx, "unpinshared", "")
+			failIfErr(err)
+			Expect(Store.api.pinned(ctx, shared.cnode.Cid())).To(BeTrue())
+			Expect(Store.api.pinned(ctx, storeb2.blockHeader.cnode.Cid())).To(BeTrue())
+			Expect(Store.api.pinned(ctx, header1.Cid())).To(BeFalse())
+			Expect(Store.api.pinned(ctx, old.cnode.Cid())).To(BeFalse())
+
+			err = Store.UnpinBlock(ctx, "unpin1")
+			Expect(err).To(HaveOccurred())
+			err = Store.UnpinBlock(ctx, "unpin2")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("keeps nodes that an older block not retained by the store reaches", func() {
+			pin = true
+			defer func() { pin = false }()
+
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "unpinkept", []byte("kept")))
+			_, err := storeb.Submit(ctx, &testBlock{hash: "unpinr1", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+			kept, err := Store.merkleTree.getNode(ctx, "unpinkept", "")
+			failIfErr(err)
+			// as if committed before a restart
+			Store.Lock()
+			delete(Store.retained, "unpinr1")
+			Store.Unlock()
+
+			for i, v := range []string{"other", "changed"} {
+				sb, err := Store.OpenBlock(uint64(i + 2))
+				failIfErr(err)
+				storeb := sb.(*storeBlock)
+				key := "unpinother"
+				if v == "changed" {
+					key = "unpinkept"
+				}
+				failIfErr(storeb.tree.putValue(ctx, key, []byte(v)))
+				hash := fmt.Sprintf("unpinr%d", i+2)
+				_, err = storeb.Submit(ctx, &testBlock{hash: hash, parentHash: fmt.Sprintf("unpinr%d", i+1), number: uint64(i + 2)})
+				failIfErr(err)
+				failIfErr(storeb.Commit(ctx))
+			}
+
+			failIfErr(Store.UnpinBlock(ctx, "unpinr2"))
+			Expect(Store.api.pinned(ctx, kept.cnode.Cid())).To(BeTrue())
+		})
+	})
+
+	Describe("GetValueAtRoot", func() {
+		It("reads each version of a key at its own root", func() {
+			var roots []string
+			for _, v := range []string{"first", "second"} {
+				storeb := openStore(ctx)
+				failIfErr(storeb.tree.putValue(ctx, "atrootkey", []byte(v)))
+				root, err := storeb.Submit(ctx, &testBlock{hash: "atroot" + v, number: 1})
+				failIfErr(err)
+				failIfErr(storeb.Commit(ctx))
+				roots = append(roots, root)
+			}
+
+			for i, v := range []string{"first", "second"} {
+				value, err := Store.GetValueAtRoot(ctx, roots[i], "atrootkey")
+				failIfErr(err)
+				Expect(string(value)).To(Equal(v))
+			}
+
+			value, err := Store.GetValueAtRoot(ctx, roots[0], "atrootmissing")
+			failIfErr(err)
+			Expect(value).To(BeNil())
+		})
+	})
+
+	Describe("DiffRoots", func() {
+		It("groups the keys that differ between two roots", func() {
+			keys := func(changes []KeyChange) []string {
+				var ks []string
+				for _, c := range changes {
+					ks = append(ks, c.Key)
+				}
+				return ks
+			}
+
+			storeb := openStore(ctx)
+			for _, k := range []string{"diffa", "diffb", "diffc"} {
+				failIfErr(storeb.tree.putValue(ctx, k, []byte(k)))
+			}
+			rootA, err := storeb.Submit(ctx, &testBlock{hash: "diff1", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			storeb = openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "diffb", []byte("changed")))
+			failIfErr(storeb.tree.deleteKey(ctx, "diffc"))
+			failIfErr(storeb.tree.putValue(ctx, "diffd", []byte("diffd")))
+			rootB, err := storeb.Submit(ctx, &testBlock{hash: "diff2", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			d, err := Store.DiffRoots(ctx, rootA, rootB)
+			failIfErr(err)
+			Expect(keys(d.Added)).To(ContainElement("diffd"))
+			Expect(keys(d.Removed)).To(Equal([]string{"diffc"}))
+			Expect(keys(d.Modified)).To(Equal([]string{"diffb"}))
+			Expect(d.Removed[0].Old).To(Equal([]byte("diffc")))
+			Expect(d.Removed[0].New).To(BeNil())
+			Expect(d.Modified[0].Old).To(Equal([]byte("diffb")))
+			Expect(d.Modified[0].New).To(Equal([]byte("changed")))
+
+			// a key whose value is unchanged is not modified, though its
+			// node changed with the keys below it
+			storeb = openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "diffbb", []byte("below")))
+			rootC, err := storeb.Submit(ctx, &testBlock{hash: "diff3", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+			d, err = Store.DiffRoots(ctx, rootB, rootC)
+			failIfErr(err)
+			Expect(keys(d.Added)).To(Equal([]string{"diffbb"}))
+			Expect(d.Added[0].New).To(Equal([]byte("below")))
+			Expect(d.Modified).To(BeEmpty())
+
+			d, err = Store.DiffRoots(ctx, rootB, rootB)
+			failIfErr(err)
+			Expect(*d).To(Equal(TreeDiff{}))
+		})
+	})
+
+	Describe("GetAccountTransactions", func() {
+		It("lists each account's transactions by role", func() {
+			storeb := openStore(ctx)
+			block := testBlockWithTxns("accttxns", 1)
+			alice := &testAccount{address: "accttxnsalice"}
+			dave := &testAccount{address: "accttxnsdave"}
+			block.txns = append(block.txns,
+				&testTransaction{hash: "accttxnstx3", parties: map[string]spec.Account{"from": alice, "to": dave}},
+				&testTransaction{hash: "accttxnstx4", parties: map[string]spec.Account{"from": alice, "to": dave}})
+			_, err := storeb.Submit(ctx, block)
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			expected := map[string][]string{
+				"alice from": {"accttxnstx1", "accttxnstx3", "accttxnstx4"},
+				"bob to":     {"accttxnstx1"},
+				"bob from":   {"accttxnstx2"},
+				"carol to":   {"accttxnstx2"},
+				"carol from": {},
+				"dave to":    {"accttxnstx3", "accttxnstx4"}}
+			for k, want := range expected {
+				var name, role string
+				fmt.Sscan(k, &name, &role)
+				hashes, err := Store.GetAccountTransactions(ctx, "accttxns"+name, role, 0, 0)
+				failIfErr(err)
+				Expect(hashes).To(Equal(want), k)
+			}
+
+			page, err := Store.GetAccountTransactions(ctx, "accttxnsalice", "from", 1, 1)
+			failIfErr(err)
+			Expect(page).To(Equal([]string{"accttxnstx3"}))
+			page, err = Store.GetAccountTransactions(ctx, "accttxnsalice", "from", 5, 1)
+			failIfErr(err)
+			Expect(page).To(BeEmpty())
+		})
+	})
+
+	Describe("GetTransactionBlock", func() {
+		It("finds the block that included a transaction", func() {
+			storeb := openStore(ctx)
+			block := testBlockWithTxns("txblock", 1)
+			_, err := storeb.Submit(ctx, block)
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			bnode, err := makeNodeFromBlock(block)
+			failIfErr(err)
+			blockCid, err := Store.GetTransactionBlock(ctx, "txblocktx2")
+			failIfErr(err)
+			Expect(blockCid).To(Equal(bnode.cnode.String()))
+
+			blockCid, err = Store.GetTransactionBlock(ctx, "txblocknotx")
+			failIfErr(err)
+			Expect(blockCid).To(BeEmpty())
+		})
+	})
+
+	Describe("TreePutBatch", func() {
+		newBlock := func() *storeBlock {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			sb, err := s.OpenBlock(1)
+			failIfErr(err)
+			return sb.(*storeBlock)
+		}
+
+		It("puts the same tree as sequential TreePuts", func() {
+			entries := map[string]spec.Marshalled{
+				"batchkey":  &testValue{data: []byte("one")},
+				"batchkey2": &testValue{data: []byte("two")},
+				"batchkez":  &testValue{data: []byte("three")},
+				"other":     &testValue{data: []byte("four")}}
+
+			seq := newBlock()
+			defer seq.store.Close()
+			keys := make([]string, 0, len(entries))
+			for key := range entries {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				failIfErr(seq.TreePut(ctx, key, entries[key]))
+			}
+
+			batched := newBlock()
+			defer batched.store.Close()
+			failIfErr(batched.TreePutBatch(ctx, entries))
+
+			Expect(batched.tree.getRoot()).To(Equal(seq.tree.getRoot()))
+			v := &testValue{}
+			failIfErr(batched.TreeGet(ctx, "batchkez", v))
+			Expect(v.data).To(Equal([]byte("three")))
+		})
+
+		It("leaves the tree unchanged if an entry fails", func() {
+			defer func() { maxNodeLinks = defaultMaxNodeLinks }()
+			sb := newBlock()
+			defer sb.store.Close()
+			failIfErr(sb.TreePut(ctx, "tpa", &testValue{data: []byte("a")}))
+			failIfErr(sb.TreePut(ctx, "tpb", &testValue{data: []byte("b")}))
+			root := sb.tree.getRoot()
+
+			maxNodeLinks = 3
+			err := sb.TreePutBatch(ctx, map[string]spec.Marshalled{
+				"apart": &testValue{data: []byte("fine")},
+				"tpc":   &testValue{data: []byte("c")},
+				"tpd":   &testValue{data: []byte("d")}})
+			Expect(errors.Is(err, ErrTooManyLinks)).To(BeTrue())
+
+			Expect(sb.tree.getRoot()).To(Equal(root))
+			for _, key := range []string{"apart", "tpc", "tpd"} {
+				v, err := sb.tree.getValue(ctx, key)
+				failIfErr(err)
+				Expect(v).To(BeNil())
+			}
+			v, err := sb.tree.getValue(ctx, "tpb")
+			failIfErr(err)
+			Expect(v).To(Equal([]byte("b")))
+		})
+	})
+
+	Describe("TreeGet", func() {
+		It("returns ErrKeyNotFound for a missing key", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.TreePut(ctx, "treegetkey", &testValue{data: []byte("found")}))
+			_, err := storeb.Submit(ctx, testBlockWithTxns("treeget", 1))
+			failIfErr(err)
+
+			v := &testValue{}
+			err = storeb.TreeGet(ctx, "treegetmissing", v)
+			Expect(errors.Is(err, ErrKeyNotFound)).To(BeTrue())
+			failIfErr(storeb.Commit(ctx))
+
+			err = Store.TreeGet(ctx, "treegetmissing", v)
+			Expect(errors.Is(err, ErrKeyNotFound)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("treegetmissing"))
+			failIfErr(Store.TreeGet(ctx, "treegetkey", v))
+			Expect(v.data).To(Equal([]byte("found")))
+		})
+	})
+
+	Describe("TreePutLink", func() {
+		It("links to a node that is not stored", func() {
+			blob, err := Store.Hash([]byte("external blob"), nil)
+			failIfErr(err)
+
+			storeb := openStore(ctx)
+			failIfErr(Store.TreePutLink(ctx, "linked", "blob", blob))
+			_, err = storeb.Submit(ctx, &testBlock{hash: "treeputlink", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			links, err := Store.merkleTree.getLinks(ctx, "linked")
+			failIfErr(err)
+			Expect(links).To(HaveKey("blob"))
+			Expect(linkCid(links["blob"])).To(Equal(blob))
+		})
+
+		It("rejects a malformed CID", func() {
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+
+			err := Store.TreePutLink(ctx, "linked", "blob", "not-a-cid")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not-a-cid"))
+		})
+
+		It("rejects reserved link names at every entry point", func() {
+			blob, err := Store.Hash([]byte("external blob"), nil)
+			failIfErr(err)
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+
+			for _, name := range []string{val, versionKey, expiresKey, chunksLink} {
+				links := &testLinked{links: spec.Links{name: blob}}
+
+				err = Store.TreePutLink(ctx, "reserved", name, blob)
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue(), name)
+				err = storeb.TreePut(ctx, "reserved", links)
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue(), name)
+				err = Store.Put(ctx, links)
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue(), name)
+				_, err = Store.PutReader(ctx, strings.NewReader("value"), links.links)
+				Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue(), name)
+			}
+		})
+	})
+
+	Describe("limits", func() {
+		AfterEach(func() {
+			maxValueSize = defaultMaxValueSize
+			maxNodeLinks = defaultMaxNodeLinks
+		})
+
+		It("rejects a value larger than store.maxvaluesize", func() {
+			maxValueSize = 8
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+
+			err := storeb.tree.putValue(ctx, "bigvalue", []byte("123456789"))
+			Expect(errors.Is(err, ErrValueTooLarge)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("bigvalue"))
+			Expect(err.Error()).To(ContainSubstring("store.maxvaluesize is 8"))
+
+			err = storeb.TreePut(ctx, "bigobject", &testValue{data: []byte("123456789")})
+			Expect(errors.Is(err, ErrValueTooLarge)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("bigobject"))
+		})
+
+		It("rejects a node with more links than store.maxnodelinks", func() {
+			maxNodeLinks = 3
+			tree, err := initMerkle(ctx, newMemBackend(), "")
+			failIfErr(err)
+			b, err := tree.StartBatch(nil)
+			failIfErr(err)
+
+			for _, name := range []string{"l1", "l2", "l3"} {
+				failIfErr(b.putLink(ctx, "fanout", &link{key: name, targetNode: tree.rootNode()}))
+			}
+			err = b.putLink(ctx, "fanout", &link{key: "l4", targetNode: tree.rootNode()})
+			Expect(errors.Is(err, ErrTooManyLinks)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("fanout"))
+			Expect(err.Error()).To(ContainSubstring("store.maxnodelinks is 3"))
+		})
+
+		It("rejects a key longer than store.maxkeylength without descending", func() {
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+			key := strings.Repeat("k", 1<<20)
+
+			err := storeb.tree.putValue(ctx, key, []byte("deep"))
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("store.maxkeylength is 1024"))
+			_, err = storeb.tree.getValue(ctx, key)
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+			_, err = storeb.tree.has(ctx, key)
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+			err = storeb.tree.putLink(ctx, key, &link{key: "deep", targetNode: Store.merkleTree.rootNode()})
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+			err = storeb.TreeGet(ctx, key, &testValue{})
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+			_, err = Store.merkleTree.getValue(ctx, key)
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+			_, err = Store.GetValueAtRoot(ctx, Store.GetRoot(), key)
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+			ro := &storeBlock{store: Store, merkleRoot: Store.merkleTree.rootNode(), readonly: true}
+			err = ro.TreeGet(ctx, key, &testValue{})
+			Expect(errors.Is(err, ErrKeyTooLong)).To(BeTrue())
+
+			key = strings.Repeat("k", maxKeyLength)
+			failIfErr(storeb.tree.putValue(ctx, key, []byte("deep")))
+			value, err := storeb.tree.getValue(ctx, key)
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("deep")))
+		})
+	})
+
+	Describe("PendingNodeCount", func() {
+		It("counts the nodes a commit writes", func() {
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "pending1", []byte("one")))
+			failIfErr(storeb.tree.putValue(ctx, "pending2", []byte("two")))
+			treeCount, err := storeb.PendingNodeCount()
+			failIfErr(err)
+			Expect(treeCount).To(BeNumerically(">", 0))
+
+			_, err = storeb.Submit(ctx, testBlockWithTxns("pending", 1))
+			failIfErr(err)
+			count, err := storeb.PendingNodeCount()
+			failIfErr(err)
+			Expect(count).To(BeNumerically(">", treeCount))
+			again, err := storeb.PendingNodeCount()
+			failIfErr(err)
+			Expect(again).To(Equal(count))
+
+			put := Store.Stats().NodesPut
+			failIfErr(storeb.Commit(ctx))
+			Expect(Store.Stats().NodesPut - put).To(BeEquivalentTo(count))
+		})
+	})
+
+	Describe("AppendBlock", func() {
+		newStore := func() *store {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			return s
+		}
+
+		It("commits a chain as OpenBlock, Submit and Commit do", func() {
+			s := newStore()
+			defer s.Close()
+			opened := newStore()
+			defer opened.Close()
+
+			parentHash := ""
+			for i := uint64(1); i <= 3; i++ {
+				block := testBlockWithTxns(fmt.Sprintf("append%d", i), i)
+				block.parentHash = parentHash
+				root, err := s.AppendBlock(ctx, block)
+				failIfErr(err)
+				Expect(root).To(Equal(s.GetRoot()))
+
+				sb, err := opened.OpenBlock(i)
+				failIfErr(err)
+				_, err = sb.Submit(ctx, block)
+				failIfErr(err)
+				failIfErr(sb.Commit(ctx))
+				Expect(root).To(Equal(opened.GetRoot()))
+				parentHash = block.hash
+			}
+			Expect(s.storeBlocks).To(BeEmpty())
+		})
+
+		It("rejects a block that does not follow the root", func() {
+			s := newStore()
+			defer s.Close()
+			_, err := s.AppendBlock(ctx, testBlockWithTxns("appendparent1", 1))
+			failIfErr(err)
+			root := s.GetRoot()
+
+			block := testBlockWithTxns("appendparent2", 2)
+			block.parentHash = "someotherblock"
+			_, err = s.AppendBlock(ctx, block)
+			Expect(errors.Is(err, ErrParentMismatch)).To(BeTrue())
+
+			block = testBlockWithTxns("appendparent3", 3)
+			block.parentHash = "appendparent1"
+			_, err = s.AppendBlock(ctx, block)
+			Expect(errors.Is(err, ErrBlockNotSuccessor)).To(BeTrue())
+
+			Expect(s.GetRoot()).To(Equal(root))
+			Expect(s.storeBlocks).To(BeEmpty())
+		})
+
+		It("refuses while a block is open", func() {
+			s := newStore()
+			defer s.Close()
+			_, err := s.OpenBlock(1)
+			failIfErr(err)
+			_, err = s.AppendBlock(ctx, testBlockWithTxns("appendopen", 1))
+			Expect(errors.Is(err, ErrBlockAlreadyOpen)).To(BeTrue())
+		})
+	})
+
+	Describe("GetSignedRoot", func() {
+		It("returns ErrRootNotSigned without a signer", func() {
+			openStore(ctx)
+			_, _, err := Store.GetSignedRoot()
+			Expect(errors.Is(err, ErrRootNotSigned)).To(BeTrue())
+		})
+
+		It("signs each committed root", func() {
+			dir, err := ioutil.TempDir("", "signedroot")
+			failIfErr(err)
+			defer os.RemoveAll(dir)
+			pub, priv, err := ed25519.GenerateKey(nil)
+			failIfErr(err)
+
+			storeb := openStore(ctx)
+			Store.signer = ed25519Signer(priv)
+			Store.rootFile = path.Join(dir, "root")
+			defer func() {
+				Store.signer = nil
+				Store.rootFile = ""
+			}()
+			_, err = storeb.Submit(ctx, testBlockWithTxns("signedroot", 1))
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			root, sig, err := Store.GetSignedRoot()
+			failIfErr(err)
+			Expect(root).To(Equal(Store.GetRoot()))
+			failIfErr(VerifySignedRoot(ed25519Verifier(pub), root, sig))
+
+			content, err := ioutil.ReadFile(Store.rootFile + ".sig")
+			failIfErr(err)
+			Expect(string(content)).To(Equal(root + " " + base64.StdEncoding.EncodeToString(sig) + "\n"))
+
+			err = VerifySignedRoot(ed25519Verifier(pub), NilStoreRoot, sig)
+			Expect(errors.Is(err, ErrBadRootSignature)).To(BeTrue())
+			otherPub, _, err := ed25519.GenerateKey(nil)
+			failIfErr(err)
+			err = VerifySignedRoot(ed25519Verifier(otherPub), root, sig)
+			Expect(errors.Is(err, ErrBadRootSignature)).To(BeTrue())
+		})
+	})
+
+	Describe("Compact", func() {
+		countNodes := func() int {
+			count := 0
+			err := walkNode(ctx, Store.api, Store.merkleTree.rootNode(), "", func(string, *node) error {
+				count++
+				return nil
+			})
+			failIfErr(err)
+			return count
+		}
+		liveEntries := func() map[string]string {
+			entries := make(map[string]string)
+			err := Store.merkleTree.walk(ctx, func(key string, data []byte, links spec.Links) error {
+				entries[key] = fmt.Sprintf("%x %v", data, links)
+				return nil
+			})
+			failIfErr(err)
+			return entries
+		}
+
+		It("drops empty branches and keeps every live key", func() {
+			storeb := openStore(ctx)
+			for i := 0; i < 5; i++ {
+				failIfErr(storeb.tree.putValue(ctx, fmt.Sprintf("livekey%d", i), []byte(fmt.Sprint(i))))
+				failIfErr(storeb.tree.putValue(ctx, fmt.Sprintf("emptybranch%d", i), nil))
+			}
+			_, err := storeb.Submit(ctx, testBlockWithTxns("compact", 1))
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			before := liveEntries()
+			nodesBefore := countNodes()
+			root, err := Store.Compact(ctx)
+			failIfErr(err)
+			Expect(root).To(Equal(Store.GetRoot()))
+			sb, err := Store.GetBlock(ctx, "compact")
+			failIfErr(err)
+			Expect(sb.(*storeBlock).blockHeader.cnode.String()).To(Equal(root))
+			Expect(liveEntries()).To(Equal(before))
+			Expect(countNodes()).To(BeNumerically("<", nodesBefore))
+
+			value, err := Store.merkleTree.getValue(ctx, "livekey3")
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("3")))
+
+			again, err := Store.Compact(ctx)
+			failIfErr(err)
+			Expect(again).To(Equal(root))
+		})
+
+		It("refuses while a block is open", func() {
+			openStore(ctx)
+			_, err := Store.Compact(ctx)
+			Expect(errors.Is(err, ErrBlockAlreadyOpen)).To(BeTrue())
+		})
+	})
+
+	Describe("Snapshot", func() {
+		commitValue := func(hash string, value string) {
+			storeb := openStore(ctx)
+			failIfErr(storeb.tree.putValue(ctx, "snapshotkey", []byte(value)))
+			_, err := storeb.Submit(ctx, testBlockWithTxns(hash, 1))
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+		}
+
+		It("restores the values of a snapshot root", func() {
+			commitValue("snapshot1", "old")
+			snapshot, err := Store.Snapshot(ctx)
+			failIfErr(err)
+			Expect(snapshot).To(Equal(Store.GetRoot()))
+
+			commitValue("snapshot2", "new")
+			Expect(Store.GetRoot()).NotTo(Equal(snapshot))
+
+			failIfErr(Store.RestoreFromRoot(ctx, snapshot))
+			Expect(Store.GetRoot()).To(Equal(snapshot))
+			value, err := Store.merkleTree.getValue(ctx, "snapshotkey")
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("old")))
+
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+			value, err = storeb.tree.getValue(ctx, "snapshotkey")
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("old")))
+		})
+
+		It("rejects a root without a merkle tree", func() {
+			n, err := makeNodeFromObj([]byte("not a root"), nil)
+			failIfErr(err)
+			failIfErr(putObj(ctx, Store.api, n))
+			root := Store.GetRoot()
+
+			err = Store.RestoreFromRoot(ctx, n.cnode.String())
+			Expect(errors.Is(err, ErrBlockNotFound)).To(BeTrue())
+			Expect(Store.RestoreFromRoot(ctx, "notacid")).NotTo(Succeed())
+			Expect(Store.GetRoot()).To(Equal(root))
+		})
+
+		It("keeps the current root and tree if the root file cannot be written", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+			var roots []string
+			for i, v := range []string{"old", "new"} {
+				sb, err := s.OpenBlock(uint64(i + 1))
+				failIfErr(err)
+				failIfErr(sb.(*storeBlock).tree.putValue(ctx, "snapshotkey", []byte(v)))
+				root, err := sb.Submit(ctx, testBlockWithTxns("restorefail"+v, uint64(i+1)))
+				failIfErr(err)
+				failIfErr(sb.Commit(ctx))
+				roots = append(roots, root)
+			}
+
+			s.rootFile = path.Join(getDataDir(), "missing", "root")
+			err = s.RestoreFromRoot(ctx, roots[0])
+			Expect(err).To(HaveOccurred())
+			Expect(s.GetRoot()).To(Equal(roots[1]))
+			value, err := s.merkleTree.getValue(ctx, "snapshotkey")
+			failIfErr(err)
+			Expect(value).To(Equal([]byte("new")))
+		})
+
+		It("refuses to restore while a block is open", func() {
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+			snapshot, err := Store.Snapshot(ctx)
+			failIfErr(err)
+
+			err = Store.RestoreFromRoot(ctx, snapshot)
+			Expect(errors.Is(err, ErrBlockAlreadyOpen)).To(BeTrue())
+		})
+	})
+
+	Describe("WithProfiling", func() {
+		It("records the steps of a submit and commit", func() {
+			storeb := openStore(ctx)
+			pctx, profile := Store.WithProfiling(ctx)
+			failIfErr(storeb.tree.putValue(pctx, "profiled", []byte("value")))
+			_, err := storeb.Submit(pctx, testBlockWithTxns("profiled", 1))
+			failIfErr(err)
+			failIfErr(storeb.Commit(pctx))
+
+			for _, name := range []string{"putKey", "putMany", "collectChangedNodes", "putChunk", "batchCommit", "setRoot"} {
+				Expect(profile.Total(name)).To(BeNumerically(">", 0), name)
+			}
+			Expect(profile.Total("batchCommit")).To(BeNumerically(">=", profile.Total("collectChangedNodes")))
+		})
+
+		It("records nothing without a profile in the context", func() {
+			_, profile := Store.WithProfiling(ctx)
+			storeb := openStore(ctx)
+			_, err := storeb.Submit(ctx, testBlockWithTxns("unprofiled", 1))
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+			Expect(profile.Spans()).To(BeEmpty())
+		})
+	})
+
+	Describe("GC", func() {
+		It("frees nodes left by a reverted block and keeps the root", func() {
+			cfg := configFromViper()
+			cfg.InMemory = true
+			s, err := InitStoreWithConfig(ctx, cfg)
+			failIfErr(err)
+			defer s.Close()
+			defer func(n int) { spillNodes = n }(spillNodes)
+			spillNodes = 10
+			mem := s.api.(*memBackend)
+
+			external, err := makeNodeFromObj([]byte("not stored"), nil)
+			failIfErr(err)
+			sb, err := s.OpenBlock(1)
+			failIfErr(err)
+			failIfErr(sb.TreePut(ctx, "gckept", &testValue{data: []byte("kept")}))
+			failIfErr(sb.TreePutLink(ctx, "gclink", "external", external.cnode.String()))
+			_, err = sb.Submit(ctx, testBlockWithTxns("gc1", 1))
+			failIfErr(err)
+			failIfErr(sb.Commit(ctx))
+			failIfErr(mem.pin(ctx, s.root.path, false))
+			pins := make(map[string]bool)
+			for k, v := range mem.pins {
+				pins[k] = v
+			}
+			stored := len(mem.nodes)
+
+			sb, err = s.OpenBlock(2)
+			failIfErr(err)
+			failIfErr(sb.(*storeBlock).tree.putMany(ctx, largeEntries(300)))
+			Expect(len(mem.nodes)).To(BeNumerically(">", stored))
+			failIfErr(sb.Revert())
+
+			freed, err := s.GC(ctx)
+			failIfErr(err)
+			Expect(freed).To(BeNumerically(">", 0))
+			Expect(len(mem.nodes)).To(BeNumerically("<=", stored))
+			Expect(mem.pins).To(Equal(pins))
+			failIfErr(s.HealthCheck(ctx))
+			var kept testValue
+			failIfErr(s.TreeGet(ctx, "gckept", &kept))
+			Expect(kept.data).To(Equal([]byte("kept")))
+		})
+
+		It("refuses while a block is open", func() {
+			storeb := openStore(ctx)
+			defer storeb.Revert()
+
+			_, err := Store.GC(ctx)
+			Expect(errors.Is(err, ErrBlockAlreadyOpen)).To(BeTrue())
+		})
+	})
+
+	Describe("CloseContext", func() {
+		It("waits for a commit in progress", func() {
+			storeb := openStore(ctx)
+			_, err := storeb.Submit(ctx, testBlockWithTxns("closing", 1))
+			failIfErr(err)
+
+			committed := make(chan error, 1)
+			go func() {
+				committed <- storeb.Commit(ctx)
+			}()
+
+			s := Store
+			failIfErr(s.CloseContext(ctx))
+			failIfErr(<-committed)
+			Expect(Store).To(BeNil())
+
+			_, err = s.OpenBlock(2)
+			Expect(errors.Is(err, ErrStoreClosed)).To(BeTrue())
+
+			failIfErr(InitStore(ctx))
+			Expect(Store.GetRoot()).To(Equal(storeb.GetRoot()))
+		})
+
+		It("times out while a block is open", func() {
+			storeb := openStore(ctx)
+			s := Store
+
+			tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			err := s.CloseContext(tctx)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(Store).To(Equal(s))
+
+			failIfErr(storeb.Revert())
+			failIfErr(s.CloseContext(ctx))
+			failIfErr(InitStore(ctx))
+		})
+	})
+})
+
+// testBlock implements the parts of spec.Block used by the store.
+type testBlock struct {
+	spec.Block
+	hash       string
+	parentHash string
+	number     uint64
+	txns       []spec.Transaction
+}
+
+func (b *testBlock) Hash() string                     { return b.hash }
+func (b *testBlock) ParentHash() string               { return b.parentHash }
+func (b *testBlock) BlockNumber() uint64              { return b.number }
+func (b *testBlock) Transactions() []spec.Transaction { return b.txns }
+func (b *testBlock) Marshal() ([]byte, spec.Links, error) {
+	return []byte("block" + b.hash), nil, nil
+}
+
+// testTransaction implements the parts of spec.Transaction used by the store.
+type testTransaction struct {
+	spec.Transaction
+	hash    string
+	parties map[string]spec.Account
+}
+
+func (t *testTransaction) Hash() string                     { return t.hash }
+func (t *testTransaction) Parties() map[string]spec.Account { return t.parties }
+func (t *testTransaction) Marshal() ([]byte, spec.Links, error) {
+	return []byte("txn" + t.hash), nil, nil
+}
+
+// testAccount implements the parts of spec.Account used by the store.
+type testAccount struct {
+	spec.Account
+	address string
+}
+
+func (a *testAccount) Address() string { return a.address }
+func (a *testAccount) Marshal() proto.Message {
+	return &types.StringValue{Value: a.address}
+}
+
+// testLogger records the messages it receives.
+type testLogger struct {
+	debugs, infos, errors []string
+}
+
+func (l *testLogger) Debug(msg string, _ ...interface{}) { l.debugs = append(l.debugs, msg) }
+func (l *testLogger) Info(msg string, _ ...interface{})  { l.infos = append(l.infos, msg) }
+func (l *testLogger) Error(msg string, _ ...interface{}) { l.errors = append(l.errors, msg) }
+
+// testLinked implements spec.Marshalled over links only.
+// noPutBackend is a backend that fails every put.
+type noPutBackend struct {
+	backend
+}
+
+func (noPutBackend) put(context.Context, []ipldNode) error {
+	return errors.New("put on a read-only store")
+}
+
+type testLinked struct {
+	links spec.Links
+}
+
+func (v *testLinked) Marshal() ([]byte, spec.Links, error) { return nil, v.links, nil }
+func (v *testLinked) Unmarshal(_ []byte, links spec.Links) error {
+	v.links = links
+	return nil
+}
+
+// testValue implements spec.Marshalled over raw bytes.
+type testValue struct {
+	data []byte
+}
+
+func (v *testValue) Marshal() ([]byte, spec.Links, error) { return v.data, nil, nil }
+func (v *testValue) Unmarshal(data []byte, _ spec.Links) error {
+	v.data = data
+	return nil
+}
+
+// commitChain submits and commits count blocks numbered from 1, each the
+// parent of the next, and returns their header CIDs.
+func commitChain(ctx context.Context, prefix string, count int) []string {
+	var headers []string
+	parentHash := ""
+	for i := 1; i <= count; i++ {
+		sb, err := Store.OpenBlock(uint64(i))
+		failIfErr(err)
+		hash := fmt.Sprintf("%s%d", prefix, i)
+		root, err := sb.Submit(ctx, &testBlock{hash: hash, parentHash: parentHash, number: uint64(i)})
+		failIfErr(err)
+		failIfErr(sb.Commit(ctx))
+		headers = append(headers, root)
+		parentHash = hash
+	}
+	return headers
+}
+
+// testBlockWithTxns returns a block with two transactions between three
+// accounts.
+func testBlockWithTxns(hash string, number uint64) *testBlock {
+	alice := &testAccount{address: hash + "alice"}
+	bob := &testAccount{address: hash + "bob"}
+	carol := &testAccount{address: hash + "carol"}
+	return &testBlock{
+		hash:   hash,
+		number: number,
+		txns: []spec.Transaction{
+			&testTransaction{hash: hash + "tx1", parties: map[string]spec.Account{"from": alice, "to": bob}},
+			&testTransaction{hash: hash + "tx2", parties: map[string]spec.Account{"from": bob, "to": carol}}}}
+}
+
+// ed25519Signer and ed25519Verifier stand in for the libp2p keys of an
+// IPFS node.
+type ed25519Signer ed25519.PrivateKey
+
+func (k ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(k), data), nil
+}
+
+type ed25519Verifier ed25519.PublicKey
+
+func (k ed25519Verifier) Verify(data []byte, sig []byte) (bool, error) {
+	return ed25519.Verify(ed25519.PublicKey(k), data, sig), nil
+}
+
+// TestHoldRootLock is a helper for the CompareAndSetRoot specs rather than
+// a test. Run with STOREIPFS_LOCK_ROOT set, it locks that root file until
+// stdin is closed, and then writes the root STOREIPFS_LOCK_ROOT_WRITE to
+// it before releasing the lock.
+func TestHoldRootLock(t *testing.T) {
+	rootFile := os.Getenv("STOREIPFS_LOCK_ROOT")
+	if rootFile == "" {
+		return
+	}
+	unlock, err := lockRootFile(rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	fmt.Println("locked")
+	ioutil.ReadAll(os.Stdin)
+	err = ioutil.WriteFile(rootFile, formatRootFile("/ipld/"+os.Getenv("STOREIPFS_LOCK_ROOT_WRITE")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
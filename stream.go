@@ -0,0 +1,195 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	spec "github.com/blocktop/go-spec"
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+)
+
+// A value read by PutReader that fits in one chunk is stored inline, as Put
+// would store it. A larger value is split into chunk nodes holding
+// streamChunkSize bytes each. The value's node then has no data and links
+// to an index node under chunksLink, whose links "0", "1", ... are the
+// chunks in order.
+const chunksLink = "_chunks"
+
+var streamChunkSize = 256 << 10
+
+// PutReader stores the value read from r with links and returns its CID.
+// At most one chunk of the value is held in memory.
+func (s *store) PutReader(ctx context.Context, r io.Reader, specLinks spec.Links) (string, error) {
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+	links, err := makeLinks(specLinks)
+	if err != nil {
+		return "", err
+	}
+
+	size := streamChunkSize
+	if size > maxValueSize {
+		size = maxValueSize
+	}
+	buf := make([]byte, size)
+	br := bufio.NewReader(r)
+
+	chunks := make(map[string]*link)
+	for {
+		k, err := io.ReadFull(br, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		if err == nil {
+			if _, perr := br.Peek(1); perr == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if len(chunks) == 0 && err == io.ErrUnexpectedEOF {
+			// the whole value fits in one chunk
+			return s.putNode(ctx, append([]byte(nil), buf[:k]...), links)
+		}
+		if len(chunks) == maxNodeLinks {
+			return "", fmt.Errorf("%w: more than %d chunks of %d bytes", ErrValueTooLarge, maxNodeLinks, size)
+		}
+
+		cn, perr := makeNodeFromObj(append([]byte(nil), buf[:k]...), nil)
+		if perr != nil {
+			return "", perr
+		}
+		perr = putObj(ctx, s.api, cn)
+		if perr != nil {
+			return "", perr
+		}
+		name := strconv.Itoa(len(chunks))
+		chunks[name] = &link{key: name, targetCid: cn.cnode.Cid()}
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if len(chunks) == 0 {
+		return s.putNode(ctx, []byte{}, links)
+	}
+
+	index, err := makeNodeFromObj(nil, chunks)
+	if err != nil {
+		return "", err
+	}
+	err = putObj(ctx, s.api, index)
+	if err != nil {
+		return "", err
+	}
+
+	if links == nil {
+		links = make(map[string]*link)
+	}
+	links[chunksLink] = &link{key: chunksLink, targetCid: index.cnode.Cid()}
+	return s.putNode(ctx, nil, links)
+}
+
+func (s *store) putNode(ctx context.Context, data []byte, links map[string]*link) (string, error) {
+	n, err := makeNodeFromObj(data, links)
+	if err != nil {
+		return "", err
+	}
+	err = putObj(ctx, s.api, n)
+	if err != nil {
+		return "", err
+	}
+	return n.cnode.String(), nil
+}
+
+// GetReader returns a reader over the value of the node hash, which may
+// have been stored by Put or PutReader. Chunks are fetched as they are read.
+func (s *store) GetReader(ctx context.Context, hash string) (io.ReadCloser, error) {
+	c, err := cid.Parse(hash)
+	if err != nil {
+		return nil, err
+	}
+	n, err := getObj(ctx, s.api, coreiface.IpldPath(c).String())
+	if err != nil {
+		return nil, err
+	}
+
+	indexLink := n.links[chunksLink]
+	if indexLink == nil {
+		return ioutil.NopCloser(bytes.NewReader(n.data)), nil
+	}
+	index, err := linkTarget(ctx, s.api, indexLink)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, fmt.Errorf("missing chunk index for %s", hash)
+	}
+
+	chunks := make([]cid.Cid, len(index.links))
+	for i := range chunks {
+		lnk := index.links[strconv.Itoa(i)]
+		if lnk == nil {
+			return nil, fmt.Errorf("missing chunk %d of %s", i, hash)
+		}
+		chunks[i] = lnk.targetCid
+	}
+	return &chunkReader{ctx: ctx, api: s.api, chunks: chunks}, nil
+}
+
+// chunkReader reads the chunks of a value in order, fetching each when the
+// previous one has been read.
+type chunkReader struct {
+	ctx    context.Context
+	api    backend
+	chunks []cid.Cid
+	cur    []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		n, err := getObj(r.ctx, r.api, coreiface.IpldPath(r.chunks[0]).String())
+		if err != nil {
+			return 0, err
+		}
+		r.cur = n.data
+		r.chunks = r.chunks[1:]
+	}
+	k := copy(p, r.cur)
+	r.cur = r.cur[k:]
+	return k, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.chunks = nil
+	r.cur = nil
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	spec "github.com/blocktop/go-spec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streaming values", func() {
+	var ctx context.Context
+	BeforeEach(func() {
+		ctx = context.Background()
+		streamChunkSize = 16
+	})
+	AfterEach(func() {
+		streamChunkSize = 256 << 10
+	})
+
+	readAll := func(hash string) []byte {
+		r, err := Store.GetReader(ctx, hash)
+		failIfErr(err)
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		failIfErr(err)
+		return b
+	}
+
+	It("stores a value that fits in one chunk inline", func() {
+		value := []byte("sixteen bytes!!!")
+		hash, err := Store.PutReader(ctx, bytes.NewReader(value), nil)
+		failIfErr(err)
+
+		inline, err := Store.Hash(value, nil)
+		failIfErr(err)
+		Expect(hash).To(Equal(inline))
+		Expect(readAll(hash)).To(Equal(value))
+	})
+
+	It("splits a large value into chunks", func() {
+		value := bytes.Repeat([]byte("0123456789"), 10)
+		target, err := Store.Hash([]byte("target"), nil)
+		failIfErr(err)
+		hash, err := Store.PutReader(ctx, bytes.NewReader(value), spec.Links{"owner": target})
+		failIfErr(err)
+
+		links, err := Store.GetLinks(ctx, hash)
+		failIfErr(err)
+		Expect(links).To(HaveKeyWithValue("owner", target))
+		Expect(links).To(HaveKey(chunksLink))
+		Expect(readAll(hash)).To(Equal(value))
+	})
+
+	It("rejects a value with more chunks than store.maxnodelinks", func() {
+		maxNodeLinks = 2
+		defer func() { maxNodeLinks = defaultMaxNodeLinks }()
+
+		_, err := Store.PutReader(ctx, bytes.NewReader(make([]byte, 100)), nil)
+		Expect(err).To(MatchError(ContainSubstring("more than 2 chunks")))
+	})
+})
@@ -0,0 +1,64 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer holds the tracerRef set by SetTracer. Without a tracer no span is
+// started and no attribute is computed.
+var tracer atomic.Value
+
+type tracerRef struct {
+	t trace.Tracer
+}
+
+// SetTracer sets the OpenTelemetry tracer that getObj, putObj, batch
+// commits, Submit and Commit start spans with, for every store in the
+// process. A nil tracer turns tracing off, which is the default.
+func (s *store) SetTracer(t trace.Tracer) {
+	tracer.Store(tracerRef{t})
+}
+
+// startTrace starts a span named name as a child of any span in ctx. It
+// returns a nil span if no tracer is set, which the caller checks before
+// computing attributes.
+func startTrace(ctx context.Context, name string) (context.Context, trace.Span) {
+	ref, _ := tracer.Load().(tracerRef)
+	if ref.t == nil {
+		return ctx, nil
+	}
+	return ref.t.Start(ctx, name)
+}
+
+// endTrace records err, if any, on span and ends it. It does nothing for a
+// nil span.
+func endTrace(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
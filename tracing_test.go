@@ -0,0 +1,77 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing", func() {
+	var ctx context.Context
+	var recorder *tracetest.SpanRecorder
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		recorder = tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		Store.SetTracer(provider.Tracer("storeipfs-test"))
+	})
+
+	AfterEach(func() {
+		Store.SetTracer(nil)
+	})
+
+	It("records spans for a submit and commit", func() {
+		storeb := openStore(ctx)
+		_, err := storeb.Submit(ctx, testBlockWithTxns("traced", 1))
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+
+		spans := make(map[string]sdktrace.ReadOnlySpan)
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+		Expect(spans).To(HaveKey("storeipfs.Submit"))
+		Expect(spans).To(HaveKey("storeipfs.Commit"))
+		Expect(spans).To(HaveKey("storeipfs.batch.commit"))
+
+		commit := spans["storeipfs.batch.commit"]
+		Expect(commit.Parent().SpanID()).To(Equal(spans["storeipfs.Commit"].SpanContext().SpanID()))
+		var nodes int64
+		for _, kv := range commit.Attributes() {
+			if kv.Key == "ipfs.nodes" {
+				nodes = kv.Value.AsInt64()
+			}
+		}
+		Expect(nodes).To(BeNumerically(">", 0))
+	})
+
+	It("records nothing once the tracer is removed", func() {
+		Store.SetTracer(nil)
+		storeb := openStore(ctx)
+		_, err := storeb.Submit(ctx, testBlockWithTxns("untraced", 1))
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+		Expect(recorder.Ended()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,192 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"fmt"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	spec "github.com/blocktop/go-spec"
+)
+
+// MerkleTree is the key-value contract of a store's merkle tree. Values are
+// raw bytes and links map names to CIDs; the trie layout underneath is not
+// exposed.
+type MerkleTree interface {
+	// Root returns the CID of the tree's root node.
+	Root() string
+
+	// Get returns the value at key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// GetLinks returns the named links at key, or nil if there is no
+	// node at key.
+	GetLinks(ctx context.Context, key string) (spec.Links, error)
+
+	// Has reports whether key holds a value or named links.
+	Has(ctx context.Context, key string) (bool, error)
+
+	// Range calls yield with every key below prefix that holds a value, in
+	// lexical order, stopping at the first error returned by yield.
+	Range(ctx context.Context, prefix string, yield func(key string) error) error
+
+	// Walk calls fn for every key that holds a value or named links, in
+	// lexical order, stopping at the first error returned by fn.
+	Walk(ctx context.Context, fn func(key string, data []byte, links spec.Links) error) error
+
+	// Proof returns a proof of the value at key, for VerifyProof.
+	Proof(ctx context.Context, key string) (*MerkleProof, error)
+}
+
+// MerkleTreeWriter is a MerkleTree that can be changed, the tree of an open
+// store block.
+type MerkleTreeWriter interface {
+	MerkleTree
+
+	// Put sets the value at key.
+	Put(ctx context.Context, key string, value []byte) error
+
+	// PutLink sets the link name at key to targetCID.
+	PutLink(ctx context.Context, key string, name string, targetCID string) error
+
+	// Delete removes the value and named links at key.
+	Delete(ctx context.Context, key string) error
+}
+
+// MerkleTree returns the committed merkle tree. Reads see each commit as it
+// is made.
+func (s *store) MerkleTree() MerkleTree {
+	return &committedTree{m: s.merkleTree}
+}
+
+// MerkleTree returns the merkle tree of the block. It is read-only for a
+// block returned by GetBlock, and only usable until the block is committed
+// or reverted.
+func (s *storeBlock) MerkleTree() MerkleTreeWriter {
+	if s.readonly {
+		return readonlyTree{&committedTree{m: &merkleTreeStruct{api: s.store.api, root: s.merkleRoot}}}
+	}
+	return &batchTree{b: s.tree}
+}
+
+var _ MerkleTree = (*committedTree)(nil)
+var _ MerkleTreeWriter = (*batchTree)(nil)
+var _ MerkleTreeWriter = readonlyTree{}
+
+type committedTree struct {
+	m *merkleTreeStruct
+}
+
+func (t *committedTree) Root() string { return t.m.getRoot() }
+
+func (t *committedTree) Get(ctx context.Context, key string) ([]byte, error) {
+	return t.m.getValue(ctx, key)
+}
+
+func (t *committedTree) GetLinks(ctx context.Context, key string) (spec.Links, error) {
+	n, err := t.m.getNode(ctx, key, "")
+	if err != nil || n == nil {
+		return nil, err
+	}
+	return makeSpecLinks(namedLinks(n)), nil
+}
+
+func (t *committedTree) Has(ctx context.Context, key string) (bool, error) {
+	return t.m.has(ctx, key)
+}
+
+func (t *committedTree) Range(ctx context.Context, prefix string, yield func(key string) error) error {
+	return t.m.rangeKeys(ctx, prefix, yield)
+}
+
+func (t *committedTree) Walk(ctx context.Context, fn func(key string, data []byte, links spec.Links) error) error {
+	return t.m.walk(ctx, fn)
+}
+
+func (t *committedTree) Proof(ctx context.Context, key string) (*MerkleProof, error) {
+	return t.m.getProof(ctx, key)
+}
+
+type batchTree struct {
+	b *merkleTreeBatch
+}
+
+func (t *batchTree) Root() string { return t.b.getRoot() }
+
+func (t *batchTree) Get(ctx context.Context, key string) ([]byte, error) {
+	return t.b.getValue(ctx, key)
+}
+
+func (t *batchTree) GetLinks(ctx context.Context, key string) (spec.Links, error) {
+	n, err := t.b.getNode(ctx, key, "")
+	if err != nil || n == nil {
+		return nil, err
+	}
+	return makeSpecLinks(namedLinks(n)), nil
+}
+
+func (t *batchTree) Has(ctx context.Context, key string) (bool, error) {
+	return t.b.has(ctx, key)
+}
+
+func (t *batchTree) Range(ctx context.Context, prefix string, yield func(key string) error) error {
+	return t.b.rangeKeys(ctx, prefix, yield)
+}
+
+func (t *batchTree) Walk(ctx context.Context, fn func(key string, data []byte, links spec.Links) error) error {
+	return t.b.walk(ctx, fn)
+}
+
+func (t *batchTree) Proof(ctx context.Context, key string) (*MerkleProof, error) {
+	return t.b.getProof(ctx, key)
+}
+
+func (t *batchTree) Put(ctx context.Context, key string, value []byte) error {
+	return t.b.putValue(ctx, key, value)
+}
+
+func (t *batchTree) PutLink(ctx context.Context, key string, name string, targetCID string) error {
+	c, err := cid.Parse(targetCID)
+	if err != nil {
+		return fmt.Errorf("invalid link target %q for %s: %w", targetCID, key, err)
+	}
+	return t.b.putLink(ctx, key, &link{key: name, targetCid: c})
+}
+
+func (t *batchTree) Delete(ctx context.Context, key string) error {
+	return t.b.deleteKey(ctx, key)
+}
+
+// readonlyTree is a MerkleTreeWriter that refuses writes, for the trees of
+// blocks returned by GetBlock.
+type readonlyTree struct {
+	MerkleTree
+}
+
+func (readonlyTree) Put(context.Context, string, []byte) error {
+	return ErrStoreNotOpen
+}
+
+func (readonlyTree) PutLink(context.Context, string, string, string) error {
+	return ErrStoreNotOpen
+}
+
+func (readonlyTree) Delete(context.Context, string) error {
+	return ErrStoreNotOpen
+}
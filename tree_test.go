@@ -0,0 +1,145 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"errors"
+
+	spec "github.com/blocktop/go-spec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MerkleTree", func() {
+	var ctx context.Context
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("writes through an open block and reads the committed tree", func() {
+		blob, err := Store.Hash([]byte("tree blob"), nil)
+		failIfErr(err)
+
+		storeb := openStore(ctx)
+		var w MerkleTreeWriter = storeb.MerkleTree()
+		failIfErr(w.Put(ctx, "ifacekey", []byte("value")))
+		failIfErr(w.Put(ctx, "ifacekeychild", []byte("child")))
+		failIfErr(w.PutLink(ctx, "ifacekey", "blob", blob))
+		failIfErr(w.Put(ctx, "ifacegone", []byte("gone")))
+		failIfErr(w.Delete(ctx, "ifacegone"))
+		root, err := storeb.Submit(ctx, &testBlock{hash: "iface", number: 1})
+		failIfErr(err)
+		failIfErr(storeb.Commit(ctx))
+
+		var t MerkleTree = Store.MerkleTree()
+		Expect(t.Root()).To(Equal(Store.merkleTree.getRoot()))
+
+		value, err := t.Get(ctx, "ifacekey")
+		failIfErr(err)
+		Expect(value).To(Equal([]byte("value")))
+		links, err := t.GetLinks(ctx, "ifacekey")
+		failIfErr(err)
+		Expect(links).To(Equal(spec.Links{"blob": blob}))
+		ok, err := t.Has(ctx, "ifacegone")
+		failIfErr(err)
+		Expect(ok).To(BeFalse())
+
+		var keys []string
+		failIfErr(t.Range(ctx, "iface", func(key string) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		Expect(keys).To(Equal([]string{"ifacekey", "ifacekeychild"}))
+
+		proof, err := t.Proof(ctx, "ifacekey")
+		failIfErr(err)
+		ok, err = VerifyProof(t.Root(), "ifacekey", []byte("value"), proof)
+		failIfErr(err)
+		Expect(ok).To(BeTrue())
+
+		sb, err := Store.GetBlock(ctx, "iface")
+		failIfErr(err)
+		Expect(sb.(*storeBlock).GetRoot()).To(Equal(root))
+		hist := sb.(*storeBlock).MerkleTree()
+		value, err = hist.Get(ctx, "ifacekeychild")
+		failIfErr(err)
+		Expect(value).To(Equal([]byte("child")))
+		Expect(hist.Put(ctx, "ifacekey", []byte("changed"))).To(Equal(ErrStoreNotOpen))
+	})
+
+	Describe("named trees", func() {
+		treeRoot := func(name string) string {
+			t, err := Store.Tree(ctx, name)
+			failIfErr(err)
+			return t.Root()
+		}
+
+		It("commits namespaces with independent roots", func() {
+			storeb := openStore(ctx)
+			accounts, err := storeb.Tree(ctx, "accounts")
+			failIfErr(err)
+			contracts, err := storeb.Tree(ctx, "contracts")
+			failIfErr(err)
+			failIfErr(accounts.Put(ctx, "nskey", []byte("account")))
+			failIfErr(contracts.Put(ctx, "nskey", []byte("contract")))
+			_, err = storeb.Submit(ctx, &testBlock{hash: "ns1", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			for name, want := range map[string]string{"accounts": "account", "contracts": "contract"} {
+				t, err := Store.Tree(ctx, name)
+				failIfErr(err)
+				value, err := t.Get(ctx, "nskey")
+				failIfErr(err)
+				Expect(string(value)).To(Equal(want))
+			}
+			value, err := Store.merkleTree.getValue(ctx, "nskey")
+			failIfErr(err)
+			Expect(value).To(BeNil())
+
+			contractsRoot := treeRoot("contracts")
+			accountsRoot := treeRoot("accounts")
+			Expect(accountsRoot).NotTo(Equal(contractsRoot))
+
+			storeb = openStore(ctx)
+			accounts, err = storeb.Tree(ctx, "accounts")
+			failIfErr(err)
+			failIfErr(accounts.Put(ctx, "nskey", []byte("account2")))
+			_, err = storeb.Submit(ctx, &testBlock{hash: "ns2", number: 1})
+			failIfErr(err)
+			failIfErr(storeb.Commit(ctx))
+
+			Expect(treeRoot("accounts")).NotTo(Equal(accountsRoot))
+			Expect(treeRoot("contracts")).To(Equal(contractsRoot))
+
+			sb, err := Store.GetBlock(ctx, "ns1")
+			failIfErr(err)
+			old, err := sb.(*storeBlock).Tree(ctx, "accounts")
+			failIfErr(err)
+			value, err = old.Get(ctx, "nskey")
+			failIfErr(err)
+			Expect(string(value)).To(Equal("account"))
+		})
+
+		It("rejects reserved names", func() {
+			_, err := Store.Tree(ctx, val)
+			Expect(errors.Is(err, ErrInvalidLinkName)).To(BeTrue())
+		})
+	})
+})
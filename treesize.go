@@ -0,0 +1,121 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+
+	spec "github.com/blocktop/go-spec"
+)
+
+// treeSize counts the keys of a committed tree. It is set by a walk and
+// kept up by batch commits from the keys each batch adds and deletes.
+type treeSize struct {
+	known    bool
+	keys     int
+	maxDepth int
+}
+
+// commit adds the changes of b, committed on top of the counted tree. A
+// batch on another root is not counted against this tree, so the count is
+// dropped until the next walk.
+func (t *treeSize) commit(b *merkleTreeBatch) {
+	if !t.known {
+		return
+	}
+	if b.forked {
+		*t = treeSize{}
+		return
+	}
+	t.keys += b.added
+	if b.depth > t.maxDepth {
+		t.maxDepth = b.depth
+	}
+}
+
+// isEntry reports whether n holds a value or named links, which makes its
+// key one of the keys of the tree.
+func isEntry(n *node) bool {
+	return n.data != nil || len(namedLinks(n)) > 0
+}
+
+// isEntryValue reports whether putting value at a new key makes the key
+// an entry.
+func isEntryValue(value interface{}, valueIsLink bool) bool {
+	if valueIsLink {
+		return true
+	}
+	data, _, _ := valueData(value)
+	return data != nil
+}
+
+// countEntry counts the key of n as added or deleted by the batch if n
+// has become an entry or stopped being one since was.
+func (b *merkleTreeBatch) countEntry(was bool, n *node) {
+	is := isEntry(n)
+	switch {
+	case is && !was:
+		b.added++
+	case was && !is:
+		b.added--
+	}
+}
+
+// TreeSize returns the number of keys in the committed merkle tree that
+// hold a value or named links, and the length of the longest, which is
+// the depth of the trie. With exact set the tree is walked, fetching every
+// node. Otherwise the count kept since the last walk is returned, walking
+// only if there has been none since the store was opened or its root was
+// replaced.
+//
+// The kept count follows the keys put and deleted by committed blocks.
+// Keys copied into place by copySubtree are not counted, and the depth is
+// never lowered by deletes, so it can drift from the exact count until the
+// next exact call.
+func (s *store) TreeSize(ctx context.Context, exact bool) (keys int, maxDepth int, err error) {
+	return s.merkleTree.treeSize(ctx, exact)
+}
+
+func (m *merkleTreeStruct) treeSize(ctx context.Context, exact bool) (int, int, error) {
+	m.Lock()
+	size := m.size
+	root := m.root
+	m.Unlock()
+	if size.known && !exact {
+		return size.keys, size.maxDepth, nil
+	}
+
+	size = treeSize{known: true}
+	err := walkEntries(ctx, m.api, root, func(key string, _ []byte, _ spec.Links) error {
+		size.keys++
+		if len(key) > size.maxDepth {
+			size.maxDepth = len(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// a commit during the walk is not in the count
+	m.Lock()
+	if m.root == root {
+		m.size = size
+	}
+	m.Unlock()
+	return size.keys, size.maxDepth, nil
+}
@@ -0,0 +1,98 @@
+// Copyright © 2018 J. Strobus White.
+// This file is part of the blocktop blockchain development kit.
+//
+// Blocktop is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Blocktop is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with blocktop. If not, see <http://www.gnu.org/licenses/>.
+
+package storeipfs
+
+import (
+	"context"
+	"fmt"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+
+	coreiface "github.com/ipfs/go-ipfs/core/coreapi/interface"
+)
+
+// VerifyTree checks every node reachable from the current root through
+// block header and merkle tree child links, and reports each link to a
+// node that is not stored and each node that cannot be decoded. Named
+// links are followed only to nodes that are stored, since they may refer
+// to data the store does not hold, such as the targets of TreePutLink.
+//
+// Nodes are fetched one at a time and not retained; only the CIDs already
+// checked are kept. With firstOnly set, VerifyTree stops at the first
+// problem. The error is for failures of the check itself, such as a done
+// context.
+func (s *store) VerifyTree(ctx context.Context, firstOnly bool) ([]string, error) {
+	s.Lock()
+	root := s.root
+	s.Unlock()
+
+	type pending struct {
+		path       string
+		c          cid.Cid
+		structural bool
+	}
+	stack := []pending{{"root", root.cnode.Cid(), true}}
+	seen := make(map[string]bool)
+	var problems []string
+
+	for len(stack) > 0 {
+		if ctx.Err() != nil {
+			return problems, ctx.Err()
+		}
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[p.c.KeyString()] {
+			continue
+		}
+		seen[p.c.KeyString()] = true
+
+		ok, err := s.api.has(ctx, p.c)
+		if err != nil {
+			return problems, err
+		}
+		if !ok {
+			if p.structural {
+				problems = append(problems, fmt.Sprintf("%s: dangling link to %s", p.path, p.c))
+			}
+		} else {
+			n, err := getObj(ctx, s.api, coreiface.IpldPath(p.c).String())
+			if err != nil {
+				if ctx.Err() != nil {
+					return problems, ctx.Err()
+				}
+				problems = append(problems, fmt.Sprintf("%s: %s cannot be read: %v", p.path, p.c, err))
+			} else {
+				for name, lnk := range n.links {
+					next := pending{p.path + "/" + name, lnk.targetCid, len(name) == 1}
+					switch name {
+					case "parent":
+						// keep paths short along the block chain
+						next = pending{lnk.targetCid.String(), lnk.targetCid, true}
+					case "block", "merkle":
+						next.structural = true
+					}
+					stack = append(stack, next)
+				}
+			}
+		}
+
+		if firstOnly && len(problems) > 0 {
+			break
+		}
+	}
+	return problems, nil
+}